@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// maxPaletteSamples caps the pixels sampled to build the palette of an
+// animated GIF output
+const maxPaletteSamples = 200000
+
+// VP8X flag of animated WebP files
+const webpFlagAnimation = 0x02
+
+// processAnimation watermarks every frame of an animated GIF with one layout,
+// so logos don't jump between frames, and stores it as an animated GIF or WebP
+func (ip *ImageProcessor) processAnimation(ctx context.Context, out *processedImage, anim *gif.GIF, meta *imageMetadata) error {
+	startTime := time.Now()
+	if ip.recipient != nil && !ip.namesRecipient() {
+		return fmt.Errorf("animation %s can't be traced to recipient %s: invisible watermarks are skipped for animations, so the text watermark or QR code must include a recipient field", out.key, ip.recipient.ID)
+	}
+	ip.logger.Printf("Watermarking %d frames of animated GIF: %s", len(anim.Image), out.key)
+	if ip.hiddenPayload != "" {
+		ip.logger.Printf("WARNING: Invisible watermarks don't survive palette quantization, skipping for animation %s", out.key)
+	}
+	if len(ip.derivatives) > 0 {
+		ip.logger.Printf("WARNING: Derivatives aren't generated for animations, storing %s at full size", out.key)
+	}
+	if len(ip.transforms) > 0 {
+		ip.logger.Printf("WARNING: Transforms aren't applied to animations, skipping for %s", out.key)
+	}
+
+	encoded, bounds, err := ip.watermarkAnimation(out, anim)
+	if err != nil {
+		return err
+	}
+	if encoded, err = ip.embedMetadata(out.key, encoded, ip.animFormat, meta); err != nil {
+		return fmt.Errorf("failed to embed metadata in animation %s: %v", out.key, err)
+	}
+
+	out.encoded = encoded
+	out.format = ip.animFormat
+	out.bounds = bounds
+	if err := ip.storeOutput(ctx, out); err != nil {
+		return err
+	}
+
+	ip.logger.Printf("Successfully processed animation %s (%d frames) in %v", out.key, len(anim.Image), time.Since(startTime))
+	return nil
+}
+
+// watermarkAnimation redacts and watermarks every frame of an animated GIF
+// and encodes the result in the animation output format
+func (ip *ImageProcessor) watermarkAnimation(out *processedImage, anim *gif.GIF) ([]byte, image.Rectangle, error) {
+	key, text, qrURL := out.key, out.text, out.qrURL
+	frames := compositeFrames(anim)
+	if out.redaction != nil {
+		for i, frame := range frames {
+			var err error
+			if frames[i], out.redacted, err = out.redaction.apply(frame, 1); err != nil {
+				return nil, image.Rectangle{}, fmt.Errorf("failed to redact frame %d of %s: %v", i, key, err)
+			}
+		}
+		ip.logger.Printf("Redacted %d regions in %d frames of %s", out.redacted, len(frames), key)
+	}
+	var layout watermarkLayout
+	if ip.mode != ModeTiled && ip.caption == nil && !ip.unmarked {
+		layout = ip.planWatermarks(frames[0], text != "")
+	}
+	for i, frame := range frames {
+		var err error
+		switch {
+		case ip.unmarked:
+		case ip.mode == ModeTiled:
+			frames[i], err = ip.addTiledWatermark(frame, text)
+		case ip.caption != nil:
+			frames[i], err = ip.addCaptionBar(frame, text, qrURL)
+		default:
+			frames[i], err = ip.drawWatermarks(frame, layout, text)
+		}
+		if err == nil && qrURL != "" && ip.caption == nil && !ip.unmarked {
+			frames[i], err = ip.drawQRCode(frames[i], qrURL)
+		}
+		if err != nil {
+			return nil, image.Rectangle{}, fmt.Errorf("failed to add watermark to frame %d of %s: %v", i, key, err)
+		}
+	}
+
+	var encoded []byte
+	var err error
+	if ip.animFormat == FormatWebP {
+		encoded, err = encodeAnimatedWebP(frames, anim, ip.lossless, ip.quality)
+	} else {
+		encoded, err = encodeAnimatedGIF(frames, anim)
+	}
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to encode animation %s: %v", key, err)
+	}
+	return encoded, frames[0].Bounds(), nil
+}
+
+// compositeFrames renders every frame of a GIF onto the full canvas,
+// applying the disposal method of the frames before it
+func compositeFrames(anim *gif.GIF) []*image.NRGBA {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = anim.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(bounds)
+
+	frames := make([]*image.NRGBA, len(anim.Image))
+	for i, frame := range anim.Image {
+		var previous *image.NRGBA
+		disposal := byte(0)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = imaging.Clone(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// encodeAnimatedGIF quantizes full canvas frames to one shared palette and
+// encodes them with the delays, disposal methods and loop count of the source
+func encodeAnimatedGIF(frames []*image.NRGBA, anim *gif.GIF) ([]byte, error) {
+	pal, transparent := animationPalette(frames)
+
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, len(frames)),
+		Delay:     anim.Delay,
+		Disposal:  anim.Disposal,
+		LoopCount: anim.LoopCount,
+		Config: image.Config{
+			ColorModel: pal,
+			Width:      frames[0].Bounds().Dx(),
+			Height:     frames[0].Bounds().Dy(),
+		},
+	}
+	if transparent >= 0 {
+		out.BackgroundIndex = byte(transparent)
+	}
+
+	cache := make(map[color.NRGBA]uint8)
+	for i, frame := range frames {
+		paletted := image.NewPaletted(frame.Bounds(), pal)
+		for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+			for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+				c := frame.NRGBAAt(x, y)
+				if c.A < 128 && transparent >= 0 {
+					paletted.SetColorIndex(x, y, uint8(transparent))
+					continue
+				}
+				c.A = 255
+				index, ok := cache[c]
+				if !ok {
+					index = uint8(pal.Index(c))
+					cache[c] = index
+				}
+				paletted.SetColorIndex(x, y, index)
+			}
+		}
+		out.Image[i] = paletted
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// animationPalette builds a palette shared by all frames with median cut, so
+// static areas keep the same colors from frame to frame. It returns the index
+// of the transparent entry, or -1 when no frame has transparent pixels.
+func animationPalette(frames []*image.NRGBA) (color.Palette, int) {
+	total := 0
+	for _, frame := range frames {
+		total += frame.Rect.Dx() * frame.Rect.Dy()
+	}
+	step := total/maxPaletteSamples + 1
+
+	var samples []color.NRGBA
+	hasTransparency := false
+	n := 0
+	for _, frame := range frames {
+		for i := 0; i < len(frame.Pix); i += 4 {
+			if frame.Pix[i+3] < 128 {
+				hasTransparency = true
+				continue
+			}
+			if n++; n%step == 0 {
+				samples = append(samples, color.NRGBA{R: frame.Pix[i], G: frame.Pix[i+1], B: frame.Pix[i+2], A: 255})
+			}
+		}
+	}
+
+	size := 256
+	if hasTransparency {
+		size = 255
+	}
+	pal := medianCut(samples, size)
+	if len(pal) == 0 {
+		pal = color.Palette{color.Black}
+	}
+	if !hasTransparency {
+		return pal, -1
+	}
+	return append(pal, color.NRGBA{}), len(pal)
+}
+
+// medianCut splits the samples into at most n boxes along their widest
+// channel and returns the mean color of each box
+func medianCut(samples []color.NRGBA, n int) color.Palette {
+	if len(samples) == 0 {
+		return nil
+	}
+	boxes := [][]color.NRGBA{samples}
+	for len(boxes) < n {
+		// Split the box with the widest channel range
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			channel, r := widestChannel(box)
+			if r > bestRange {
+				best, bestChannel, bestRange = i, channel, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return channelOf(box[i], bestChannel) < channelOf(box[j], bestChannel) })
+		mid := len(box) / 2
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	pal := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b int
+		for _, c := range box {
+			r += int(c.R)
+			g += int(c.G)
+			b += int(c.B)
+		}
+		pal = append(pal, color.NRGBA{R: uint8(r / len(box)), G: uint8(g / len(box)), B: uint8(b / len(box)), A: 255})
+	}
+	return pal
+}
+
+// widestChannel returns the channel (0 red, 1 green, 2 blue) with the
+// largest range in a box, and that range
+func widestChannel(box []color.NRGBA) (int, int) {
+	lo := [3]int{255, 255, 255}
+	hi := [3]int{}
+	for _, c := range box {
+		for ch := 0; ch < 3; ch++ {
+			v := channelOf(c, ch)
+			lo[ch] = min(lo[ch], v)
+			hi[ch] = max(hi[ch], v)
+		}
+	}
+	channel := 0
+	for ch := 1; ch < 3; ch++ {
+		if hi[ch]-lo[ch] > hi[channel]-lo[channel] {
+			channel = ch
+		}
+	}
+	return channel, hi[channel] - lo[channel]
+}
+
+// channelOf returns one channel of a color
+func channelOf(c color.NRGBA, channel int) int {
+	switch channel {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	default:
+		return int(c.B)
+	}
+}
+
+// encodeAnimatedWebP encodes full canvas frames as an animated WebP with the
+// delays and loop count of the source GIF
+func encodeAnimatedWebP(frames []*image.NRGBA, anim *gif.GIF, lossless bool, quality int) ([]byte, error) {
+	var body []byte
+	appendChunk := func(fourCC string, data []byte) {
+		body = append(body, fourCC...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+		body = append(body, data...)
+		if len(data)&1 == 1 {
+			body = append(body, 0)
+		}
+	}
+
+	// GIF counts repeats after the first play, WebP counts plays
+	loops := 0
+	switch {
+	case anim.LoopCount < 0:
+		loops = 1
+	case anim.LoopCount > 0:
+		loops = anim.LoopCount + 1
+	}
+	animChunk := make([]byte, 6)
+	binary.LittleEndian.PutUint16(animChunk[4:], uint16(loops))
+
+	width, height := frames[0].Bounds().Dx(), frames[0].Bounds().Dy()
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagAnimation | webpFlagAlpha
+	putUint24(vp8x[4:], uint32(width-1))
+	putUint24(vp8x[7:], uint32(height-1))
+	appendChunk("VP8X", vp8x)
+	appendChunk("ANIM", animChunk)
+
+	for i, frame := range frames {
+		encoded, err := encodeWebP(frame, lossless, quality)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode frame %d: %v", i, err)
+		}
+		chunks, err := webpChunks(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		delay := 0
+		if i < len(anim.Delay) {
+			delay = anim.Delay[i] * 10
+		}
+		header := make([]byte, 16)
+		putUint24(header[6:], uint32(width-1))
+		putUint24(header[9:], uint32(height-1))
+		putUint24(header[12:], uint32(delay))
+		header[15] = 0x02 // Frames cover the whole canvas, so replace instead of blending
+
+		frameData := header
+		for _, chunk := range chunks {
+			if chunk.FourCC == "ALPH" || chunk.FourCC == "VP8 " || chunk.FourCC == "VP8L" {
+				frameData = append(frameData, chunk.FourCC...)
+				frameData = binary.LittleEndian.AppendUint32(frameData, uint32(len(chunk.Data)))
+				frameData = append(frameData, chunk.Data...)
+				if len(chunk.Data)&1 == 1 {
+					frameData = append(frameData, 0)
+				}
+			}
+		}
+		appendChunk("ANMF", frameData)
+	}
+
+	file := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(file[4:], uint32(4+len(body)))
+	file = append(file, "WEBP"...)
+	return append(file, body...), nil
+}
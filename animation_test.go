@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"log"
+	"testing"
+)
+
+// testAnimation returns a 3 frame GIF whose later frames only cover part of
+// the canvas
+func testAnimation() *gif.GIF {
+	full := image.NewPaletted(image.Rect(0, 0, 300, 400), palette.Plan9)
+	for i := range full.Pix {
+		full.Pix[i] = uint8(full.Palette.Index(color.RGBA{R: 30, G: 60, B: 120, A: 255}))
+	}
+	patch := image.NewPaletted(image.Rect(100, 50, 150, 100), palette.Plan9)
+	for i := range patch.Pix {
+		patch.Pix[i] = uint8(patch.Palette.Index(color.RGBA{R: 250, G: 250, B: 0, A: 255}))
+	}
+	patch2 := image.NewPaletted(image.Rect(10, 10, 40, 40), palette.Plan9)
+	for i := range patch2.Pix {
+		patch2.Pix[i] = uint8(patch2.Palette.Index(color.RGBA{R: 250, G: 0, B: 0, A: 255}))
+	}
+
+	return &gif.GIF{
+		Image:     []*image.Paletted{full, patch, patch2},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: 0,
+		Config:    image.Config{ColorModel: color.Palette(palette.Plan9), Width: 300, Height: 400},
+	}
+}
+
+func TestCompositeFrames(t *testing.T) {
+	frames := compositeFrames(testAnimation())
+	if len(frames) != 3 {
+		t.Fatalf("compositeFrames() returned %d frames, want 3", len(frames))
+	}
+
+	// Frame 2 draws over the first frame
+	if c := frames[1].NRGBAAt(120, 70); c.R < 200 || c.B > 50 {
+		t.Errorf("frame 1 patch = %v, want yellow", c)
+	}
+	if c := frames[1].NRGBAAt(5, 5); c.B < 100 {
+		t.Errorf("frame 1 background = %v, want the first frame", c)
+	}
+	// The patch of frame 2 is cleared before frame 3 is drawn
+	if c := frames[2].NRGBAAt(120, 70); c.A != 0 {
+		t.Errorf("frame 2 disposed area = %v, want transparent", c)
+	}
+	if c := frames[2].NRGBAAt(20, 20); c.R < 200 || c.G > 50 {
+		t.Errorf("frame 2 patch = %v, want red", c)
+	}
+}
+
+func TestWatermarkAnimation(t *testing.T) {
+	logo := solidImage(40, 20, color.White)
+	for _, format := range []string{FormatGIF, FormatWebP} {
+		t.Run(format, func(t *testing.T) {
+			if format == FormatWebP {
+				skipWithoutWebPEncoder(t)
+			}
+			ip := &ImageProcessor{
+				leftWatermark:  logo,
+				rightWatermark: logo,
+				mode:           ModeCorners,
+				placement:      PlacementFixed,
+				lumaThreshold:  DefaultLuminanceThreshold,
+				animFormat:     format,
+				quality:        DefaultWebPQuality,
+				logger:         log.New(io.Discard, "", 0),
+			}
+
+			encoded, bounds, err := ip.watermarkAnimation(&processedImage{key: "loop.gif"}, testAnimation())
+			if err != nil {
+				t.Fatalf("watermarkAnimation() error = %v", err)
+			}
+			if bounds != image.Rect(0, 0, 300, 400) {
+				t.Errorf("bounds = %v, want 300x400", bounds)
+			}
+
+			if format == FormatWebP {
+				chunks, err := webpChunks(encoded)
+				if err != nil {
+					t.Fatalf("webpChunks() error = %v", err)
+				}
+				frames := 0
+				for _, chunk := range chunks {
+					if chunk.FourCC == "ANMF" {
+						frames++
+					}
+				}
+				if chunks[0].FourCC != "VP8X" || chunks[1].FourCC != "ANIM" || frames != 3 {
+					t.Errorf("animated WebP has chunks %v, want VP8X, ANIM and 3 frames", chunks[0].FourCC)
+				}
+				return
+			}
+
+			out, err := gif.DecodeAll(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("Output is not a valid GIF: %v", err)
+			}
+			if len(out.Image) != 3 || out.Delay[2] != 30 || out.Disposal[1] != gif.DisposalBackground || out.LoopCount != 0 {
+				t.Errorf("output has %d frames, delays %v, disposal %v, loop %d", len(out.Image), out.Delay, out.Disposal, out.LoopCount)
+			}
+
+			// The left logo sits in the bottom-left corner of every frame
+			pt := cornerPoint("left", bounds, watermarkSize(logo)).Add(image.Pt(5, 5))
+			for i, frame := range out.Image {
+				if r, g, b, _ := frame.At(pt.X, pt.Y).RGBA(); r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+					t.Errorf("frame %d at %v = %d,%d,%d, want the white logo", i, pt, r>>8, g>>8, b>>8)
+				}
+			}
+		})
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	var samples []color.NRGBA
+	for i := 0; i < 100; i++ {
+		samples = append(samples, color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255})
+	}
+	pal := medianCut(samples, 16)
+	if len(pal) != 2 {
+		t.Fatalf("medianCut() returned %d colors, want 2", len(pal))
+	}
+	if pal.Index(color.NRGBA{R: 250, A: 255}) == pal.Index(color.NRGBA{B: 250, A: 255}) {
+		t.Error("medianCut() merged red and blue")
+	}
+}
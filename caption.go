@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Caption bar styles
+const (
+	BarStyleSolid = "solid" // A flat BAR_COLOR background
+	BarStyleBlur  = "blur"  // A blurred copy of the photo stretched behind it
+)
+
+// Caption bar defaults
+const (
+	DefaultBarHeight  = "12%"
+	DefaultBarColor   = "#000000"
+	DefaultFrameWidth = "3%"
+)
+
+// Limits that keep bars usable on small images
+const (
+	minBarHeight   = 32
+	barBlurDivisor = 40 // Blur sigma is the longer canvas side over this
+)
+
+// relativeSize is a length in pixels or a percentage of a reference length
+type relativeSize struct {
+	pixels  int
+	percent float64
+}
+
+// parseRelativeSize parses "120" as pixels or "12%" as a percentage
+func parseRelativeSize(name, value string) (relativeSize, error) {
+	if v, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return relativeSize{}, fmt.Errorf("%s must be a percentage between 0 and 100: %s", name, value)
+		}
+		return relativeSize{percent: percent}, nil
+	}
+	pixels, err := strconv.Atoi(value)
+	if err != nil || pixels <= 0 {
+		return relativeSize{}, fmt.Errorf("%s must be a positive number of pixels or a percentage: %s", name, value)
+	}
+	return relativeSize{pixels: pixels}, nil
+}
+
+// of resolves the size against a reference length
+func (s relativeSize) of(reference int) int {
+	if s.pixels > 0 {
+		return s.pixels
+	}
+	return int(math.Round(float64(reference) * s.percent / 100))
+}
+
+// String formats the size the way it is configured
+func (s relativeSize) String() string {
+	if s.pixels > 0 {
+		return strconv.Itoa(s.pixels)
+	}
+	return strconv.FormatFloat(s.percent, 'f', -1, 64) + "%"
+}
+
+// captionBar holds the settings of the bar and frame modes
+type captionBar struct {
+	height relativeSize // Percentages are of the image height
+	style  string
+	color  color.NRGBA
+	frame  relativeSize // Percentages are of the shorter image side, unused in bar mode
+}
+
+// newCaptionBar reads the caption bar settings
+func newCaptionBar() (*captionBar, error) {
+	heightValue, styleValue, colorValue, frameValue := os.Getenv(EnvBarHeight), os.Getenv(EnvBarStyle), os.Getenv(EnvBarColor), os.Getenv(EnvFrameWidth)
+	if heightValue == "" {
+		heightValue = DefaultBarHeight
+	}
+	if styleValue == "" {
+		styleValue = BarStyleSolid
+	}
+	if colorValue == "" {
+		colorValue = DefaultBarColor
+	}
+	if frameValue == "" {
+		frameValue = DefaultFrameWidth
+	}
+
+	bar := &captionBar{style: styleValue}
+	var err error
+	if bar.height, err = parseRelativeSize(EnvBarHeight, heightValue); err != nil {
+		return nil, err
+	}
+	if styleValue != BarStyleSolid && styleValue != BarStyleBlur {
+		return nil, fmt.Errorf("invalid %s: %s (must be %s or %s)", EnvBarStyle, styleValue, BarStyleSolid, BarStyleBlur)
+	}
+	if bar.color, err = parseHexColor(colorValue); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", EnvBarColor, err)
+	}
+	if bar.frame, err = parseRelativeSize(EnvFrameWidth, frameValue); err != nil {
+		return nil, err
+	}
+	return bar, nil
+}
+
+// validateCaptionSettings checks the optional caption bar settings
+func validateCaptionSettings() error {
+	_, err := newCaptionBar()
+	return err
+}
+
+// captionLayout is where the photo and the bar go on the grown canvas
+type captionLayout struct {
+	canvas image.Rectangle
+	photo  image.Point     // Top left corner of the photo
+	bar    image.Rectangle // Area holding the logos and text
+	inset  int             // Horizontal margin that aligns content with the photo
+}
+
+// layout computes the canvas of a width x height photo. Bar mode only adds
+// the bar below the photo, frame mode also borders the other three sides.
+func (b *captionBar) layout(width, height int, frame bool) captionLayout {
+	barHeight := max(b.height.of(height), minBarHeight)
+	border := 0
+	if frame {
+		border = max(b.frame.of(min(width, height)), 1)
+	}
+	canvas := image.Rect(0, 0, width+2*border, height+border+barHeight)
+	return captionLayout{
+		canvas: canvas,
+		photo:  image.Pt(border, border),
+		bar:    image.Rect(0, border+height, canvas.Dx(), canvas.Dy()),
+		inset:  border,
+	}
+}
+
+// addCaptionBar grows the canvas with a bar below the image, or a frame
+// around it, and draws the logos, text and QR code inside the bar so no
+// photo pixels are covered
+func (ip *ImageProcessor) addCaptionBar(img *image.NRGBA, text, qrURL string) (*image.NRGBA, error) {
+	l := ip.caption.layout(img.Bounds().Dx(), img.Bounds().Dy(), ip.mode == ModeFrame)
+
+	var canvas *image.NRGBA
+	if ip.caption.style == BarStyleBlur {
+		// Stretch the photo over the whole canvas and blur it so the bar
+		// continues its colors
+		sigma := float64(max(l.canvas.Dx(), l.canvas.Dy())) / barBlurDivisor
+		canvas = imaging.Blur(imaging.Resize(img, l.canvas.Dx(), l.canvas.Dy(), imaging.Linear), sigma)
+	} else {
+		canvas = imaging.New(l.canvas.Dx(), l.canvas.Dy(), ip.caption.color)
+	}
+	canvas = imaging.Paste(canvas, img, l.photo)
+	ip.logger.Printf("Grew canvas to %dx%d for a %dpx %s bar", l.canvas.Dx(), l.canvas.Dy(), l.bar.Dy(), ip.caption.style)
+
+	// Logos fill the bar height minus padding, without being enlarged
+	padding := min(WatermarkPadding, l.bar.Dy()/5)
+	contentHeight := l.bar.Dy() - 2*padding
+	fit := func(wm image.Image) image.Image {
+		if h := min(contentHeight, MaxWatermarkHeight); wm.Bounds().Dy() > h {
+			return imaging.Resize(wm, 0, h, imaging.Lanczos)
+		}
+		return wm
+	}
+	centerY := func(h int) int {
+		return l.bar.Min.Y + (l.bar.Dy()-h)/2
+	}
+
+	left := fit(ip.selectVariant("left", canvas, ip.leftWatermark, ip.leftDark, l.bar))
+	right := fit(ip.selectVariant("right", canvas, ip.rightWatermark, ip.rightDark, l.bar))
+	rightX := l.canvas.Dx() - l.inset - padding - right.Bounds().Dx()
+	canvas = imaging.Overlay(canvas, left, image.Pt(l.inset+padding, centerY(left.Bounds().Dy())), ip.watermarkOpacity())
+	canvas = imaging.Overlay(canvas, right, image.Pt(rightX, centerY(right.Bounds().Dy())), ip.watermarkOpacity())
+
+	// The QR code fills the bar height next to the right logo
+	if qrURL != "" {
+		code, err := ip.qr.render(qrURL, contentHeight)
+		if err != nil {
+			return nil, err
+		}
+		x := rightX - padding - code.Bounds().Dx()
+		canvas = imaging.Overlay(canvas, code, image.Pt(x, centerY(code.Bounds().Dy())), 1.0)
+		ip.logger.Printf("Added %dpx QR code for %s in the caption bar", code.Bounds().Dx(), qrURL)
+	}
+
+	// Text goes in the middle of the bar, scaled down when it doesn't fit
+	if text != "" {
+		textImg, err := renderText(ip.textFont, ip.textSize, text, ip.textColor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render text watermark: %v", err)
+		}
+		var textMark image.Image = textImg
+		if textImg.Bounds().Dy() > contentHeight {
+			textMark = imaging.Resize(textImg, 0, contentHeight, imaging.Lanczos)
+		}
+		x := (l.canvas.Dx() - textMark.Bounds().Dx()) / 2
+		canvas = imaging.Overlay(canvas, textMark, image.Pt(x, centerY(textMark.Bounds().Dy())), ip.watermarkOpacity())
+		ip.logger.Printf("Added text watermark in the caption bar")
+	}
+
+	ip.logger.Printf("Watermarks added successfully")
+	return canvas, nil
+}
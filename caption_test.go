@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestParseRelativeSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"120", 120, false},
+		{"12%", 96, false},
+		{"2.5%", 20, false},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"150%", 0, true},
+		{"tall", 0, true},
+	}
+	for _, tt := range tests {
+		size, err := parseRelativeSize(EnvBarHeight, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRelativeSize(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && size.of(800) != tt.want {
+			t.Errorf("parseRelativeSize(%q).of(800) = %d, want %d", tt.value, size.of(800), tt.want)
+		}
+	}
+}
+
+func TestCaptionLayout(t *testing.T) {
+	bar := &captionBar{height: relativeSize{percent: 10}, frame: relativeSize{pixels: 20}}
+
+	l := bar.layout(800, 600, false)
+	if l.canvas != image.Rect(0, 0, 800, 660) || l.photo != image.Pt(0, 0) || l.bar != image.Rect(0, 600, 800, 660) {
+		t.Errorf("bar layout = %+v", l)
+	}
+
+	l = bar.layout(800, 600, true)
+	if l.canvas != image.Rect(0, 0, 840, 680) || l.photo != image.Pt(20, 20) || l.bar != image.Rect(0, 620, 840, 680) {
+		t.Errorf("frame layout = %+v", l)
+	}
+
+	// Bars on small images keep room for the logos
+	if l := bar.layout(100, 50, false); l.bar.Dy() != minBarHeight {
+		t.Errorf("small image bar height = %d, want %d", l.bar.Dy(), minBarHeight)
+	}
+}
+
+func TestAddCaptionBarLeavesPhotoUntouched(t *testing.T) {
+	photo := noisyImage(400, 300, image.Rect(0, 0, 400, 300))
+	logo := solidImage(300, 300, color.NRGBA{R: 255, A: 255})
+
+	for _, mode := range []string{ModeBar, ModeFrame} {
+		for _, style := range []string{BarStyleSolid, BarStyleBlur} {
+			t.Run(mode+" "+style, func(t *testing.T) {
+				ip := &ImageProcessor{
+					leftWatermark:  logo,
+					rightWatermark: logo,
+					mode:           mode,
+					caption: &captionBar{
+						height: relativeSize{pixels: 60},
+						style:  style,
+						color:  color.NRGBA{A: 255},
+						frame:  relativeSize{pixels: 10},
+					},
+					logger: log.New(io.Discard, "", 0),
+				}
+				out, err := ip.addWatermark(photo, "", "")
+				if err != nil {
+					t.Fatalf("addWatermark() error = %v", err)
+				}
+				l := ip.caption.layout(400, 300, mode == ModeFrame)
+				if out.Bounds() != l.canvas {
+					t.Fatalf("canvas = %v, want %v", out.Bounds(), l.canvas)
+				}
+
+				for y := 0; y < 300; y++ {
+					for x := 0; x < 400; x++ {
+						if got, want := out.At(l.photo.X+x, l.photo.Y+y), photo.NRGBAAt(x, y); color.NRGBAModel.Convert(got) != want {
+							t.Fatalf("photo pixel (%d, %d) = %v, want %v", x, y, got, want)
+						}
+					}
+				}
+
+				// Logos are scaled to the bar and drawn inside it
+				red := 0
+				for y := l.bar.Min.Y; y < l.bar.Max.Y; y++ {
+					for x := 0; x < l.canvas.Dx(); x++ {
+						if c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA); c.R > 200 && c.G < 50 {
+							red++
+						}
+					}
+				}
+				if want := 2 * 36 * 36; red < want*9/10 || red > want*11/10 {
+					t.Errorf("bar has %d logo pixels, want about %d", red, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDecoderTimeout bounds how long an external decoder may run
+const DefaultDecoderTimeout = 60 * time.Second
+
+// Placeholders in external decoder commands
+const (
+	decoderInput  = "{input}"  // Path of the source file; stdin is used when absent
+	decoderOutput = "{output}" // Path of a PNG file to write; stdout is read when absent
+)
+
+// imageDecoder turns the bytes of a source image into pixels
+type imageDecoder interface {
+	decode(ctx context.Context, data []byte, ext string) (image.Image, error)
+	String() string
+}
+
+// builtinDecoder decodes the formats supported by the Go libraries
+type builtinDecoder struct{}
+
+func (builtinDecoder) decode(_ context.Context, data []byte, _ string) (image.Image, error) {
+	return decodeImage(data)
+}
+
+func (builtinDecoder) String() string {
+	return "built-in"
+}
+
+// commandDecoder shells out to a locally installed converter that writes a
+// format the built-in decoder reads, usually PNG
+type commandDecoder struct {
+	args    []string
+	timeout time.Duration
+}
+
+func (d *commandDecoder) String() string {
+	return d.args[0]
+}
+
+// decode runs the converter on data and decodes what it writes. ext is the
+// extension given to the input file, since some converters rely on it.
+func (d *commandDecoder) decode(ctx context.Context, data []byte, ext string) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "decoder-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decoder directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "source"+ext)
+	output := filepath.Join(dir, "decoded.png")
+	var usesInput, usesOutput bool
+	args := make([]string, len(d.args))
+	for i, arg := range d.args {
+		usesInput = usesInput || strings.Contains(arg, decoderInput)
+		usesOutput = usesOutput || strings.Contains(arg, decoderOutput)
+		args[i] = strings.NewReplacer(decoderInput, input, decoderOutput, output).Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if usesInput {
+		if err := os.WriteFile(input, data, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write decoder input: %v", err)
+		}
+	} else {
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %v", d, d.timeout)
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", d, err, strings.TrimSpace(stderr.String()))
+	}
+
+	decoded := stdout.Bytes()
+	if usesOutput {
+		if decoded, err = os.ReadFile(output); err != nil {
+			return nil, fmt.Errorf("%s did not write its output: %v", d, err)
+		}
+	}
+	img, err := decodeImage(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the output of %s: %v", d, err)
+	}
+	return img, nil
+}
+
+// decoderRegistry maps lowercase extensions (".heic") and MIME types
+// ("image/heic") to the decoder that reads them
+type decoderRegistry map[string]imageDecoder
+
+// newDecoderRegistry registers the built-in formats, then the external
+// decoders of spec, which override them. spec is a semicolon separated list
+// of "<extensions and MIME types>=<command>" entries, for example
+// ".heic,.heif,image/heic=heif-convert {input} {output}".
+func newDecoderRegistry(spec string, timeout time.Duration) (decoderRegistry, error) {
+	registry := decoderRegistry{}
+	for _, f := range imageFormats {
+		if !f.builtin {
+			continue
+		}
+		for _, ext := range f.extensions {
+			registry[ext] = builtinDecoder{}
+		}
+		registry[f.mime] = builtinDecoder{}
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		keys, command, ok := strings.Cut(entry, "=")
+		args := strings.Fields(command)
+		if !ok || len(args) == 0 {
+			return nil, fmt.Errorf("invalid decoder %q (must be <extensions>=<command>)", strings.TrimSpace(entry))
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, fmt.Errorf("decoder command %s not found: %v", args[0], err)
+		}
+		decoder := &commandDecoder{args: args, timeout: timeout}
+		for _, key := range strings.Split(keys, ",") {
+			key = strings.ToLower(strings.TrimSpace(key))
+			if !strings.HasPrefix(key, ".") && !strings.Contains(key, "/") {
+				return nil, fmt.Errorf("invalid decoder key %q (must be an extension like .heic or a MIME type like image/heic)", key)
+			}
+			registry[key] = decoder
+		}
+	}
+	return registry, nil
+}
+
+// decoderTimeout returns the configured external decoder timeout
+func decoderTimeout() (time.Duration, error) {
+	v := os.Getenv(EnvDecoderTimeout)
+	if v == "" {
+		return DefaultDecoderTimeout, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds: %s", EnvDecoderTimeout, v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// validateDecoderSettings checks the optional external decoder settings
+func validateDecoderSettings() error {
+	timeout, err := decoderTimeout()
+	if err != nil {
+		return err
+	}
+	_, err = newDecoderRegistry(os.Getenv(EnvExternalDecoders), timeout)
+	return err
+}
+
+// handlesExtension reports whether a key's extension has a decoder
+func (r decoderRegistry) handlesExtension(key string) bool {
+	return r[strings.ToLower(filepath.Ext(key))] != nil
+}
+
+// lookup picks the decoder for an object. A detected format decides on its
+// own, so a HEIC photo saved as .jpg still reaches the HEIC decoder; content
+// nothing recognizes falls back to the key's extension and Content-Type.
+func (r decoderRegistry) lookup(key, contentType, format string) imageDecoder {
+	for _, f := range imageFormats {
+		if f.name != format {
+			continue
+		}
+		// An external decoder registered under any name of the format
+		// replaces the built-in one
+		var found imageDecoder
+		for _, name := range append([]string{f.mime}, f.extensions...) {
+			switch d := r[name].(type) {
+			case *commandDecoder:
+				return d
+			case builtinDecoder:
+				found = d
+			}
+		}
+		return found
+	}
+	if d := r[strings.ToLower(filepath.Ext(key))]; d != nil {
+		return d
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return r[strings.ToLower(strings.TrimSpace(mediaType))]
+}
+
+// sourceExtension returns the extension an external decoder's input file gets
+func sourceExtension(key, format string) string {
+	for _, f := range imageFormats {
+		if f.name == format {
+			return f.extensions[0]
+		}
+	}
+	return strings.ToLower(filepath.Ext(key))
+}
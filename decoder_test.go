@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoderRegistryLookup(t *testing.T) {
+	registry, err := newDecoderRegistry(".heic,.HEIF, image/heic=cat;image/tiff=cat", time.Second)
+	if err != nil {
+		t.Fatalf("newDecoderRegistry() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		contentType string
+		format      string
+		want        string
+	}{
+		{"HEIC content", "photo.heic", "", "heic", "cat"},
+		{"HEIC saved as .jpg", "photo.jpg", "image/jpeg", "heic", "cat"},
+		{"JPEG saved as .heic", "photo.heic", "", "jpeg", "built-in"},
+		{"Overridden built-in", "scan.tif", "", "tiff", "cat"},
+		{"Unrecognized content by extension", "photo.HEIF", "", "", "cat"},
+		{"Unrecognized content by Content-Type", "upload-7f3a", "image/heic; charset=binary", "", "cat"},
+		{"AVIF without a decoder", "photo.avif", "image/avif", "avif", ""},
+		{"Unknown", "notes.txt", "text/plain", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if d := registry.lookup(tt.key, tt.contentType, tt.format); d != nil {
+				got = d.String()
+			}
+			if got != tt.want {
+				t.Errorf("lookup() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if !registry.handlesExtension("uploads/IMG_0001.HEIC") || registry.handlesExtension("photo.avif") {
+		t.Error("handlesExtension() did not follow the configured extensions")
+	}
+}
+
+func TestDecoderRegistryErrors(t *testing.T) {
+	for _, spec := range []string{
+		".heic",
+		".heic=",
+		"heic=cat",
+		".heic=no-such-decoder-command {input}",
+	} {
+		if _, err := newDecoderRegistry(spec, time.Second); err == nil {
+			t.Errorf("newDecoderRegistry(%q) expected error", spec)
+		}
+	}
+}
+
+func TestCommandDecoder(t *testing.T) {
+	var source bytes.Buffer
+	if err := png.Encode(&source, solidImage(12, 8, color.NRGBA{0, 128, 255, 255})); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"stdin to stdout", []string{"cat"}},
+		{"files", []string{"cp", decoderInput, decoderOutput}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &commandDecoder{args: tt.args, timeout: 5 * time.Second}
+			img, err := d.decode(context.Background(), source.Bytes(), ".heic")
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if img.Bounds().Dx() != 12 || img.Bounds().Dy() != 8 {
+				t.Errorf("decode() size = %v, want 12x8", img.Bounds())
+			}
+		})
+	}
+
+	failing := &commandDecoder{args: []string{"sh", "-c", "echo broken file >&2; exit 1"}, timeout: 5 * time.Second}
+	if _, err := failing.decode(context.Background(), source.Bytes(), ".heic"); err == nil || !strings.Contains(err.Error(), "broken file") {
+		t.Errorf("decode() error = %v, want the converter's stderr", err)
+	}
+
+	slow := &commandDecoder{args: []string{"sleep", "5"}, timeout: 50 * time.Millisecond}
+	if _, err := slow.decode(context.Background(), source.Bytes(), ".heic"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("decode() error = %v, want a timeout", err)
+	}
+}
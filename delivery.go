@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DeliveryManifestName is the object written under TARGET_PREFIX that maps
+// recipient IDs to recipients
+const DeliveryManifestName = "manifest.json"
+
+// DefaultRecipientPayload is the invisible watermark embedded in deliveries
+// when INVISIBLE_WATERMARK isn't set
+const DefaultRecipientPayload = "{recipient.id}"
+
+// recipientIDPattern restricts IDs to characters that are safe in S3 prefixes
+var recipientIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// recipient is an entry of the delivery recipient list
+type recipient struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// deliveryManifest records which recipient received which copies
+type deliveryManifest struct {
+	Created    time.Time        `json:"created"`
+	Source     string           `json:"source"`
+	Recipients []deliveryRecord `json:"recipients"`
+}
+
+// deliveryRecord is the manifest entry of one recipient
+type deliveryRecord struct {
+	recipient
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// loadRecipients reads a JSON array of recipients and checks that their IDs
+// are unique and usable as a prefix and, when payloadMax is positive, fit in
+// the invisible watermark
+func loadRecipients(path string, payloadMax int) ([]recipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipients %s: %v", path, err)
+	}
+	var recipients []recipient
+	if err := json.Unmarshal(data, &recipients); err != nil {
+		return nil, fmt.Errorf("failed to parse recipients %s: %v", path, err)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("recipients %s is empty", path)
+	}
+
+	seen := make(map[string]bool, len(recipients))
+	for _, r := range recipients {
+		if !recipientIDPattern.MatchString(r.ID) {
+			return nil, fmt.Errorf("invalid recipient ID %q: only letters, digits, '.', '_' and '-' are allowed", r.ID)
+		}
+		if payloadMax > 0 && len(r.ID) > payloadMax {
+			return nil, fmt.Errorf("recipient ID %q is longer than the %d bytes the invisible watermark can hold", r.ID, payloadMax)
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("duplicate recipient ID %q", r.ID)
+		}
+		seen[r.ID] = true
+	}
+	return recipients, nil
+}
+
+// validateDeliverySettings checks the optional recipient list
+func validateDeliverySettings() error {
+	path := os.Getenv(EnvRecipientsPath)
+	if path == "" {
+		return nil
+	}
+	payloadMax := 0
+	if os.Getenv(EnvInvisibleWatermark) == "" {
+		payloadMax = invisiblePayloadMax
+	}
+	_, err := loadRecipients(path, payloadMax)
+	return err
+}
+
+// addTo exposes the recipient to templates as recipient.id, recipient.name
+// and recipient.email
+func (r *recipient) addTo(vars templateVars) {
+	vars["recipient.id"] = r.ID
+	vars["recipient.name"] = r.Name
+	vars["recipient.email"] = r.Email
+}
+
+// namesRecipient reports whether the visible watermarks include a recipient
+// field. It's the only trace an animation carries, since animations skip the
+// invisible watermark.
+func (ip *ImageProcessor) namesRecipient() bool {
+	if ip.unmarked {
+		return false
+	}
+	uses := func(template string) bool {
+		return strings.Contains(template, "{recipient.")
+	}
+	return uses(ip.textTemplate) || (ip.qr != nil && uses(ip.qr.template))
+}
+
+// prefixDir ends a non-empty prefix with a slash, so recipient prefixes and
+// the manifest are nested under it rather than appended to its last segment
+func prefixDir(prefix string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return prefix + "/"
+	}
+	return prefix
+}
+
+// forRecipient returns a copy of the processor that writes the outputs,
+// sidecars and run report of one recipient to their own prefixes and path
+func (ip *ImageProcessor) forRecipient(r *recipient) *ImageProcessor {
+	delivery := *ip
+	delivery.recipient = r
+	delivery.targetPrefix = prefixDir(ip.targetPrefix) + r.ID + "/"
+	if ip.provenance != nil && ip.provenance.prefix != "" {
+		provenance := *ip.provenance
+		provenance.prefix = prefixDir(provenance.prefix) + r.ID + "/"
+		delivery.provenance = &provenance
+	}
+	if ip.reportPath != "" {
+		delivery.reportPath = ip.reportPath + "." + r.ID
+	}
+	return &delivery
+}
+
+// ProcessDeliveries runs ProcessImages once per recipient, writing each copy
+// under TARGET_PREFIX/<recipient ID>/, and uploads a manifest of the
+// deliveries. A failed recipient doesn't stop the others.
+func (ip *ImageProcessor) ProcessDeliveries(ctx context.Context) error {
+	manifest := deliveryManifest{
+		Created: time.Now().UTC(),
+		Source:  fmt.Sprintf("s3://%s/%s", ip.sourceBucket, ip.sourcePrefix),
+	}
+
+	var failed []string
+	for i := range ip.recipients {
+		r := &ip.recipients[i]
+		delivery := ip.forRecipient(r)
+		ip.logger.Printf("Delivering to recipient %s (%s) under %s", r.ID, r.Name, delivery.targetPrefix)
+
+		err := delivery.ProcessImages(ctx)
+		record := deliveryRecord{recipient: *r, Prefix: delivery.targetPrefix, Keys: delivery.report.outputKeys()}
+		if err != nil {
+			ip.logger.Printf("ERROR: Delivery to recipient %s failed: %v", r.ID, err)
+			record.Error = err.Error()
+			failed = append(failed, r.ID)
+		}
+		manifest.Recipients = append(manifest.Recipients, record)
+	}
+
+	if err := ip.uploadManifest(ctx, &manifest); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("delivery failed for %d of %d recipients: %s", len(failed), len(ip.recipients), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// uploadManifest writes the delivery manifest next to the recipient prefixes
+func (ip *ImageProcessor) uploadManifest(ctx context.Context, manifest *deliveryManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode delivery manifest: %v", err)
+	}
+
+	key := prefixDir(ip.targetPrefix) + DeliveryManifestName
+	contentType := "application/json"
+	_, err = ip.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &ip.sourceBucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: &contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload delivery manifest %s: %v", key, err)
+	}
+	ip.logger.Printf("Uploaded delivery manifest for %d recipients to %s", len(manifest.Recipients), key)
+	return nil
+}
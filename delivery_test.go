@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRecipients(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		payloadMax int
+		wantCount  int
+		wantErr    bool
+	}{
+		{"Valid", `[{"id":"acme","name":"Acme Corp"},{"id":"globex-01","name":"Globex","email":"photo@globex.example"}]`, invisiblePayloadMax, 2, false},
+		{"Empty list", `[]`, 0, 0, true},
+		{"Invalid JSON", `{"id":"acme"}`, 0, 0, true},
+		{"Missing ID", `[{"name":"Acme Corp"}]`, 0, 0, true},
+		{"Slash in ID", `[{"id":"acme/eu","name":"Acme Corp"}]`, 0, 0, true},
+		{"Duplicate ID", `[{"id":"acme"},{"id":"acme"}]`, 0, 0, true},
+		{"ID too long for payload", `[{"id":"a-very-long-recipient"}]`, invisiblePayloadMax, 0, true},
+		{"Long ID with custom payload", `[{"id":"a-very-long-recipient"}]`, 0, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recipients.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("Failed to write recipients: %v", err)
+			}
+
+			recipients, err := loadRecipients(path, tt.payloadMax)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRecipients() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(recipients) != tt.wantCount {
+				t.Errorf("loadRecipients() returned %d recipients, want %d", len(recipients), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestRecipientTemplateVars(t *testing.T) {
+	r := &recipient{ID: "acme", Name: "Acme Corp"}
+	vars := newTemplateVars("bucket", "source/photo.jpg", time.Date(2024, 12, 30, 15, 47, 3, 0, time.UTC), nil, nil, nil)
+	r.addTo(vars)
+
+	if got := renderTemplate("Licensed to {recipient.name} ({recipient.id})", vars); got != "Licensed to Acme Corp (acme)" {
+		t.Errorf("renderTemplate() = %q", got)
+	}
+	if got := renderTemplate(DefaultRecipientPayload, vars); got != "acme" {
+		t.Errorf("default payload = %q, want %q", got, "acme")
+	}
+}
+
+func TestAnimationDeliveryNeedsVisibleRecipient(t *testing.T) {
+	ip := &ImageProcessor{
+		recipient:     &recipient{ID: "acme", Name: "Acme Corp"},
+		textTemplate:  "© {year}",
+		hiddenPayload: DefaultRecipientPayload,
+		logger:        log.New(io.Discard, "", 0),
+	}
+	if ip.namesRecipient() {
+		t.Errorf("namesRecipient() = true without a recipient field")
+	}
+	// The animation fails before anything is uploaded
+	err := ip.processAnimation(context.Background(), &processedImage{key: "loop.gif"}, testAnimation(), &imageMetadata{})
+	if err == nil {
+		t.Errorf("processAnimation() delivered an animation without a recipient trace")
+	}
+
+	ip.textTemplate = "Licensed to {recipient.name}"
+	if !ip.namesRecipient() {
+		t.Errorf("namesRecipient() = false with %q", ip.textTemplate)
+	}
+	ip.textTemplate = ""
+	ip.qr = &qrSettings{template: "https://example.com/l/{recipient.id}"}
+	if !ip.namesRecipient() {
+		t.Errorf("namesRecipient() = false with a QR code naming the recipient")
+	}
+	ip.unmarked = true
+	if ip.namesRecipient() {
+		t.Errorf("namesRecipient() = true without visible watermarks")
+	}
+}
+
+func TestForRecipient(t *testing.T) {
+	ip := &ImageProcessor{
+		targetPrefix: "deliveries",
+		provenance:   &provenanceConfig{prefix: "provenance"},
+		reportPath:   "/tmp/report.json",
+	}
+	r := &recipient{ID: "acme"}
+
+	delivery := ip.forRecipient(r)
+	if delivery.recipient != r || delivery.targetPrefix != "deliveries/acme/" || delivery.provenance.prefix != "provenance/acme/" {
+		t.Errorf("forRecipient() = recipient %v, target prefix %q, provenance prefix %q", delivery.recipient, delivery.targetPrefix, delivery.provenance.prefix)
+	}
+	if delivery.reportPath != "/tmp/report.json.acme" {
+		t.Errorf("forRecipient() report path = %q, want /tmp/report.json.acme", delivery.reportPath)
+	}
+	if ip.targetPrefix != "deliveries" || ip.provenance.prefix != "provenance" || ip.reportPath != "/tmp/report.json" {
+		t.Error("forRecipient() changed the shared processor")
+	}
+
+	ip.reportPath = ""
+	if delivery := ip.forRecipient(r); delivery.reportPath != "" {
+		t.Errorf("forRecipient() without REPORT_PATH wrote a report to %q", delivery.reportPath)
+	}
+}
+
+func TestPrefixDir(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":               "",
+		"deliveries":     "deliveries/",
+		"deliveries/":    "deliveries/",
+		"out/2024/april": "out/2024/april/",
+	} {
+		if got := prefixDir(prefix); got != want {
+			t.Errorf("prefixDir(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Derivative fit modes
+const (
+	FitContain = "contain" // Scale down to fit inside the box, keeping the whole image
+	FitCover   = "cover"   // Fill the box exactly, cropping the center of the image
+)
+
+// DefaultDerivativeSuffix is added to the key of each derivative before its
+// extension
+const DefaultDerivativeSuffix = "-{derivative}"
+
+// Smallest logo height and text size in pixels a rendition shows. When
+// scaling down from the source would shrink the marks below these, they are
+// drawn on an intermediate size instead.
+const (
+	minRenditionLogoHeight = 32
+	minRenditionTextSize   = 10
+)
+
+// derivativeNamePattern restricts derivative names to characters that are
+// safe in S3 keys
+var derivativeNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// derivative is a resized rendition written for every source image
+type derivative struct {
+	Name      string  `json:"name"`
+	MaxWidth  int     `json:"max_width"`
+	MaxHeight int     `json:"max_height"`
+	Fit       string  `json:"fit"`
+	Format    string  `json:"format"`
+	Quality   int     `json:"quality"`
+	Suffix    *string `json:"suffix"`
+}
+
+// loadDerivatives reads a JSON array of derivatives, checks them and fills
+// in the default fit and suffix
+func loadDerivatives(path string) ([]derivative, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read derivatives %s: %v", path, err)
+	}
+	var derivatives []derivative
+	if err := json.Unmarshal(data, &derivatives); err != nil {
+		return nil, fmt.Errorf("failed to parse derivatives %s: %v", path, err)
+	}
+	if len(derivatives) == 0 {
+		return nil, fmt.Errorf("derivatives %s is empty", path)
+	}
+
+	names := make(map[string]bool, len(derivatives))
+	suffixes := make(map[string]string, len(derivatives))
+	for i := range derivatives {
+		d := &derivatives[i]
+		if !derivativeNamePattern.MatchString(d.Name) {
+			return nil, fmt.Errorf("invalid derivative name %q: only letters, digits, '.', '_' and '-' are allowed", d.Name)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("duplicate derivative name %q", d.Name)
+		}
+		names[d.Name] = true
+
+		if d.MaxWidth < 0 || d.MaxHeight < 0 {
+			return nil, fmt.Errorf("derivative %s: max_width and max_height must not be negative", d.Name)
+		}
+		switch d.Fit {
+		case "":
+			d.Fit = FitContain
+		case FitContain:
+		case FitCover:
+			if d.MaxWidth == 0 || d.MaxHeight == 0 {
+				return nil, fmt.Errorf("derivative %s: fit %s needs both max_width and max_height", d.Name, FitCover)
+			}
+		default:
+			return nil, fmt.Errorf("derivative %s: invalid fit %s (must be %s or %s)", d.Name, d.Fit, FitContain, FitCover)
+		}
+		switch d.Format {
+		case "", FormatJPEG:
+		case FormatWebP:
+			if err := checkWebPEncoder("derivative " + d.Name); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("derivative %s: invalid format %s (must be %s or %s)", d.Name, d.Format, FormatJPEG, FormatWebP)
+		}
+		if d.Quality != 0 && (d.Quality < 1 || d.Quality > 100) {
+			return nil, fmt.Errorf("derivative %s: quality must be between 1 and 100: %d", d.Name, d.Quality)
+		}
+
+		if d.Suffix == nil {
+			suffix := DefaultDerivativeSuffix
+			d.Suffix = &suffix
+		}
+		if strings.Contains(*d.Suffix, "/") {
+			return nil, fmt.Errorf("derivative %s: suffix must not contain '/'", d.Name)
+		}
+		// Templated suffixes are checked per image once they're rendered
+		if other, ok := suffixes[*d.Suffix]; ok && !strings.Contains(*d.Suffix, "{") {
+			return nil, fmt.Errorf("derivatives %s and %s have the same suffix %q", other, d.Name, *d.Suffix)
+		}
+		suffixes[*d.Suffix] = d.Name
+	}
+	return derivatives, nil
+}
+
+// validateDerivativeSettings checks the optional derivative list
+func validateDerivativeSettings() error {
+	if path := os.Getenv(EnvDerivativesPath); path != "" {
+		_, err := loadDerivatives(path)
+		return err
+	}
+	return nil
+}
+
+// resolveDerivatives gives derivatives without a format the output format,
+// and derivatives without a quality the output quality when they share its
+// format or the default quality of their format otherwise
+func resolveDerivatives(derivatives []derivative, outputFormat string, quality int) {
+	for i := range derivatives {
+		d := &derivatives[i]
+		if d.Format == "" {
+			d.Format = outputFormat
+		}
+		switch {
+		case d.Quality != 0:
+		case d.Format == outputFormat:
+			d.Quality = quality
+		case d.Format == FormatWebP:
+			d.Quality = DefaultWebPQuality
+		default:
+			d.Quality = DefaultJPEGQuality
+		}
+	}
+}
+
+// cropRect returns the part of an image a derivative keeps: all of it, or
+// the largest centered area with the aspect ratio of a cover box
+func (d *derivative) cropRect(bounds image.Rectangle) image.Rectangle {
+	if d.Fit != FitCover {
+		return bounds
+	}
+	return aspectRect(bounds, image.Pt(d.MaxWidth, d.MaxHeight))
+}
+
+// size returns the dimensions of the derivative of a width x height image.
+// Images are only ever scaled down.
+func (d *derivative) size(width, height int) (int, int) {
+	scale := 1.0
+	if d.MaxWidth > 0 && width > d.MaxWidth {
+		scale = math.Min(scale, float64(d.MaxWidth)/float64(width))
+	}
+	if d.MaxHeight > 0 && height > d.MaxHeight {
+		scale = math.Min(scale, float64(d.MaxHeight)/float64(height))
+	}
+	w := int(math.Round(float64(width) * scale))
+	h := int(math.Round(float64(height) * scale))
+	return max(w, 1), max(h, 1)
+}
+
+// derivativeKey inserts a rendered suffix before the extension of a key
+func derivativeKey(key, suffix string) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + suffix + ext
+}
+
+// markedCopy identifies a watermarked copy that derivatives can share
+type markedCopy struct {
+	rect image.Rectangle
+	size image.Point
+}
+
+// markingSize returns the size the area a derivative keeps is watermarked at.
+// That's the area itself unless scaling it down to the rendition would make
+// the logos or text unreadable, in which case it's scaled down just enough
+// beforehand that they keep their minimum size.
+func (ip *ImageProcessor) markingSize(d *derivative, area image.Point, text string) image.Point {
+	w, _ := d.size(area.X, area.Y)
+	scale := float64(w) / float64(area.X)
+	if scale >= 1 || ip.unmarked {
+		return area
+	}
+
+	// How much each mark can be scaled down and stay readable
+	shrink := float64(min(watermarkSize(ip.leftWatermark).Y, watermarkSize(ip.rightWatermark).Y)) / minRenditionLogoHeight
+	if text != "" {
+		shrink = math.Min(shrink, ip.textSize/minRenditionTextSize)
+	}
+	marking := math.Max(math.Min(scale*shrink, 1), scale)
+	if marking >= 1 {
+		return area
+	}
+	return image.Pt(max(int(math.Round(float64(area.X)*marking)), 1), max(int(math.Round(float64(area.Y)*marking)), 1))
+}
+
+// renderDerivative crops, watermarks and resizes an image for a derivative,
+// reusing watermarked copies of the same area and size from earlier
+// derivatives
+func (ip *ImageProcessor) renderDerivative(d *derivative, base *processedImage, img image.Image, watermarked map[markedCopy]image.Image) (image.Image, error) {
+	rect := d.cropRect(img.Bounds())
+	key := markedCopy{rect: rect, size: ip.markingSize(d, rect.Size(), base.text)}
+	marked, ok := watermarked[key]
+	if !ok {
+		area := imaging.Crop(img, rect)
+		if key.size != rect.Size() {
+			area = imaging.Resize(area, key.size.X, key.size.Y, imaging.Lanczos)
+		}
+		var err error
+		marked, err = ip.addWatermark(area, base.text, base.qrURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add watermark to image %s: %v", base.key, err)
+		}
+		watermarked[key] = marked
+	}
+
+	// Bar and frame modes grow the canvas, so size the watermarked copy
+	size := marked.Bounds().Size()
+	if w, h := d.size(size.X, size.Y); w != size.X || h != size.Y {
+		return imaging.Resize(marked, w, h, imaging.Lanczos), nil
+	}
+	return marked, nil
+}
+
+// storeDerivatives writes every configured derivative of a decoded image.
+// Watermarks are drawn at source resolution on the area a derivative keeps
+// and scaled down with it, so every rendition shows the same picture, while
+// the invisible watermark is embedded at the final size. Small renditions of
+// large sources are watermarked at an intermediate size, so their logos and
+// text stay readable. All derivatives are rendered before any is uploaded, so
+// suffixes that render to the same key fail the image without overwriting
+// each other.
+func (ip *ImageProcessor) storeDerivatives(ctx context.Context, base *processedImage, img image.Image, meta *imageMetadata) error {
+	watermarked := make(map[markedCopy]image.Image)
+	renditions := make([]image.Image, len(ip.derivatives))
+	outs := make([]processedImage, len(ip.derivatives))
+	keys := make(map[string]string, len(ip.derivatives))
+
+	for i := range ip.derivatives {
+		d := &ip.derivatives[i]
+		resized, err := ip.renderDerivative(d, base, img, watermarked)
+		if err != nil {
+			return err
+		}
+		renditions[i] = resized
+
+		out := &outs[i]
+		*out = *base
+		out.format = d.Format
+		out.derivative = d.Name
+		out.suffix = renderTemplate(*d.Suffix, templateVars{
+			"derivative": d.Name,
+			"width":      strconv.Itoa(resized.Bounds().Dx()),
+			"height":     strconv.Itoa(resized.Bounds().Dy()),
+		})
+		targetKey := ip.targetKey(out)
+		if other, ok := keys[targetKey]; ok {
+			return fmt.Errorf("derivatives %s and %s of image %s both render to %s", other, d.Name, base.key, targetKey)
+		}
+		keys[targetKey] = d.Name
+	}
+
+	for i := range ip.derivatives {
+		d := &ip.derivatives[i]
+		out := &outs[i]
+		ip.logger.Printf("Rendering derivative %s of %s at %dx%d", d.Name, base.key, renditions[i].Bounds().Dx(), renditions[i].Bounds().Dy())
+
+		// Encode in the format and quality of the derivative
+		rendition := *ip
+		rendition.outputFormat = d.Format
+		rendition.quality = d.Quality
+		final, encoded, err := rendition.finishImage(base.key, renditions[i], base.payload, meta.clone())
+		if err != nil {
+			return err
+		}
+		renditions[i] = nil
+
+		out.encoded = encoded
+		out.bounds = final.Bounds()
+		if err := ip.storeOutput(ctx, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
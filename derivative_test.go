@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDerivatives(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantCount int
+		wantErr   bool
+	}{
+		{"Valid", `[{"name":"320","max_width":320},{"name":"thumb","max_width":200,"max_height":200,"fit":"cover","format":"webp","quality":70}]`, 2, false},
+		{"Full size", `[{"name":"full","suffix":""},{"name":"640","max_width":640}]`, 2, false},
+		{"Empty list", `[]`, 0, true},
+		{"Invalid JSON", `{"name":"320"}`, 0, true},
+		{"Missing name", `[{"max_width":320}]`, 0, true},
+		{"Duplicate name", `[{"name":"320","max_width":320},{"name":"320","max_width":640}]`, 0, true},
+		{"Negative size", `[{"name":"320","max_width":-320}]`, 0, true},
+		{"Cover without height", `[{"name":"square","max_width":200,"fit":"cover"}]`, 0, true},
+		{"Unknown fit", `[{"name":"320","max_width":320,"fit":"stretch"}]`, 0, true},
+		{"Unknown format", `[{"name":"320","max_width":320,"format":"png"}]`, 0, true},
+		{"Quality out of range", `[{"name":"320","max_width":320,"quality":101}]`, 0, true},
+		{"Slash in suffix", `[{"name":"320","max_width":320,"suffix":"/320"}]`, 0, true},
+		{"Same suffix", `[{"name":"a","max_width":320,"suffix":"-small"},{"name":"b","max_width":640,"suffix":"-small"}]`, 0, true},
+		{"Same suffix with width", `[{"name":"a","max_width":320,"suffix":"-{width}w"},{"name":"b","max_width":640,"suffix":"-{width}w"}]`, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.Contains(tt.content, FormatWebP) {
+				skipWithoutWebPEncoder(t)
+			}
+			path := filepath.Join(t.TempDir(), "derivatives.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("Failed to write derivatives: %v", err)
+			}
+
+			derivatives, err := loadDerivatives(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadDerivatives() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(derivatives) != tt.wantCount {
+				t.Errorf("loadDerivatives() returned %d derivatives, want %d", len(derivatives), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestResolveDerivatives(t *testing.T) {
+	skipWithoutWebPEncoder(t)
+	path := filepath.Join(t.TempDir(), "derivatives.json")
+	content := `[{"name":"a","max_width":320},{"name":"b","max_width":320,"format":"webp"},{"name":"c","max_width":320,"format":"jpeg","quality":60}]`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write derivatives: %v", err)
+	}
+	derivatives, err := loadDerivatives(path)
+	if err != nil {
+		t.Fatalf("loadDerivatives() error = %v", err)
+	}
+	resolveDerivatives(derivatives, FormatJPEG, 90)
+
+	want := []struct {
+		format  string
+		quality int
+	}{
+		{FormatJPEG, 90},
+		{FormatWebP, DefaultWebPQuality},
+		{FormatJPEG, 60},
+	}
+	for i, d := range derivatives {
+		if d.Fit != FitContain || *d.Suffix != DefaultDerivativeSuffix {
+			t.Errorf("derivative %s fit = %q, suffix = %q", d.Name, d.Fit, *d.Suffix)
+		}
+		if d.Format != want[i].format || d.Quality != want[i].quality {
+			t.Errorf("derivative %s = %s/%d, want %s/%d", d.Name, d.Format, d.Quality, want[i].format, want[i].quality)
+		}
+	}
+}
+
+func TestDerivativeGeometry(t *testing.T) {
+	bounds := image.Rect(0, 0, 4000, 3000)
+	tests := []struct {
+		name     string
+		d        derivative
+		wantRect image.Rectangle
+		wantSize image.Point
+	}{
+		{"Width only", derivative{MaxWidth: 640, Fit: FitContain}, bounds, image.Pt(640, 480)},
+		{"Height only", derivative{MaxHeight: 300, Fit: FitContain}, bounds, image.Pt(400, 300)},
+		{"Box", derivative{MaxWidth: 1000, MaxHeight: 1000, Fit: FitContain}, bounds, image.Pt(1000, 750)},
+		{"Never enlarged", derivative{MaxWidth: 8000, Fit: FitContain}, bounds, image.Pt(4000, 3000)},
+		{"Full size", derivative{Fit: FitContain}, bounds, image.Pt(4000, 3000)},
+		{"Square cover", derivative{MaxWidth: 200, MaxHeight: 200, Fit: FitCover}, image.Rect(500, 0, 3500, 3000), image.Pt(200, 200)},
+		{"Tall cover", derivative{MaxWidth: 300, MaxHeight: 600, Fit: FitCover}, image.Rect(1250, 0, 2750, 3000), image.Pt(300, 600)},
+		{"Wide cover", derivative{MaxWidth: 1600, MaxHeight: 400, Fit: FitCover}, image.Rect(0, 1000, 4000, 2000), image.Pt(1600, 400)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect := tt.d.cropRect(bounds)
+			if rect != tt.wantRect {
+				t.Errorf("cropRect() = %v, want %v", rect, tt.wantRect)
+			}
+			if w, h := tt.d.size(rect.Dx(), rect.Dy()); image.Pt(w, h) != tt.wantSize {
+				t.Errorf("size() = %dx%d, want %v", w, h, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestDerivativeKey(t *testing.T) {
+	tests := []struct {
+		key, suffix, want string
+	}{
+		{"processed/photo.jpg", "-640", "processed/photo-640.jpg"},
+		{"processed/shoot-page2.jpg", "@2x", "processed/shoot-page2@2x.jpg"},
+		{"processed/upload-7f3a", "-thumb", "processed/upload-7f3a-thumb"},
+	}
+	for _, tt := range tests {
+		if got := derivativeKey(tt.key, tt.suffix); got != tt.want {
+			t.Errorf("derivativeKey(%q, %q) = %q, want %q", tt.key, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestDerivativeKeyCollision(t *testing.T) {
+	logo := solidImage(40, 20, color.White)
+	suffix := "-{width}w"
+	ip := &ImageProcessor{
+		leftWatermark:  logo,
+		rightWatermark: logo,
+		sourcePrefix:   "source/",
+		targetPrefix:   "target/",
+		outputFormat:   FormatJPEG,
+		logger:         log.New(io.Discard, "", 0),
+		derivatives: []derivative{
+			{Name: "small", MaxWidth: 320, Fit: FitContain, Format: FormatJPEG, Quality: 80, Suffix: &suffix},
+			{Name: "large", MaxWidth: 640, Fit: FitContain, Format: FormatJPEG, Quality: 80, Suffix: &suffix},
+		},
+	}
+
+	// Neither derivative resizes a 200px source, so both render to photo-200w.jpg.
+	// The collision fails the image before anything is uploaded.
+	img := solidImage(200, 150, color.Black)
+	err := ip.storeDerivatives(context.Background(), &processedImage{key: "source/photo.jpg"}, img, &imageMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "target/photo-200w.jpg") {
+		t.Errorf("storeDerivatives() error = %v, want a collision on target/photo-200w.jpg", err)
+	}
+}
+
+func TestSmallRenditionOfLargeSource(t *testing.T) {
+	logo := solidImage(100, 200, color.White)
+	ip := &ImageProcessor{
+		leftWatermark:  logo,
+		rightWatermark: logo,
+		logger:         log.New(io.Discard, "", 0),
+	}
+	img := solidImage(3000, 2000, color.Black)
+	thumb := &derivative{Name: "thumb", MaxWidth: 256}
+	large := &derivative{Name: "2048", MaxWidth: 2048}
+
+	if got := ip.markingSize(large, img.Bounds().Size(), ""); got != img.Bounds().Size() {
+		t.Errorf("markingSize() for a large rendition = %v, want the source size", got)
+	}
+	if got := ip.markingSize(thumb, img.Bounds().Size(), ""); got.X >= 3000 || got.X <= 256 {
+		t.Errorf("markingSize() for a thumbnail = %v, want between the thumbnail and the source", got)
+	}
+
+	rendered, err := ip.renderDerivative(thumb, &processedImage{key: "photo.jpg"}, img, make(map[markedCopy]image.Image))
+	if err != nil {
+		t.Fatalf("renderDerivative() error = %v", err)
+	}
+	if rendered.Bounds().Dx() != 256 {
+		t.Fatalf("renderDerivative() width = %d, want 256", rendered.Bounds().Dx())
+	}
+
+	// Measure the left logo in the thumbnail
+	rows := 0
+	for y := 0; y < rendered.Bounds().Dy(); y++ {
+		for x := 0; x < rendered.Bounds().Dx()/2; x++ {
+			if r, _, _, _ := rendered.At(x, y).RGBA(); r>>8 > 128 {
+				rows++
+				break
+			}
+		}
+	}
+	if rows < minRenditionLogoHeight-2 {
+		t.Errorf("logo in a 256px rendition of a 3000px source is %dpx tall, want at least %d", rows, minRenditionLogoHeight)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EXIF IFD pointer tags
+const (
+	exifTagExifIFD    = 0x8769
+	exifTagGPSIFD     = 0x8825
+	exifTagInteropIFD = 0xA005
+)
+
+// exifTagOrientation is the IFD0 tag holding the image orientation
+const exifTagOrientation = 0x0112
+
+// exifTagNames maps the EXIF tags we understand to their conventional names,
+// keyed by the IFD they live in
+var exifTagNames = map[string]map[uint16]string{
+	"ifd0": {
+		0x010E: "ImageDescription",
+		0x010F: "Make",
+		0x0110: "Model",
+		0x0112: "Orientation",
+		0x0131: "Software",
+		0x0132: "DateTime",
+		0x013B: "Artist",
+		0x8298: "Copyright",
+	},
+	"exif": {
+		0x829A: "ExposureTime",
+		0x829D: "FNumber",
+		0x8827: "ISOSpeedRatings",
+		0x9003: "DateTimeOriginal",
+		0x9004: "DateTimeDigitized",
+		0x920A: "FocalLength",
+		0xA002: "PixelXDimension",
+		0xA003: "PixelYDimension",
+		0xA430: "CameraOwnerName",
+		0xA431: "BodySerialNumber",
+		0xA433: "LensMake",
+		0xA434: "LensModel",
+		0xA435: "LensSerialNumber",
+	},
+	"gps": {
+		0x0000: "GPSVersionID",
+		0x0001: "GPSLatitudeRef",
+		0x0002: "GPSLatitude",
+		0x0003: "GPSLongitudeRef",
+		0x0004: "GPSLongitude",
+		0x0005: "GPSAltitudeRef",
+		0x0006: "GPSAltitude",
+		0x0007: "GPSTimeStamp",
+		0x001D: "GPSDateStamp",
+	},
+}
+
+// exifTypeSizes holds the byte size of a single value of each TIFF field type
+var exifTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	7:  1, // UNDEFINED
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+// exifEntry is a single IFD entry with its value bytes resolved
+type exifEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// exifByteOrder is the byte order of an EXIF block, used for both reading
+// and writing
+type exifByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// exifData is a parsed EXIF (TIFF) block. The thumbnail IFD is not kept,
+// since it would show the image without watermarks.
+type exifData struct {
+	order   exifByteOrder
+	ifd0    []exifEntry
+	exif    []exifEntry
+	gps     []exifEntry
+	interop []exifEntry
+}
+
+// jpegSegment is a marker segment from the header of a JPEG file
+type jpegSegment struct {
+	Marker byte
+	Data   []byte
+}
+
+// jpegSegments returns the marker segments preceding the image data of a JPEG
+func jpegSegments(data []byte) ([]jpegSegment, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker at offset %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image, no more header segments
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("truncated JPEG segment at offset %d", pos)
+		}
+		segments = append(segments, jpegSegment{Marker: marker, Data: data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+	return segments, nil
+}
+
+// pngChunk is a chunk from a PNG file
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunks returns the chunks of a PNG file
+func pngChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk %s at offset %d", chunkType, pos)
+		}
+		chunks = append(chunks, pngChunk{Type: chunkType, Data: data[pos+8 : pos+8+length]})
+		pos += 12 + length
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+// extractEXIF returns the raw TIFF-structured EXIF block embedded in a JPEG,
+// PNG or WebP file, or nil if there is none
+func extractEXIF(data []byte) []byte {
+	if segments, err := jpegSegments(data); err == nil {
+		for _, seg := range segments {
+			if seg.Marker == 0xE1 && bytes.HasPrefix(seg.Data, []byte("Exif\x00\x00")) {
+				return seg.Data[6:]
+			}
+		}
+		return nil
+	}
+
+	if chunks, err := pngChunks(data); err == nil {
+		for _, chunk := range chunks {
+			if chunk.Type == "eXIf" {
+				return chunk.Data
+			}
+		}
+		return nil
+	}
+
+	if chunks, err := webpChunks(data); err == nil {
+		for _, chunk := range chunks {
+			if chunk.FourCC == "EXIF" {
+				// Some writers keep the JPEG style header
+				return bytes.TrimPrefix(chunk.Data, []byte("Exif\x00\x00"))
+			}
+		}
+	}
+	return nil
+}
+
+// parseEXIF parses a TIFF-structured EXIF block
+func parseEXIF(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("EXIF block too short")
+	}
+
+	var order exifByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order marker")
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, fmt.Errorf("invalid EXIF header")
+	}
+
+	ex := &exifData{order: order}
+	var err error
+	if ex.ifd0, err = readIFD(tiff, order, order.Uint32(tiff[4:])); err != nil {
+		return nil, fmt.Errorf("failed to read IFD0: %v", err)
+	}
+	if offset, ok := ex.pointer(ex.ifd0, exifTagExifIFD); ok {
+		if ex.exif, err = readIFD(tiff, order, offset); err != nil {
+			return nil, fmt.Errorf("failed to read EXIF IFD: %v", err)
+		}
+	}
+	if offset, ok := ex.pointer(ex.ifd0, exifTagGPSIFD); ok {
+		if ex.gps, err = readIFD(tiff, order, offset); err != nil {
+			return nil, fmt.Errorf("failed to read GPS IFD: %v", err)
+		}
+	}
+	if offset, ok := ex.pointer(ex.exif, exifTagInteropIFD); ok {
+		if ex.interop, err = readIFD(tiff, order, offset); err != nil {
+			return nil, fmt.Errorf("failed to read interoperability IFD: %v", err)
+		}
+	}
+	return ex, nil
+}
+
+// readIFD reads the entries of the IFD at the given offset
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([]exifEntry, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, fmt.Errorf("IFD offset %d out of range", offset)
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	pos := int(offset) + 2
+	if pos+count*12 > len(tiff) {
+		return nil, fmt.Errorf("IFD at offset %d is truncated", offset)
+	}
+
+	entries := make([]exifEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := tiff[pos+i*12 : pos+i*12+12]
+		entry := exifEntry{
+			Tag:   order.Uint16(raw[0:]),
+			Type:  order.Uint16(raw[2:]),
+			Count: order.Uint32(raw[4:]),
+		}
+		size, ok := exifTypeSizes[entry.Type]
+		if !ok {
+			// Unknown field types can't be sized, skip them
+			continue
+		}
+		length := size * int(entry.Count)
+		if length <= 4 {
+			entry.Value = raw[8 : 8+length]
+		} else {
+			valueOffset := int(order.Uint32(raw[8:]))
+			if valueOffset+length > len(tiff) || valueOffset < 0 {
+				continue
+			}
+			entry.Value = tiff[valueOffset : valueOffset+length]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// pointer returns the offset stored in an IFD pointer tag
+func (ex *exifData) pointer(entries []exifEntry, tag uint16) (uint32, bool) {
+	for _, e := range entries {
+		if e.Tag == tag && len(e.Value) >= 4 {
+			return ex.order.Uint32(e.Value), true
+		}
+	}
+	return 0, false
+}
+
+// SetOrientation replaces the orientation tag, if present, with the given value
+func (ex *exifData) SetOrientation(orientation uint16) {
+	for i, e := range ex.ifd0 {
+		if e.Tag == exifTagOrientation {
+			value := make([]byte, 2)
+			ex.order.PutUint16(value, orientation)
+			ex.ifd0[i] = exifEntry{Tag: e.Tag, Type: 3, Count: 1, Value: value}
+		}
+	}
+}
+
+// Encode serializes the EXIF data back into a TIFF-structured block, laying
+// out IFD0 followed by the EXIF, interoperability and GPS IFDs
+func (ex *exifData) Encode() []byte {
+	ifd0 := withoutTags(ex.ifd0, exifTagExifIFD, exifTagGPSIFD)
+	exif := withoutTags(ex.exif, exifTagInteropIFD)
+	interop := ex.interop
+	gps := ex.gps
+
+	if len(exif) == 0 {
+		interop = nil
+	}
+	if len(interop) > 0 {
+		exif = append(exif, exifEntry{Tag: exifTagInteropIFD, Type: 4, Count: 1, Value: make([]byte, 4)})
+	}
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, exifEntry{Tag: exifTagExifIFD, Type: 4, Count: 1, Value: make([]byte, 4)})
+	}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, exifEntry{Tag: exifTagGPSIFD, Type: 4, Count: 1, Value: make([]byte, 4)})
+	}
+
+	exifOffset := 8 + ifdSize(ifd0)
+	interopOffset := exifOffset + ifdSize(exif)
+	gpsOffset := interopOffset + ifdSize(interop)
+	ex.setPointer(ifd0, exifTagExifIFD, exifOffset)
+	ex.setPointer(ifd0, exifTagGPSIFD, gpsOffset)
+	ex.setPointer(exif, exifTagInteropIFD, interopOffset)
+
+	buf := make([]byte, 8, gpsOffset+ifdSize(gps))
+	if ex.order == binary.LittleEndian {
+		copy(buf, "II")
+	} else {
+		copy(buf, "MM")
+	}
+	ex.order.PutUint16(buf[2:], 42)
+	ex.order.PutUint32(buf[4:], 8)
+
+	buf = ex.appendIFD(buf, ifd0)
+	buf = ex.appendIFD(buf, exif)
+	buf = ex.appendIFD(buf, interop)
+	return ex.appendIFD(buf, gps)
+}
+
+// appendIFD writes an IFD and its out-of-line values at the end of buf
+func (ex *exifData) appendIFD(buf []byte, entries []exifEntry) []byte {
+	if len(entries) == 0 {
+		return buf
+	}
+
+	sorted := append([]exifEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Tag < sorted[j].Tag })
+
+	dataOffset := len(buf) + 2 + len(sorted)*12 + 4
+	var data []byte
+	buf = ex.order.AppendUint16(buf, uint16(len(sorted)))
+	for _, e := range sorted {
+		buf = ex.order.AppendUint16(buf, e.Tag)
+		buf = ex.order.AppendUint16(buf, e.Type)
+		buf = ex.order.AppendUint32(buf, e.Count)
+		if len(e.Value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, e.Value)
+			buf = append(buf, value...)
+			continue
+		}
+		buf = ex.order.AppendUint32(buf, uint32(dataOffset+len(data)))
+		data = append(data, e.Value...)
+		if len(data)%2 == 1 {
+			// Values start on word boundaries
+			data = append(data, 0)
+		}
+	}
+	buf = ex.order.AppendUint32(buf, 0)
+	return append(buf, data...)
+}
+
+// setPointer stores a sub-IFD offset in the matching pointer entry
+func (ex *exifData) setPointer(entries []exifEntry, tag uint16, offset int) {
+	for i := range entries {
+		if entries[i].Tag == tag {
+			ex.order.PutUint32(entries[i].Value, uint32(offset))
+		}
+	}
+}
+
+// ifdSize returns the number of bytes an IFD occupies once encoded
+func ifdSize(entries []exifEntry) int {
+	if len(entries) == 0 {
+		return 0
+	}
+	size := 2 + len(entries)*12 + 4
+	for _, e := range entries {
+		if len(e.Value) > 4 {
+			size += len(e.Value) + len(e.Value)%2
+		}
+	}
+	return size
+}
+
+// withoutTags returns entries minus those with the given tags
+func withoutTags(entries []exifEntry, tags ...uint16) []exifEntry {
+	var kept []exifEntry
+	for _, e := range entries {
+		drop := false
+		for _, tag := range tags {
+			if e.Tag == tag {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// Fields returns the known EXIF fields as formatted strings keyed by tag name
+func (ex *exifData) Fields() map[string]string {
+	fields := make(map[string]string)
+	for ifd, entries := range map[string][]exifEntry{"ifd0": ex.ifd0, "exif": ex.exif, "gps": ex.gps} {
+		for _, e := range entries {
+			name, ok := exifTagNames[ifd][e.Tag]
+			if !ok {
+				continue
+			}
+			fields[name] = ex.format(e)
+		}
+	}
+	return fields
+}
+
+// format renders an entry value as a string
+func (ex *exifData) format(e exifEntry) string {
+	switch e.Type {
+	case 2:
+		return strings.TrimRight(string(e.Value), "\x00 ")
+	case 7:
+		return strings.TrimRight(string(e.Value), "\x00")
+	}
+
+	size := exifTypeSizes[e.Type]
+	values := make([]string, 0, e.Count)
+	for i := 0; i+size <= len(e.Value); i += size {
+		v := e.Value[i : i+size]
+		switch e.Type {
+		case 1:
+			values = append(values, strconv.Itoa(int(v[0])))
+		case 3:
+			values = append(values, strconv.Itoa(int(ex.order.Uint16(v))))
+		case 4:
+			values = append(values, strconv.FormatUint(uint64(ex.order.Uint32(v)), 10))
+		case 9:
+			values = append(values, strconv.Itoa(int(int32(ex.order.Uint32(v)))))
+		case 5:
+			values = append(values, formatRational(float64(ex.order.Uint32(v)), float64(ex.order.Uint32(v[4:]))))
+		case 10:
+			values = append(values, formatRational(float64(int32(ex.order.Uint32(v))), float64(int32(ex.order.Uint32(v[4:])))))
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// formatRational renders a rational as a decimal number
+func formatRational(num, den float64) string {
+	if den == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(num/den, 'f', -1, 64)
+}
+
+// exifOrientation returns the orientation tag of the EXIF block embedded in a
+// JPEG, PNG or WebP file, or 0 if there is none
+func exifOrientation(data []byte) int {
+	raw := extractEXIF(data)
+	if raw == nil {
+		return 0
+	}
+	ex, err := parseEXIF(raw)
+	if err != nil {
+		return 0
+	}
+	orientation, _ := strconv.Atoi(ex.Fields()["Orientation"])
+	return orientation
+}
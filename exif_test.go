@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// testIFDEntry describes an entry for buildTestEXIF
+type testIFDEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// buildTestEXIF builds a little-endian TIFF block with the given IFD0 entries
+// and an optional EXIF sub-IFD
+func buildTestEXIF(ifd0, exifIFD []testIFDEntry) []byte {
+	order := binary.LittleEndian
+	buf := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+
+	writeIFD := func(entries []testIFDEntry) {
+		start := len(buf)
+		dataOffset := start + 2 + len(entries)*12 + 4
+		var data []byte
+		buf = order.AppendUint16(buf, uint16(len(entries)))
+		for _, e := range entries {
+			buf = order.AppendUint16(buf, e.tag)
+			buf = order.AppendUint16(buf, e.typ)
+			buf = order.AppendUint32(buf, e.count)
+			if len(e.value) <= 4 {
+				v := make([]byte, 4)
+				copy(v, e.value)
+				buf = append(buf, v...)
+			} else {
+				buf = order.AppendUint32(buf, uint32(dataOffset+len(data)))
+				data = append(data, e.value...)
+			}
+		}
+		buf = order.AppendUint32(buf, 0)
+		buf = append(buf, data...)
+	}
+
+	if exifIFD != nil {
+		// The pointer value is patched once the IFD0 size is known
+		ifd0 = append(ifd0, testIFDEntry{tag: exifTagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+	writeIFD(ifd0)
+	if exifIFD != nil {
+		exifOffset := len(buf)
+		order.PutUint32(buf[8+2+(len(ifd0)-1)*12+8:], uint32(exifOffset))
+		writeIFD(exifIFD)
+	}
+	return buf
+}
+
+// asciiValue returns a NUL-terminated EXIF ASCII value
+func asciiValue(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// buildTestJPEG encodes img as a JPEG with the given EXIF block
+func buildTestJPEG(t *testing.T, img image.Image, exif []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	data := buf.Bytes()
+
+	payload := append([]byte("Exif\x00\x00"), exif...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestParseEXIF(t *testing.T) {
+	raw := buildTestEXIF(
+		[]testIFDEntry{
+			{tag: 0x013B, typ: 2, count: 10, value: asciiValue("Jane Smith")[:10]},
+			{tag: 0x0112, typ: 3, count: 1, value: []byte{6, 0}},
+		},
+		[]testIFDEntry{
+			{tag: 0x9003, typ: 2, count: 20, value: asciiValue("2024:05:01 12:30:00")},
+			{tag: 0x829D, typ: 5, count: 1, value: []byte{28, 0, 0, 0, 10, 0, 0, 0}},
+		},
+	)
+
+	data := buildTestJPEG(t, image.NewRGBA(image.Rect(0, 0, 8, 8)), raw)
+	extracted := extractEXIF(data)
+	if !bytes.Equal(extracted, raw) {
+		t.Fatalf("extractEXIF() did not return the embedded EXIF block")
+	}
+
+	ex, err := parseEXIF(extracted)
+	if err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+
+	fields := ex.Fields()
+	want := map[string]string{
+		"Artist":           "Jane Smith",
+		"Orientation":      "6",
+		"DateTimeOriginal": "2024:05:01 12:30:00",
+		"FNumber":          "2.8",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("Fields()[%s] = %q, want %q", name, fields[name], value)
+		}
+	}
+}
+
+func TestExtractEXIFWithoutMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+
+	if got := extractEXIF(buf.Bytes()); got != nil {
+		t.Errorf("extractEXIF() = %v, want nil", got)
+	}
+	if got := extractEXIF([]byte("not an image")); got != nil {
+		t.Errorf("extractEXIF() = %v, want nil", got)
+	}
+}
+
+func TestParseEXIFInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Too short", []byte("II")},
+		{"Bad byte order", []byte("XX\x2a\x00\x08\x00\x00\x00")},
+		{"Bad magic", []byte("II\x00\x00\x08\x00\x00\x00")},
+		{"IFD out of range", []byte("II\x2a\x00\xff\x00\x00\x00")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseEXIF(tt.data); err == nil {
+				t.Error("parseEXIF() expected error")
+			}
+		})
+	}
+}
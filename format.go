@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Format detection policies
+const (
+	DetectExtension = "extension" // Only keys with an image extension, as before
+	DetectAuto      = "auto"      // Image extensions, plus keys without an extension sniffed by content
+	DetectContent   = "content"   // Every key is sniffed by content
+)
+
+// sniffLength is the number of leading bytes fetched to detect a format
+const sniffLength = 64
+
+// imageFormat describes an input format we can recognize
+type imageFormat struct {
+	name       string
+	mime       string
+	extensions []string
+	magic      func(header []byte) bool
+	web        bool // Whether browsers display it, so outputs may keep its key
+	builtin    bool // Whether it decodes without an external decoder
+}
+
+// imageFormats lists the recognized input formats
+var imageFormats = []imageFormat{
+	{name: "jpeg", mime: "image/jpeg", extensions: []string{".jpg", ".jpeg"}, magic: isJPEG, web: true, builtin: true},
+	{name: "png", mime: "image/png", extensions: []string{".png"}, magic: isPNG, web: true, builtin: true},
+	{name: "webp", mime: "image/webp", extensions: []string{".webp"}, magic: isWebP, web: true, builtin: true},
+	{name: "gif", mime: "image/gif", extensions: []string{".gif"}, magic: isGIF, web: true, builtin: true},
+	{name: "tiff", mime: "image/tiff", extensions: []string{".tif", ".tiff"}, magic: isTIFF, builtin: true},
+	{name: "bmp", mime: "image/bmp", extensions: []string{".bmp"}, magic: isBMP, builtin: true},
+	{name: "heic", mime: "image/heic", extensions: []string{".heic", ".heif"}, magic: isHEIC},
+	{name: "avif", mime: "image/avif", extensions: []string{".avif"}, magic: isAVIF},
+}
+
+// isJPEG reports whether data starts with a JPEG marker
+func isJPEG(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF})
+}
+
+// isPNG reports whether data starts with the PNG signature
+func isPNG(header []byte) bool {
+	return bytes.HasPrefix(header, pngSignature)
+}
+
+// isobmffBrand returns the major brand of an ISO base media file, the
+// container of HEIC and AVIF, or ""
+func isobmffBrand(header []byte) string {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return ""
+	}
+	return string(header[8:12])
+}
+
+// isHEIC reports whether data starts with a HEIF file type box
+func isHEIC(header []byte) bool {
+	switch isobmffBrand(header) {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// isAVIF reports whether data starts with an AVIF file type box
+func isAVIF(header []byte) bool {
+	switch isobmffBrand(header) {
+	case "avif", "avis":
+		return true
+	}
+	return false
+}
+
+// isGIF reports whether data starts with a GIF header
+func isGIF(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("GIF87a")) || bytes.HasPrefix(header, []byte("GIF89a"))
+}
+
+// skipError marks an object that isn't processed without counting as a failure
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// validateFormatSettings checks the optional format detection policy
+func validateFormatSettings() error {
+	switch v := os.Getenv(EnvFormatDetection); v {
+	case "", DetectExtension, DetectAuto, DetectContent:
+		return nil
+	default:
+		return fmt.Errorf("invalid %s: %s (must be %s, %s or %s)", EnvFormatDetection, v, DetectExtension, DetectAuto, DetectContent)
+	}
+}
+
+// formatFromExtension returns the format a key's extension claims, or ""
+func formatFromExtension(key string) string {
+	ext := strings.ToLower(filepath.Ext(key))
+	for _, f := range imageFormats {
+		for _, e := range f.extensions {
+			if ext == e {
+				return f.name
+			}
+		}
+	}
+	return ""
+}
+
+// isWebFormat reports whether browsers display a format
+func isWebFormat(name string) bool {
+	for _, f := range imageFormats {
+		if f.name == name {
+			return f.web
+		}
+	}
+	return false
+}
+
+// sniffFormat detects a supported format from the leading bytes of a file
+func sniffFormat(header []byte) string {
+	for _, f := range imageFormats {
+		if f.magic(header) {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// needsSniffing reports whether a listed key is queued and whether its
+// content must be checked before it is downloaded in full
+func (ip *ImageProcessor) needsSniffing(key string) (queue, sniff bool) {
+	if strings.HasSuffix(key, "/") || ip.isSidecar(key) {
+		return false, false
+	}
+	hasImageExt := isImageFile(key) || ip.decoders.handlesExtension(key)
+	switch ip.detection {
+	case DetectContent:
+		return true, !hasImageExt
+	case DetectAuto:
+		noExt := filepath.Ext(key) == ""
+		return hasImageExt || noExt, noExt
+	default:
+		return hasImageExt, false
+	}
+}
+
+// isSidecar reports whether a key is a redaction or override sidecar rather
+// than an image to process
+func (ip *ImageProcessor) isSidecar(key string) bool {
+	return (ip.redact || ip.overrideFrom[OverridesSidecar]) && strings.HasSuffix(strings.ToLower(key), ".json")
+}
+
+// sniffObject fetches the first bytes of an object and returns its format,
+// or a skipError when it isn't an image any decoder reads. The format is ""
+// when only the object's Content-Type matched a decoder.
+func (ip *ImageProcessor) sniffObject(ctx context.Context, key string) (string, error) {
+	rangeHeader := fmt.Sprintf("bytes=0-%d", sniffLength-1)
+	result, err := ip.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &ip.sourceBucket,
+		Key:    &key,
+		Range:  &rangeHeader,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get object header %s: %v", key, err)
+	}
+	defer result.Body.Close()
+
+	header, err := io.ReadAll(io.LimitReader(result.Body, sniffLength))
+	if err != nil {
+		return "", fmt.Errorf("failed to read object header %s: %v", key, err)
+	}
+	format := sniffFormat(header)
+	var contentType string
+	if result.ContentType != nil {
+		contentType = *result.ContentType
+	}
+	if ip.decoders.lookup(key, contentType, format) == nil {
+		if format != "" {
+			return "", &skipError{reason: fmt.Sprintf("no decoder for %s", format)}
+		}
+		if contentType == "" {
+			contentType = "unknown"
+		}
+		return "", &skipError{reason: fmt.Sprintf("unsupported content (Content-Type %s)", contentType)}
+	}
+	return format, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestSniffFormat(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	var jpegData, pngData bytes.Buffer
+	if err := imaging.Encode(&jpegData, img, imaging.JPEG); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"JPEG", jpegData.Bytes(), "jpeg"},
+		{"PNG", pngData.Bytes(), "png"},
+		{"BMP", []byte("BM\x36\x00\x0c\x00"), "bmp"},
+		{"TIFF", []byte("MM\x00*\x00\x00\x00\x08"), "tiff"},
+		{"HEIC", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "heic"},
+		{"AVIF", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1"), "avif"},
+		{"MP4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), ""},
+		{"Text", []byte("hello world"), ""},
+		{"PDF", []byte("%PDF-1.7"), ""},
+		{"Empty", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffFormat(tt.header); got != tt.want {
+				t.Errorf("sniffFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsSniffing(t *testing.T) {
+	tests := []struct {
+		detection string
+		key       string
+		wantQueue bool
+		wantSniff bool
+	}{
+		{DetectExtension, "source/photo.jpg", true, false},
+		{DetectExtension, "source/upload-7f3a", false, false},
+		{DetectAuto, "source/photo.PNG", true, false},
+		{DetectAuto, "source/upload-7f3a", true, true},
+		{DetectAuto, "source/notes.txt", false, false},
+		{DetectContent, "source/notes.txt", true, true},
+		{DetectContent, "source/photo.jpg", true, false},
+		{DetectContent, "source/folder/", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.detection+" "+tt.key, func(t *testing.T) {
+			ip := &ImageProcessor{detection: tt.detection}
+			queue, sniff := ip.needsSniffing(tt.key)
+			if queue != tt.wantQueue || sniff != tt.wantSniff {
+				t.Errorf("needsSniffing() = %v, %v, want %v, %v", queue, sniff, tt.wantQueue, tt.wantSniff)
+			}
+		})
+	}
+}
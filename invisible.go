@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// Invisible watermark parameters. Each block of the image carries one bit in
+// the difference of two low-frequency DCT coefficients of its luminance. The
+// blocks have a fixed size in pixels and form tiles that repeat across the
+// image, each holding the whole payload and a sync pattern, so any part of
+// the image at least one tile across still carries the mark. Extraction
+// searches for the sync pattern to find the tile grid of a cropped or
+// downscaled copy.
+const (
+	invisibleBlockSize  = 12 // Side of a block in pixels of the marked image
+	invisibleTileBlocks = 16 // Blocks per side of a tile
+	invisibleTileSize   = invisibleBlockSize * invisibleTileBlocks
+	invisibleTileSlots  = invisibleTileBlocks * invisibleTileBlocks
+	invisiblePayloadMax = 15 // Maximum payload length in bytes
+	invisibleFrameBytes = 1 + invisiblePayloadMax + 2
+	invisibleFrameBits  = invisibleFrameBytes * 8
+	invisibleSyncBits   = invisibleTileSlots - invisibleFrameBits
+
+	DefaultInvisibleStrength = 12
+	DefaultInvisibleKey      = "s3-watermark"
+)
+
+// Extraction search parameters
+const (
+	invisibleMaxScale     = 2.5  // Largest downscale of the marked image searched for
+	invisibleFoldStep     = 2    // Pixels of the marked image per bin of a folded tile
+	invisibleSearchExtent = 1536 // Pixels of the marked image folded while searching
+	invisibleVoteClip     = 2    // Largest vote of one block, in standard deviations
+	invisibleSyncMatch    = 8    // Sync score that ends the search early
+	invisibleSyncMin      = 4.5  // Sync score below which no payload is reported
+)
+
+// invisibleLayout assigns every block of a tile either a frame bit or a sync
+// bit. The layout is derived from the key, so the payload can't be read or
+// forged without it.
+type invisibleLayout struct {
+	bit  [invisibleTileSlots]int     // Frame bit carried by a slot, -1 for sync slots
+	sync [invisibleTileSlots]float64 // +1 or -1 for sync slots, 0 for frame slots
+}
+
+// invisibleAlignment is where the tile grid of a marked image lies in a
+// copy: the copy is scaled down by scale, and offset is the position of the
+// copy's origin in the tile grid, in pixels of the marked image
+type invisibleAlignment struct {
+	scale  float64
+	offset image.Point
+	score  float64 // Sync correlation in standard deviations
+}
+
+// invisibleResult is the outcome of extracting an invisible watermark
+type invisibleResult struct {
+	Payload    string
+	Confidence float64 // Mean agreement of the block votes, from 0 (noise) to 1
+	Valid      bool    // Whether the sync pattern was found and the payload checksum matched
+}
+
+// validateInvisibleSettings checks the optional invisible watermark settings
+func validateInvisibleSettings() error {
+	if v := os.Getenv(EnvInvisibleStrength); v != "" {
+		if strength, err := strconv.ParseFloat(v, 64); err != nil || strength <= 0 {
+			return fmt.Errorf("%s must be a positive number: %s", EnvInvisibleStrength, v)
+		}
+	}
+	return nil
+}
+
+// invisibleFrame encodes a payload as a fixed size frame of length, data and
+// checksum bits
+func invisibleFrame(payload string) ([]bool, error) {
+	if len(payload) > invisiblePayloadMax {
+		return nil, fmt.Errorf("invisible watermark payload %q is longer than %d bytes", payload, invisiblePayloadMax)
+	}
+
+	frame := make([]byte, invisibleFrameBytes)
+	frame[0] = byte(len(payload))
+	copy(frame[1:], payload)
+	binary.BigEndian.PutUint16(frame[invisibleFrameBytes-2:], uint16(crc32.ChecksumIEEE(frame[:invisibleFrameBytes-2])))
+
+	bits := make([]bool, invisibleFrameBits)
+	for i := range bits {
+		bits[i] = frame[i/8]&(0x80>>(i%8)) != 0
+	}
+	return bits, nil
+}
+
+// decodeInvisibleFrame turns frame bits back into a payload
+func decodeInvisibleFrame(bits []bool) (string, bool) {
+	frame := make([]byte, invisibleFrameBytes)
+	for i, bit := range bits {
+		if bit {
+			frame[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	checksum := binary.BigEndian.Uint16(frame[invisibleFrameBytes-2:])
+	if uint16(crc32.ChecksumIEEE(frame[:invisibleFrameBytes-2])) != checksum || int(frame[0]) > invisiblePayloadMax {
+		return "", false
+	}
+	return string(frame[1 : 1+int(frame[0])]), true
+}
+
+// newInvisibleLayout scatters the frame and sync bits over the slots of a
+// tile with a permutation seeded by the key
+func newInvisibleLayout(key string) *invisibleLayout {
+	sum := sha256.Sum256([]byte(key))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8]))))
+
+	layout := &invisibleLayout{}
+	for i, slot := range rng.Perm(invisibleTileSlots) {
+		if i < invisibleFrameBits {
+			layout.bit[slot] = i
+			continue
+		}
+		layout.bit[slot] = -1
+		layout.sync[slot] = float64(rng.Intn(2)*2 - 1)
+	}
+	return layout
+}
+
+// invisibleBasis is the DCT-II basis function of frequency k, continuous in
+// the position t from 0 to invisibleBlockSize
+func invisibleBasis(k int, t float64) float64 {
+	return math.Sqrt(2.0/invisibleBlockSize) * math.Cos(math.Pi*t*float64(k)/invisibleBlockSize)
+}
+
+// invisiblePattern is the change of luminance that raises the (2,1)
+// coefficient of a block and lowers the (1,2) coefficient by the same
+// amount. Its dot product with a block is the difference of the two.
+func invisiblePattern(tx, ty float64) float64 {
+	return invisibleBasis(1, tx)*invisibleBasis(2, ty) - invisibleBasis(2, tx)*invisibleBasis(1, ty)
+}
+
+// invisibleLuma returns the luminance of every pixel of img
+func invisibleLuma(img *image.NRGBA) []float64 {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := img.Pix[y*img.Stride+x*4 : y*img.Stride+x*4+3]
+			luma[y*width+x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+	return luma
+}
+
+// embedInvisibleWatermark hides payload in img and returns the marked copy
+func embedInvisibleWatermark(img image.Image, payload, key string, strength float64) (*image.NRGBA, error) {
+	bits, err := invisibleFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+	layout := newInvisibleLayout(key)
+
+	var pattern [invisibleBlockSize][invisibleBlockSize]float64
+	for y := range pattern {
+		for x := range pattern[y] {
+			pattern[y][x] = invisiblePattern(float64(x)+0.5, float64(y)+0.5)
+		}
+	}
+	// Strength is per 8 pixels of block side, so larger blocks change each
+	// pixel as little as 8x8 blocks would
+	target := strength * invisibleBlockSize / 8
+
+	out := imaging.Clone(img)
+	width, height := out.Bounds().Dx(), out.Bounds().Dy()
+	luma := invisibleLuma(out)
+	for by := 0; by+invisibleBlockSize <= height; by += invisibleBlockSize {
+		for bx := 0; bx+invisibleBlockSize <= width; bx += invisibleBlockSize {
+			slot := (by/invisibleBlockSize%invisibleTileBlocks)*invisibleTileBlocks + bx/invisibleBlockSize%invisibleTileBlocks
+			want := layout.sync[slot] > 0
+			if b := layout.bit[slot]; b >= 0 {
+				want = bits[b]
+			}
+
+			var diff float64
+			for y := 0; y < invisibleBlockSize; y++ {
+				for x := 0; x < invisibleBlockSize; x++ {
+					diff += luma[(by+y)*width+bx+x] * pattern[y][x]
+				}
+			}
+			if !want {
+				diff = -diff
+			}
+			if diff >= target {
+				continue
+			}
+
+			adjust := (target - diff) / 2
+			if !want {
+				adjust = -adjust
+			}
+			for y := 0; y < invisibleBlockSize; y++ {
+				for x := 0; x < invisibleBlockSize; x++ {
+					d := adjust * pattern[y][x]
+					i := (by+y)*out.Stride + (bx+x)*4
+					for ch := 0; ch < 3; ch++ {
+						out.Pix[i+ch] = clampByte(float64(out.Pix[i+ch]) + d)
+					}
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// extractInvisibleWatermark reads a payload embedded with the same key from
+// a copy that may have been cropped, downscaled or recompressed
+func extractInvisibleWatermark(img image.Image, key string) invisibleResult {
+	layout := newInvisibleLayout(key)
+	nrgba := imaging.Clone(img)
+	width, height := nrgba.Bounds().Dx(), nrgba.Bounds().Dy()
+	luma := invisibleLuma(nrgba)
+
+	// Search scales from the copy's own size upwards, in steps small enough
+	// that the tile grid drifts by less than half a block across the folded
+	// area
+	var best invisibleAlignment
+	step := 0.0
+	for scale := 1.0; scale <= invisibleMaxScale; scale *= 1 + step {
+		a := searchInvisibleAlignment(luma, width, height, scale, layout)
+		if a.score > best.score {
+			best = a
+		}
+		if best.score >= invisibleSyncMatch {
+			break
+		}
+		step = invisibleBlockSize / math.Min(float64(max(width, height))*scale, invisibleSearchExtent)
+	}
+	if best.score < invisibleSyncMin {
+		return invisibleResult{}
+	}
+	best = refineInvisibleAlignment(luma, width, height, best, step, layout)
+
+	// Read the frame from the votes of every block of the copy
+	votes, agree, total := invisibleVotes(luma, width, height, best, layout)
+	bits := make([]bool, invisibleFrameBits)
+	var confidence float64
+	for i := range bits {
+		bits[i] = votes[i] > 0
+		if total[i] == 0 {
+			continue
+		}
+		share := float64(agree[i]) / float64(total[i])
+		if !bits[i] {
+			share = 1 - share
+		}
+		confidence += (share - 0.5) * 2
+	}
+	confidence /= float64(invisibleFrameBits)
+
+	payload, valid := decodeInvisibleFrame(bits)
+	return invisibleResult{Payload: payload, Confidence: confidence, Valid: valid}
+}
+
+// searchInvisibleAlignment folds the center of a copy onto one tile, assuming
+// it was scaled down by scale, and finds the block phase and tile offset at
+// which the sync pattern correlates best. Folding averages the tiles, so the
+// mark adds up while the picture mostly cancels out.
+func searchInvisibleAlignment(luma []float64, width, height int, scale float64, layout *invisibleLayout) invisibleAlignment {
+	const bins = invisibleTileSize / invisibleFoldStep
+	const binsPerBlock = invisibleBlockSize / invisibleFoldStep
+
+	// Fold the copy, limited to the search extent around its center
+	x0, x1 := foldRange(width, scale)
+	y0, y1 := foldRange(height, scale)
+	binX := foldBins(x0, x1, scale)
+	binY := foldBins(y0, y1, scale)
+	var sum [bins * bins]float64
+	var count [bins * bins]int
+	for y := y0; y < y1; y++ {
+		row := binY[y-y0] * bins
+		for x := x0; x < x1; x++ {
+			sum[row+binX[x-x0]] += luma[y*width+x]
+			count[row+binX[x-x0]]++
+		}
+	}
+	var mean float64
+	filled := 0
+	for i := range sum {
+		if count[i] > 0 {
+			sum[i] /= float64(count[i])
+			mean += sum[i]
+			filled++
+		}
+	}
+	if filled == 0 {
+		return invisibleAlignment{scale: scale}
+	}
+	mean /= float64(filled)
+	for i := range sum {
+		if count[i] > 0 {
+			sum[i] -= mean
+		}
+	}
+
+	var pattern [binsPerBlock][binsPerBlock]float64
+	for y := range pattern {
+		for x := range pattern[y] {
+			pattern[y][x] = invisiblePattern((float64(x)+0.5)*invisibleFoldStep, (float64(y)+0.5)*invisibleFoldStep)
+		}
+	}
+
+	best := invisibleAlignment{scale: scale}
+	var diffs [invisibleTileSlots]float64
+	for py := 0; py < binsPerBlock; py++ {
+		for px := 0; px < binsPerBlock; px++ {
+			// Difference of the coefficients of every block of the folded
+			// tile, with blocks starting at this phase
+			var sumSq float64
+			for b := range diffs {
+				bx, by := b%invisibleTileBlocks*binsPerBlock+px, b/invisibleTileBlocks*binsPerBlock+py
+				var diff float64
+				for y := 0; y < binsPerBlock; y++ {
+					row := (by + y) % bins * bins
+					for x := 0; x < binsPerBlock; x++ {
+						diff += sum[row+(bx+x)%bins] * pattern[y][x]
+					}
+				}
+				diffs[b] = diff
+				sumSq += diff * diff
+			}
+			sd := math.Sqrt(sumSq / invisibleTileSlots)
+			if sd == 0 {
+				continue
+			}
+
+			// Correlate the sync bits at every offset of the tile
+			for oy := 0; oy < invisibleTileBlocks; oy++ {
+				for ox := 0; ox < invisibleTileBlocks; ox++ {
+					var score float64
+					for b, d := range diffs {
+						slot := (b/invisibleTileBlocks+oy)%invisibleTileBlocks*invisibleTileBlocks + (b%invisibleTileBlocks+ox)%invisibleTileBlocks
+						if s := layout.sync[slot]; s != 0 {
+							score += s * math.Max(-invisibleVoteClip, math.Min(invisibleVoteClip, d/sd))
+						}
+					}
+					score /= math.Sqrt(invisibleSyncBits)
+					if score > best.score {
+						// Block b of the folded tile is slot (ox, oy) away
+						// from the tile grid, so the copy's origin lies at
+						// that many blocks minus the phase
+						best.score = score
+						best.offset = image.Pt(
+							((ox*invisibleBlockSize-px*invisibleFoldStep)%invisibleTileSize+invisibleTileSize)%invisibleTileSize,
+							((oy*invisibleBlockSize-py*invisibleFoldStep)%invisibleTileSize+invisibleTileSize)%invisibleTileSize,
+						)
+					}
+				}
+			}
+		}
+	}
+	return best
+}
+
+// refineInvisibleAlignment narrows down the scale and offset found on the
+// folded tile by the sync correlation of every block of the copy. The
+// search steps through scales and folds into bins of several pixels, which
+// is close enough to find the mark but not always to read it.
+func refineInvisibleAlignment(luma []float64, width, height int, a invisibleAlignment, step float64, layout *invisibleLayout) invisibleAlignment {
+	best := a
+	best.score = invisibleSyncScore(luma, width, height, a, layout)
+	try := func(candidate invisibleAlignment) {
+		if score := invisibleSyncScore(luma, width, height, candidate, layout); score > best.score {
+			best = candidate
+			best.score = score
+		}
+	}
+	for i := -4; i <= 4; i++ {
+		if scale := a.scale * (1 + float64(i)*step/4); i != 0 && scale >= 1 {
+			candidate := searchInvisibleAlignment(luma, width, height, scale, layout)
+			try(candidate)
+		}
+	}
+	center := best
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if dx != 0 || dy != 0 {
+				candidate := center
+				candidate.offset = image.Pt(
+					(center.offset.X+dx+invisibleTileSize)%invisibleTileSize,
+					(center.offset.Y+dy+invisibleTileSize)%invisibleTileSize,
+				)
+				try(candidate)
+			}
+		}
+	}
+	return best
+}
+
+// foldRange returns the pixels of a copy along one axis that are folded:
+// all of them, or the search extent around the center
+func foldRange(length int, scale float64) (int, int) {
+	span := min(length, int(invisibleSearchExtent/scale))
+	start := (length - span) / 2
+	return start, start + span
+}
+
+// foldBins maps the pixels from start to end along one axis of a copy to the
+// bins of a folded tile
+func foldBins(start, end int, scale float64) []int {
+	const bins = invisibleTileSize / invisibleFoldStep
+	index := make([]int, end-start)
+	for i := range index {
+		pos := math.Mod((float64(start+i)+0.5)*scale, invisibleTileSize)
+		index[i] = min(int(pos/invisibleFoldStep), bins-1)
+	}
+	return index
+}
+
+// invisibleBlockDiffs returns the coefficient difference of every block of
+// a copy at an alignment, in standard deviations, along with the number of
+// blocks across. Blocks cut by the edges of the copy are left out as NaN.
+func invisibleBlockDiffs(luma []float64, width, height int, a invisibleAlignment) ([]float64, int) {
+	// Position of every column and row in the tile grid of the marked image
+	type gridPos struct {
+		block  int
+		b1, b2 float64 // Basis functions of frequency 1 and 2 at the pixel
+	}
+	positions := func(length, offset int) []gridPos {
+		pos := make([]gridPos, length)
+		for i := range pos {
+			p := (float64(i)+0.5)*a.scale + float64(offset)
+			block := int(p / invisibleBlockSize)
+			t := p - float64(block*invisibleBlockSize)
+			pos[i] = gridPos{block: block, b1: invisibleBasis(1, t), b2: invisibleBasis(2, t)}
+		}
+		return pos
+	}
+	cols := positions(width, a.offset.X)
+	rows := positions(height, a.offset.Y)
+
+	blocksX := cols[width-1].block + 1
+	blocksY := rows[height-1].block + 1
+	diffs := make([]float64, blocksX*blocksY)
+	for y, row := range rows {
+		for x, col := range cols {
+			diffs[row.block*blocksX+col.block] += luma[y*width+x] * (col.b1*row.b2 - col.b2*row.b1)
+		}
+	}
+
+	var sumSq float64
+	n := 0
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			i := by*blocksX + bx
+			if bx == 0 || by == 0 || bx == blocksX-1 || by == blocksY-1 {
+				diffs[i] = math.NaN()
+				continue
+			}
+			sumSq += diffs[i] * diffs[i]
+			n++
+		}
+	}
+	if n == 0 || sumSq == 0 {
+		return nil, blocksX
+	}
+	sd := math.Sqrt(sumSq / float64(n))
+	for i := range diffs {
+		diffs[i] /= sd
+	}
+	return diffs, blocksX
+}
+
+// invisibleSyncScore correlates the sync bits with every block of a copy at
+// an alignment
+func invisibleSyncScore(luma []float64, width, height int, a invisibleAlignment, layout *invisibleLayout) float64 {
+	diffs, blocksX := invisibleBlockDiffs(luma, width, height, a)
+	var score float64
+	n := 0
+	for i, d := range diffs {
+		slot := i/blocksX%invisibleTileBlocks*invisibleTileBlocks + i%blocksX%invisibleTileBlocks
+		if s := layout.sync[slot]; s != 0 && !math.IsNaN(d) {
+			score += s * math.Max(-invisibleVoteClip, math.Min(invisibleVoteClip, d))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return score / math.Sqrt(float64(n))
+}
+
+// invisibleVotes sums the clipped coefficient differences of every block of
+// a copy at an alignment into votes per frame bit, and counts how many
+// blocks agree with the sign of each vote
+func invisibleVotes(luma []float64, width, height int, a invisibleAlignment, layout *invisibleLayout) (votes []float64, agree, total []int) {
+	votes = make([]float64, invisibleFrameBits)
+	agree = make([]int, invisibleFrameBits)
+	total = make([]int, invisibleFrameBits)
+	diffs, blocksX := invisibleBlockDiffs(luma, width, height, a)
+	for i, d := range diffs {
+		slot := i/blocksX%invisibleTileBlocks*invisibleTileBlocks + i%blocksX%invisibleTileBlocks
+		bit := layout.bit[slot]
+		if bit < 0 || math.IsNaN(d) {
+			continue
+		}
+		votes[bit] += math.Max(-invisibleVoteClip, math.Min(invisibleVoteClip, d))
+		if d > 0 {
+			agree[bit]++
+		}
+		total[bit]++
+	}
+	return votes, agree, total
+}
+
+// clampByte rounds v to the nearest value in 0-255
+func clampByte(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
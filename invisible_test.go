@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// photoLikeImage returns an image with gradients and noise, closer to a
+// photo than a flat test image
+func photoLikeImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(7))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := rng.Intn(40) - 20
+			img.Set(x, y, color.NRGBA{
+				R: clampByte(float64(x*200/width + 30 + noise)),
+				G: clampByte(float64(y*180/height + 40 + noise)),
+				B: clampByte(float64((x+y)*100/(width+height) + 80 + noise)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+func TestInvisibleWatermarkRoundTrip(t *testing.T) {
+	img := photoLikeImage(1024, 768)
+	marked, err := embedInvisibleWatermark(img, "IMG-000123", "secret", DefaultInvisibleStrength)
+	if err != nil {
+		t.Fatalf("embedInvisibleWatermark() error = %v", err)
+	}
+
+	result := extractInvisibleWatermark(marked, "secret")
+	if !result.Valid || result.Payload != "IMG-000123" {
+		t.Fatalf("extractInvisibleWatermark() = %+v, want payload IMG-000123", result)
+	}
+	if result.Confidence < 0.5 {
+		t.Errorf("extractInvisibleWatermark() confidence = %v, want >= 0.5", result.Confidence)
+	}
+}
+
+func TestInvisibleWatermarkSurvivesJPEGAndResize(t *testing.T) {
+	img := photoLikeImage(1600, 1200)
+	marked, err := embedInvisibleWatermark(img, "ACME-42", "secret", DefaultInvisibleStrength)
+	if err != nil {
+		t.Fatalf("embedInvisibleWatermark() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	resized := imaging.Resize(marked, 800, 0, imaging.Lanczos)
+	if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	copied, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Failed to decode JPEG: %v", err)
+	}
+
+	result := extractInvisibleWatermark(copied, "secret")
+	if !result.Valid || result.Payload != "ACME-42" {
+		t.Errorf("extractInvisibleWatermark() after JPEG and resize = %+v, want payload ACME-42", result)
+	}
+}
+
+func TestInvisibleWatermarkSurvivesCropping(t *testing.T) {
+	img := photoLikeImage(1600, 1200)
+	marked, err := embedInvisibleWatermark(img, "ACME-42", "secret", DefaultInvisibleStrength)
+	if err != nil {
+		t.Fatalf("embedInvisibleWatermark() error = %v", err)
+	}
+
+	crops := []image.Rectangle{
+		image.Rect(0, 0, 1600, 1190),
+		image.Rect(0, 0, 1600, 1160),
+		image.Rect(0, 0, 1600, 1080),
+		image.Rect(0, 0, 1600, 910),
+		image.Rect(37, 53, 1400, 1100),
+		image.Rect(500, 300, 900, 700),
+	}
+	for _, crop := range crops {
+		result := extractInvisibleWatermark(imaging.Crop(marked, crop), "secret")
+		if !result.Valid || result.Payload != "ACME-42" {
+			t.Errorf("extractInvisibleWatermark() cropped to %v = %+v, want payload ACME-42", crop, result)
+		}
+	}
+}
+
+func TestInvisibleWatermarkWrongKeyOrUnmarked(t *testing.T) {
+	img := photoLikeImage(640, 480)
+	marked, err := embedInvisibleWatermark(img, "ID-1", "secret", DefaultInvisibleStrength)
+	if err != nil {
+		t.Fatalf("embedInvisibleWatermark() error = %v", err)
+	}
+
+	if result := extractInvisibleWatermark(marked, "other"); result.Valid {
+		t.Errorf("extractInvisibleWatermark() with wrong key = %+v, want invalid", result)
+	}
+	if result := extractInvisibleWatermark(img, "secret"); result.Valid {
+		t.Errorf("extractInvisibleWatermark() of unmarked image = %+v, want invalid", result)
+	}
+}
+
+func TestInvisibleFrame(t *testing.T) {
+	bits, err := invisibleFrame("hello")
+	if err != nil {
+		t.Fatalf("invisibleFrame() error = %v", err)
+	}
+	if payload, ok := decodeInvisibleFrame(bits); !ok || payload != "hello" {
+		t.Errorf("decodeInvisibleFrame() = %q, %v, want hello", payload, ok)
+	}
+
+	bits[20] = !bits[20]
+	if _, ok := decodeInvisibleFrame(bits); ok {
+		t.Error("decodeInvisibleFrame() accepted a corrupted frame")
+	}
+
+	if _, err := invisibleFrame("this payload is too long"); err == nil {
+		t.Error("invisibleFrame() expected error for long payload")
+	}
+}
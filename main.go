@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +19,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/disintegration/imaging"
+	"golang.org/x/image/font/opentype"
 )
 
 // Required environment variables
@@ -29,6 +34,70 @@ const (
 	MaxWorkers          = 5   // Maximum number of concurrent workers
 )
 
+// Optional environment variables
+const (
+	EnvWatermarkText          = "WATERMARK_TEXT"               // Text watermark template, e.g. "© {photographer} {year}"
+	EnvWatermarkTextPosition  = "WATERMARK_TEXT_POSITION"      // Anchor of the text watermark
+	EnvWatermarkTextSize      = "WATERMARK_TEXT_SIZE"          // Font size of the text watermark in pixels
+	EnvWatermarkTextColor     = "WATERMARK_TEXT_COLOR"         // Text color as #RRGGBB or #RRGGBBAA
+	EnvWatermarkFont          = "WATERMARK_FONT_PATH"          // TrueType/OpenType font file for text watermarks
+	EnvWatermarkMode          = "WATERMARK_MODE"               // "corners", "tiled", "bar" or "frame"
+	EnvTileSource             = "TILE_SOURCE"                  // Watermark repeated in tiled mode: "left", "right" or "text"
+	EnvTileAngle              = "TILE_ANGLE"                   // Rotation of tiles in degrees
+	EnvTileSpacing            = "TILE_SPACING"                 // Gap between tiles in pixels
+	EnvTileOpacity            = "TILE_OPACITY"                 // Opacity of tiles between 0 and 1
+	EnvBarHeight              = "BAR_HEIGHT"                   // Height of the caption bar in pixels or percent of the image height
+	EnvBarStyle               = "BAR_STYLE"                    // Caption bar background: "solid" or "blur"
+	EnvBarColor               = "BAR_COLOR"                    // Color of solid caption bars and frames
+	EnvFrameWidth             = "FRAME_WIDTH"                  // Frame border in pixels or percent of the shorter image side
+	EnvQRCodeURL              = "QR_CODE_URL"                  // Template of the URL encoded in a QR code watermark
+	EnvQRCodeLevel            = "QR_CODE_LEVEL"                // QR error correction level: L, M, Q or H
+	EnvQRCodeSize             = "QR_CODE_SIZE"                 // QR code size in pixels or percent of the shorter image side
+	EnvQRCodeQuietZone        = "QR_CODE_QUIET_ZONE"           // White border around the QR code in modules
+	EnvQRCodePosition         = "QR_CODE_POSITION"             // Anchor of the QR code, e.g. "top-right"
+	EnvLeftWatermarkDark      = "LEFT_WATERMARK_DARK_PATH"     // Dark variant of the left watermark for bright backgrounds
+	EnvRightWatermarkDark     = "RIGHT_WATERMARK_DARK_PATH"    // Dark variant of the right watermark for bright backgrounds
+	EnvLuminanceThreshold     = "LUMINANCE_THRESHOLD"          // Background luminance (0-255) above which dark variants are used
+	EnvWatermarkPlacement     = "WATERMARK_PLACEMENT"          // "fixed" or "auto"
+	EnvStripMetadata          = "STRIP_METADATA"               // Metadata groups not copied to outputs: "exif", "xmp", "icc"
+	EnvExifAllowTags          = "EXIF_ALLOW_TAGS"              // EXIF tags kept in outputs, all others are removed
+	EnvExifDenyTags           = "EXIF_DENY_TAGS"               // EXIF tags removed from outputs, e.g. "gps,personal"
+	EnvReportPath             = "REPORT_PATH"                  // File the JSON run report is written to
+	EnvXMPCreator             = "XMP_CREATOR"                  // Creator written into output XMP (templated)
+	EnvXMPCopyright           = "XMP_COPYRIGHT"                // Copyright notice written into output XMP (templated)
+	EnvXMPCreditLine          = "XMP_CREDIT_LINE"              // Credit line written into output XMP (templated)
+	EnvXMPWebStatement        = "XMP_WEB_STATEMENT"            // Web statement of rights URL written into output XMP (templated)
+	EnvXMPLicensorURL         = "XMP_LICENSOR_URL"             // Licensor URL written into output XMP (templated)
+	EnvInvisibleWatermark     = "INVISIBLE_WATERMARK"          // Payload hidden in the image, up to 15 bytes (templated)
+	EnvInvisibleKey           = "INVISIBLE_WATERMARK_KEY"      // Secret that scatters the payload across the image
+	EnvInvisibleStrength      = "INVISIBLE_WATERMARK_STRENGTH" // Embedding strength, higher is more robust and more visible
+	EnvRecipientsPath         = "RECIPIENTS_PATH"              // JSON recipient list; each recipient gets its own marked copy
+	EnvSigningKeyPath         = "SIGNING_KEY_PATH"             // PEM Ed25519 private key used to sign outputs
+	EnvProvenance             = "PROVENANCE_SIDECARS"          // Write a JSON provenance sidecar for each output
+	EnvProvenancePrefix       = "PROVENANCE_PREFIX"            // Prefix for sidecars instead of next to the outputs
+	EnvFormatDetection        = "FORMAT_DETECTION"             // How images are recognized: "extension", "auto" or "content"
+	EnvOutputFormat           = "OUTPUT_FORMAT"                // "jpeg" or "webp"
+	EnvOutputQuality          = "OUTPUT_QUALITY"               // Encoder quality from 1 to 100
+	EnvWebPLossless           = "WEBP_LOSSLESS"                // Encode WebP outputs losslessly
+	EnvAnimationFormat        = "ANIMATION_FORMAT"             // Format of watermarked animations: "gif" or "webp"
+	EnvTIFFPages              = "TIFF_PAGES"                   // Pages of multi-page TIFFs to process: "first" or "all"
+	EnvExternalDecoders       = "EXTERNAL_DECODERS"            // Converters for formats without a built-in decoder, e.g. ".heic=heif-convert {input} {output}"
+	EnvDecoderTimeout         = "DECODER_TIMEOUT"              // Seconds an external decoder may run
+	EnvDerivativesPath        = "DERIVATIVES_PATH"             // JSON list of resized renditions to write for every image
+	EnvTransforms             = "TRANSFORMS"                   // Steps applied before watermarking, e.g. "clamp 2048; crop 4:3 smart; sharpen"
+	EnvRedactionSidecars      = "REDACTION_SIDECARS"           // Hide the regions listed in a <key>.json sidecar next to each image
+	EnvRedactionStyle         = "REDACTION_STYLE"              // Default redaction: "pixelate" or "blur"
+	EnvWatermarkOverrides     = "WATERMARK_OVERRIDES"          // Sources of per-image overrides: "tags", "sidecar" or both
+	EnvRulesPath              = "RULES_PATH"                   // JSON rules mapping key patterns to watermark profiles
+	DefaultTextSize           = 32
+	DefaultTextColor          = "#FFFFFF"
+	DefaultTextPosition       = anchorBottomCenter
+	DefaultTileAngle          = 30
+	DefaultTileSpacing        = 100
+	DefaultTileOpacity        = 0.3
+	DefaultLuminanceThreshold = 128
+)
+
 // loadWatermarkImage loads a watermark image from a file path or URL
 func loadWatermarkImage(path string) (image.Image, error) {
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
@@ -96,6 +165,92 @@ func validateEnvironment() error {
 		return err
 	}
 
+	if err := validateVariantSettings(); err != nil {
+		return err
+	}
+	if err := validateTextSettings(); err != nil {
+		return err
+	}
+	if err := validatePlacementSettings(); err != nil {
+		return err
+	}
+	if err := validateMetadataSettings(); err != nil {
+		return err
+	}
+	if err := validateScrubSettings(); err != nil {
+		return err
+	}
+	if err := validateInvisibleSettings(); err != nil {
+		return err
+	}
+	if err := validateDeliverySettings(); err != nil {
+		return err
+	}
+	if err := validateSigningSettings(); err != nil {
+		return err
+	}
+	if err := validateProvenanceSettings(); err != nil {
+		return err
+	}
+	if err := validateFormatSettings(); err != nil {
+		return err
+	}
+	if err := validateOutputSettings(); err != nil {
+		return err
+	}
+	if err := validateTIFFSettings(); err != nil {
+		return err
+	}
+	if err := validateDecoderSettings(); err != nil {
+		return err
+	}
+	if err := validateDerivativeSettings(); err != nil {
+		return err
+	}
+	if err := validateTransformSettings(); err != nil {
+		return err
+	}
+	if err := validateCaptionSettings(); err != nil {
+		return err
+	}
+	if err := validateQRSettings(); err != nil {
+		return err
+	}
+	if err := validateRedactionSettings(); err != nil {
+		return err
+	}
+	if err := validateOverrideSettings(); err != nil {
+		return err
+	}
+	if err := validateRulesSettings(); err != nil {
+		return err
+	}
+
+	return validateTileSettings()
+}
+
+// validateTextSettings checks the optional text watermark settings
+func validateTextSettings() error {
+	if v := os.Getenv(EnvWatermarkTextPosition); v != "" {
+		if _, err := parseAnchor(v); err != nil {
+			return err
+		}
+	}
+	if v := os.Getenv(EnvWatermarkTextSize); v != "" {
+		if size, err := strconv.ParseFloat(v, 64); err != nil || size <= 0 {
+			return fmt.Errorf("%s must be a positive number: %s", EnvWatermarkTextSize, v)
+		}
+	}
+	if v := os.Getenv(EnvWatermarkTextColor); v != "" {
+		if _, err := parseHexColor(v); err != nil {
+			return err
+		}
+	}
+	if v := os.Getenv(EnvWatermarkFont); v != "" {
+		if _, err := os.Stat(v); os.IsNotExist(err) {
+			return fmt.Errorf("font file not found: %s", v)
+		}
+	}
 	return nil
 }
 
@@ -106,6 +261,54 @@ type ImageProcessor struct {
 	targetPrefix   string
 	leftWatermark  image.Image
 	rightWatermark image.Image
+	leftDark       image.Image
+	rightDark      image.Image
+	textTemplate   string
+	rights         xmpRights
+	hiddenPayload  string
+	hiddenKey      string
+	hiddenStrength float64
+	textFont       *opentype.Font
+	textSize       float64
+	textColor      color.NRGBA
+	textPosition   anchor
+	mode           string
+	placement      string
+	tileSource     string
+	tileAngle      float64
+	tileSpacing    int
+	tileOpacity    float64
+	lumaThreshold  float64
+	stripMetadata  map[string]bool
+	exifPolicy     *exifPolicy
+	report         *runReport
+	reportPath     string
+	recipients     []recipient
+	recipient      *recipient
+	signer         *signer
+	provenance     *provenanceConfig
+	detection      string
+	outputFormat   string
+	quality        int
+	lossless       bool
+	animFormat     string
+	tiffPages      string
+	decoders       decoderRegistry
+	derivatives    []derivative
+	transforms     transformChain
+	caption        *captionBar
+	qr             *qrSettings
+	redact         bool
+	redactStyle    string
+	overrideFrom   map[string]bool
+	overridden     watermarkOverrides
+	leftPosition   anchor
+	rightPosition  anchor
+	opacity        float64
+	rules          *ruleSet
+	profile        string
+	unmarked       bool
+	runTime        time.Time
 	logger         *log.Logger
 }
 
@@ -132,6 +335,169 @@ func NewImageProcessor(ctx context.Context, logger *log.Logger) (*ImageProcessor
 		return nil, fmt.Errorf("failed to load right watermark: %v", err)
 	}
 
+	leftDark, err := loadOptionalWatermark(EnvLeftWatermarkDark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dark left watermark: %v", err)
+	}
+
+	rightDark, err := loadOptionalWatermark(EnvRightWatermarkDark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dark right watermark: %v", err)
+	}
+
+	hiddenKey := DefaultInvisibleKey
+	if v := os.Getenv(EnvInvisibleKey); v != "" {
+		hiddenKey = v
+	}
+
+	hiddenStrength := float64(DefaultInvisibleStrength)
+	if v := os.Getenv(EnvInvisibleStrength); v != "" {
+		hiddenStrength, _ = strconv.ParseFloat(v, 64)
+	}
+
+	hiddenPayload := os.Getenv(EnvInvisibleWatermark)
+	var recipients []recipient
+	if v := os.Getenv(EnvRecipientsPath); v != "" {
+		if recipients, err = loadRecipients(v, 0); err != nil {
+			return nil, err
+		}
+		if hiddenPayload == "" {
+			hiddenPayload = DefaultRecipientPayload
+		}
+	}
+
+	var outputSigner *signer
+	if v := os.Getenv(EnvSigningKeyPath); v != "" {
+		if outputSigner, err = loadSigner(v); err != nil {
+			return nil, err
+		}
+	}
+
+	stripMetadata, _ := parseStripMetadata(os.Getenv(EnvStripMetadata))
+	exifPolicy, _ := parseExifPolicy(os.Getenv(EnvExifAllowTags), os.Getenv(EnvExifDenyTags))
+
+	luminanceThreshold := float64(DefaultLuminanceThreshold)
+	if v := os.Getenv(EnvLuminanceThreshold); v != "" {
+		luminanceThreshold, _ = strconv.ParseFloat(v, 64)
+	}
+
+	textTemplate := os.Getenv(EnvWatermarkText)
+	textFont, err := loadFont(os.Getenv(EnvWatermarkFont))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watermark font: %v", err)
+	}
+
+	textSize := float64(DefaultTextSize)
+	if v := os.Getenv(EnvWatermarkTextSize); v != "" {
+		textSize, _ = strconv.ParseFloat(v, 64)
+	}
+
+	textColor, _ := parseHexColor(DefaultTextColor)
+	if v := os.Getenv(EnvWatermarkTextColor); v != "" {
+		textColor, _ = parseHexColor(v)
+	}
+
+	textPosition := DefaultTextPosition
+	if v := os.Getenv(EnvWatermarkTextPosition); v != "" {
+		textPosition, _ = parseAnchor(v)
+	}
+
+	mode := ModeCorners
+	if v := os.Getenv(EnvWatermarkMode); v != "" {
+		mode = v
+	}
+
+	detection := DetectAuto
+	if v := os.Getenv(EnvFormatDetection); v != "" {
+		detection = v
+	}
+
+	outputFormat := FormatJPEG
+	if v := os.Getenv(EnvOutputFormat); v != "" {
+		outputFormat = v
+	}
+
+	quality := DefaultJPEGQuality
+	if outputFormat == FormatWebP {
+		quality = DefaultWebPQuality
+	}
+	if v := os.Getenv(EnvOutputQuality); v != "" {
+		quality, _ = strconv.Atoi(v)
+	}
+	lossless, _ := strconv.ParseBool(os.Getenv(EnvWebPLossless))
+
+	animFormat := FormatGIF
+	if v := os.Getenv(EnvAnimationFormat); v != "" {
+		animFormat = v
+	}
+
+	tiffPages := TIFFPagesFirst
+	if v := os.Getenv(EnvTIFFPages); v != "" {
+		tiffPages = v
+	}
+
+	var derivatives []derivative
+	if v := os.Getenv(EnvDerivativesPath); v != "" {
+		if derivatives, err = loadDerivatives(v); err != nil {
+			return nil, err
+		}
+		resolveDerivatives(derivatives, outputFormat, quality)
+	}
+
+	transforms, _ := parseTransforms(os.Getenv(EnvTransforms))
+
+	timeout, _ := decoderTimeout()
+	decoders, err := newDecoderRegistry(os.Getenv(EnvExternalDecoders), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	placement := PlacementFixed
+	if v := os.Getenv(EnvWatermarkPlacement); v != "" {
+		placement = v
+	}
+
+	tileSource := TileSourceLeft
+	if v := os.Getenv(EnvTileSource); v != "" {
+		tileSource = v
+	}
+
+	tileAngle := float64(DefaultTileAngle)
+	if v := os.Getenv(EnvTileAngle); v != "" {
+		tileAngle, _ = strconv.ParseFloat(v, 64)
+	}
+
+	tileSpacing := DefaultTileSpacing
+	if v := os.Getenv(EnvTileSpacing); v != "" {
+		tileSpacing, _ = strconv.Atoi(v)
+	}
+
+	tileOpacity := DefaultTileOpacity
+	if v := os.Getenv(EnvTileOpacity); v != "" {
+		tileOpacity, _ = strconv.ParseFloat(v, 64)
+	}
+
+	qrCode, _ := newQRSettings()
+
+	redact, _ := strconv.ParseBool(os.Getenv(EnvRedactionSidecars))
+	redactStyle, _ := redactionStyle()
+	overrideFrom, _ := overrideSources()
+
+	var rules *ruleSet
+	if path := os.Getenv(EnvRulesPath); path != "" {
+		rules, _ = loadRules(path)
+		if err := rules.loadLogos(); err != nil {
+			logger.Printf("ERROR: Failed to load rule profile watermarks: %v", err)
+			return nil, err
+		}
+		logger.Printf("Loaded %d rules and %d profiles from %s", len(rules.Rules), len(rules.Profiles), path)
+	}
+
+	var caption *captionBar
+	if mode == ModeBar || mode == ModeFrame {
+		caption, _ = newCaptionBar()
+	}
+
 	logger.Printf("Initializing ImageProcessor with bucket: %s, source prefix: %s, target prefix: %s", 
 		os.Getenv(EnvBucket), os.Getenv(EnvSourcePrefix), os.Getenv(EnvTargetPrefix))
 
@@ -142,15 +508,60 @@ func NewImageProcessor(ctx context.Context, logger *log.Logger) (*ImageProcessor
 	}
 
 	logger.Printf("Successfully initialized AWS SDK configuration")
-	return &ImageProcessor{
+	ip := &ImageProcessor{
 		s3Client:       s3.NewFromConfig(cfg),
 		sourceBucket:   os.Getenv(EnvBucket),
 		sourcePrefix:   os.Getenv(EnvSourcePrefix),
 		targetPrefix:   os.Getenv(EnvTargetPrefix),
 		leftWatermark:  leftWatermark,
 		rightWatermark: rightWatermark,
+		leftDark:       leftDark,
+		rightDark:      rightDark,
+		textTemplate:   textTemplate,
+		rights:         loadRightsTemplates(),
+		hiddenPayload:  hiddenPayload,
+		hiddenKey:      hiddenKey,
+		hiddenStrength: hiddenStrength,
+		textFont:       textFont,
+		textSize:       textSize,
+		textColor:      textColor,
+		textPosition:   textPosition,
+		mode:           mode,
+		placement:      placement,
+		tileSource:     tileSource,
+		tileAngle:      tileAngle,
+		tileSpacing:    tileSpacing,
+		tileOpacity:    tileOpacity,
+		lumaThreshold:  luminanceThreshold,
+		stripMetadata:  stripMetadata,
+		exifPolicy:     exifPolicy,
+		report:         &runReport{},
+		reportPath:     os.Getenv(EnvReportPath),
+		recipients:     recipients,
+		signer:         outputSigner,
+		detection:      detection,
+		outputFormat:   outputFormat,
+		quality:        quality,
+		lossless:       lossless,
+		animFormat:     animFormat,
+		tiffPages:      tiffPages,
+		decoders:       decoders,
+		derivatives:    derivatives,
+		transforms:     transforms,
+		caption:        caption,
+		qr:             qrCode,
+		redact:         redact,
+		redactStyle:    redactStyle,
+		overrideFrom:   overrideFrom,
+		rules:          rules,
+		runTime:        time.Now(),
 		logger:         logger,
-	}, nil
+	}
+
+	if enabled, _ := strconv.ParseBool(os.Getenv(EnvProvenance)); enabled {
+		ip.provenance = ip.newProvenanceConfig(os.Getenv(EnvProvenancePrefix))
+	}
+	return ip, nil
 }
 
 type ProcessResult struct {
@@ -160,6 +571,8 @@ type ProcessResult struct {
 
 func (ip *ImageProcessor) ProcessImages(ctx context.Context) error {
 	startTime := time.Now()
+	ip.runTime = startTime
+	ip.report = &runReport{}
 	ip.logger.Printf("Starting image processing workflow")
 	
 	// Get list of images to process
@@ -190,12 +603,14 @@ func (ip *ImageProcessor) ProcessImages(ctx context.Context) error {
 		go func(workerID int) {
 			defer wg.Done()
 			for key := range jobs {
-				err := ip.processImage(ctx, key)
+				err := ip.processKey(ctx, key)
 				results <- ProcessResult{
 					Key: key,
 					Err: err,
 				}
-				if err != nil {
+				if _, skipped := err.(*skipError); skipped {
+					ip.logger.Printf("Worker %d: Skipped %s: %v", workerID, key, err)
+				} else if err != nil {
 					ip.logger.Printf("Worker %d: Failed to process %s: %v", workerID, key, err)
 				} else {
 					ip.logger.Printf("Worker %d: Successfully processed %s", workerID, key)
@@ -211,7 +626,7 @@ func (ip *ImageProcessor) ProcessImages(ctx context.Context) error {
 			continue
 		}
 		key := *obj.Key
-		if !isImageFile(key) {
+		if queue, _ := ip.needsSniffing(key); !queue {
 			continue
 		}
 		jobs <- key
@@ -228,8 +643,12 @@ func (ip *ImageProcessor) ProcessImages(ctx context.Context) error {
 	// Process results
 	var errors []error
 	successCount := 0
+	skippedCount := 0
 	for result := range results {
-		if result.Err != nil {
+		if skip, ok := result.Err.(*skipError); ok {
+			ip.report.addSkipped(result.Key, skip.reason)
+			skippedCount++
+		} else if result.Err != nil {
 			errors = append(errors, fmt.Errorf("failed to process %s: %v", result.Key, result.Err))
 		} else {
 			successCount++
@@ -237,7 +656,18 @@ func (ip *ImageProcessor) ProcessImages(ctx context.Context) error {
 	}
 
 	// Log summary
-	ip.logger.Printf("Processing complete. Successfully processed %d/%d images", successCount, imageCount)
+	ip.logger.Printf("Processing complete. Successfully processed %d/%d images", successCount, imageCount-skippedCount)
+	if skippedCount > 0 {
+		ip.logger.Printf("Skipped %d objects that aren't supported images", skippedCount)
+	}
+	ip.report.log(ip)
+	if ip.reportPath != "" {
+		if err := ip.report.write(ip.reportPath); err != nil {
+			ip.logger.Printf("ERROR: %v", err)
+		} else {
+			ip.logger.Printf("Wrote run report to %s", ip.reportPath)
+		}
+	}
 	if len(errors) > 0 {
 		return fmt.Errorf("encountered %d errors during processing: %v", len(errors), errors)
 	}
@@ -253,6 +683,32 @@ func (ip *ImageProcessor) processImage(ctx context.Context, key string) error {
 	startTime := time.Now()
 	ip.logger.Printf("Starting processing of image: %s", key)
 
+	// Check the content of keys whose extension doesn't mark them as images
+	if _, sniff := ip.needsSniffing(key); sniff {
+		format, err := ip.sniffObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if format != "" {
+			ip.logger.Printf("Detected %s content in %s", format, key)
+		}
+	}
+
+	// Apply the watermark settings of this image
+	if len(ip.overrideFrom) > 0 {
+		overrides, err := ip.loadOverrides(ctx, key)
+		if err != nil {
+			return err
+		}
+		if overrides[OverrideWatermark] == WatermarkSkip {
+			return &skipError{reason: fmt.Sprintf("%s=%s override", OverrideWatermark, WatermarkSkip)}
+		}
+		if len(overrides) > 0 {
+			ip.logger.Printf("Applying overrides to %s: %s", key, overrides)
+			ip = ip.withOverrides(overrides)
+		}
+	}
+
 	// Download image
 	ip.logger.Printf("Downloading image from S3: %s", key)
 	getInput := &s3.GetObjectInput{
@@ -266,64 +722,402 @@ func (ip *ImageProcessor) processImage(ctx context.Context, key string) error {
 	}
 	defer result.Body.Close()
 
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read object %s: %v", key, err)
+	}
 	ip.logger.Printf("Successfully downloaded image: %s", key)
 
+	format := sniffFormat(data)
+	var contentType string
+	if result.ContentType != nil {
+		contentType = *result.ContentType
+	}
+	decoder := ip.decoders.lookup(key, contentType, format)
+	if decoder == nil {
+		if format != "" {
+			return &skipError{reason: fmt.Sprintf("no decoder for %s", format)}
+		}
+		return &skipError{reason: "unsupported content"}
+	}
+	if claimed := formatFromExtension(key); format != "" && claimed != "" && claimed != format {
+		ip.logger.Printf("WARNING: %s has a %s extension but contains %s data", key, claimed, format)
+	}
+	_, builtin := decoder.(builtinDecoder)
+
+	// Fetch the regions to redact, refusing to publish the image when the
+	// sidecar can't be read
+	var redaction *redactionSidecar
+	if ip.redact {
+		if redaction, err = ip.loadRedactions(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// Read EXIF, XMP and ICC metadata
+	meta, err := extractMetadata(data)
+	if err != nil {
+		ip.logger.Printf("WARNING: Failed to read metadata for %s: %v", key, err)
+		meta = &imageMetadata{}
+	}
+	// The built-in decoders rotate the pixels upright, external ones may not
+	meta.upright = builtin
+	var exifFields map[string]string
+	if meta.exif != nil {
+		exifFields = meta.exif.Fields()
+	}
+
+	// Render text watermark and rights metadata
+	var text string
+	var vars templateVars
+	var qrURL string
+	if ip.textTemplate != "" || !ip.rights.isEmpty() || ip.hiddenPayload != "" || ip.qr != nil {
+		vars = ip.imageTemplateVars(ctx, key, result.Metadata, exifFields)
+		if ip.textTemplate != "" {
+			text = renderTemplate(ip.textTemplate, vars)
+			ip.logger.Printf("Rendered text watermark for %s: %q", key, text)
+		}
+		if ip.qr != nil {
+			qrURL = renderTemplate(ip.qr.template, vars)
+		}
+		meta.rights = ip.rights.render(vars)
+	}
+
+	// Watermark animated GIFs frame by frame
+	if format == "gif" && builtin {
+		if anim, err := gif.DecodeAll(bytes.NewReader(data)); err == nil && len(anim.Image) > 1 {
+			return ip.processAnimation(ctx, &processedImage{key: key, source: result, data: data, text: text, qrURL: qrURL, redaction: redaction}, anim, meta)
+		}
+	}
+
+	// Split multi-page TIFFs into one output per page
+	if format == "tiff" && builtin && ip.tiffPages == TIFFPagesAll {
+		if pages := tiffIFDs(data); len(pages) > 1 {
+			return ip.processPages(ctx, &processedImage{key: key, source: result, data: data, text: text, qrURL: qrURL, redaction: redaction}, pages, vars, meta)
+		}
+	}
+
 	// Decode image
-	ip.logger.Printf("Decoding image: %s", key)
-	img, err := imaging.Decode(result.Body)
+	ip.logger.Printf("Decoding image with %s decoder: %s", decoder, key)
+	img, err := decoder.decode(ctx, data, sourceExtension(key, format))
 	if err != nil {
 		return fmt.Errorf("failed to decode image %s: %v", key, err)
 	}
+	if orientation := exifFields["Orientation"]; builtin && orientation != "" && orientation != "1" {
+		ip.logger.Printf("Applied EXIF orientation %s to image: %s", orientation, key)
+	}
 	ip.logger.Printf("Successfully decoded image: %s, dimensions: %dx%d", key, img.Bounds().Dx(), img.Bounds().Dy())
 
+	// Embed visible and invisible watermarks and encode
+	var payload string
+	if ip.hiddenPayload != "" {
+		payload = renderTemplate(ip.hiddenPayload, vars)
+	}
+	out := &processedImage{
+		key:       key,
+		source:    result,
+		data:      data,
+		text:      text,
+		qrURL:     qrURL,
+		payload:   payload,
+		redaction: redaction,
+	}
+	if err := ip.storeImage(ctx, out, img, meta); err != nil {
+		return err
+	}
+
+	duration := time.Since(startTime)
+	ip.logger.Printf("Successfully processed image %s in %v", key, duration)
+	return nil
+}
+
+// storeImage redacts, transforms and watermarks a decoded image and stores
+// it, or each configured derivative of it
+func (ip *ImageProcessor) storeImage(ctx context.Context, base *processedImage, img image.Image, meta *imageMetadata) error {
+	if base.redaction != nil {
+		redacted := *base
+		var err error
+		if img, redacted.redacted, err = base.redaction.apply(img, max(base.page, 1)); err != nil {
+			return fmt.Errorf("failed to redact image %s: %v", base.key, err)
+		}
+		ip.logger.Printf("Redacted %d regions of image: %s", redacted.redacted, base.key)
+		base = &redacted
+	}
+	if len(ip.transforms) > 0 {
+		img = ip.applyTransforms(base.key, img)
+	}
+	if len(ip.derivatives) > 0 {
+		return ip.storeDerivatives(ctx, base, img, meta)
+	}
+
+	watermarked, encoded, err := ip.watermarkImage(base.key, img, base.text, base.qrURL, base.payload, meta)
+	if err != nil {
+		return err
+	}
+	out := *base
+	out.encoded = encoded
+	out.format = ip.outputFormat
+	out.bounds = watermarked.Bounds()
+	return ip.storeOutput(ctx, &out)
+}
+
+// watermarkImage adds the visible and invisible watermarks to a decoded
+// image and encodes it with its metadata in the output format
+func (ip *ImageProcessor) watermarkImage(key string, img image.Image, text, qrURL, payload string, meta *imageMetadata) (image.Image, []byte, error) {
 	// Add watermark
 	ip.logger.Printf("Adding watermark to image: %s", key)
-	watermarked, err := ip.addWatermark(img)
+	watermarked, err := ip.addWatermark(img, text, qrURL)
 	if err != nil {
-		return fmt.Errorf("failed to add watermark to image %s: %v", key, err)
+		return nil, nil, fmt.Errorf("failed to add watermark to image %s: %v", key, err)
 	}
+	return ip.finishImage(key, watermarked, payload, meta)
+}
+
+// finishImage embeds the invisible watermark in a watermarked image and
+// encodes it with its metadata in the output format
+func (ip *ImageProcessor) finishImage(key string, watermarked image.Image, payload string, meta *imageMetadata) (image.Image, []byte, error) {
+	var err error
 
+	// Embed invisible watermark
+	if payload != "" {
+		watermarked, err = embedInvisibleWatermark(watermarked, payload, ip.hiddenKey, ip.hiddenStrength)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to embed invisible watermark in image %s: %v", key, err)
+		}
+		ip.logger.Printf("Embedded invisible watermark %q in image: %s", payload, key)
+	}
+
+	// Encode processed image
+	encoded, err := ip.encodeImage(key, watermarked, meta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode processed image %s: %v", key, err)
+	}
+	return watermarked, encoded, nil
+}
+
+// processedImage is a watermarked image ready to be stored
+type processedImage struct {
+	key     string
+	source  *s3.GetObjectOutput
+	data    []byte // Source bytes
+	encoded []byte
+	format  string
+	bounds  image.Rectangle
+	text    string
+	qrURL   string
+	payload string
+	page    int // Page of a multi-page source, 0 for single images
+
+	redaction *redactionSidecar // Regions to hide, nil without a sidecar
+	redacted  int               // Number of regions hidden
+
+	derivative string // Name of the derivative, "" without derivatives
+	suffix     string // Rendered key suffix of the derivative
+}
+
+// targetKey returns the key a processed image is uploaded to
+func (ip *ImageProcessor) targetKey(out *processedImage) string {
+	targetKey := strings.Replace(out.key, ip.sourcePrefix, ip.targetPrefix, 1)
+	if out.page > 0 {
+		targetKey = pageKey(targetKey, out.page)
+	}
+	if out.suffix != "" {
+		targetKey = derivativeKey(targetKey, out.suffix)
+	}
+	return ip.outputKey(targetKey, out.format)
+}
+
+// storeOutput uploads a processed image to the target prefix along with its
+// provenance sidecar
+func (ip *ImageProcessor) storeOutput(ctx context.Context, out *processedImage) error {
 	// Create temporary file
-	ip.logger.Printf("Creating temporary file for processed image: %s", key)
-	tempFile, err := os.CreateTemp("", "watermarked-*.jpg")
+	ip.logger.Printf("Creating temporary file for processed image: %s", out.key)
+	tempFile, err := os.CreateTemp("", "watermarked-*."+out.format)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	defer os.Remove(tempFile.Name())
 
 	// Save processed image to temp file
-	err = imaging.Save(watermarked, tempFile.Name())
+	_, err = tempFile.Write(out.encoded)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return fmt.Errorf("failed to save processed image: %v", err)
 	}
 
 	// Upload processed image
-	targetKey := strings.Replace(key, ip.sourcePrefix, ip.targetPrefix, 1)
+	targetKey := ip.targetKey(out)
 	ip.logger.Printf("Uploading processed image to: %s", targetKey)
 
-	err = ip.uploadImage(ctx, tempFile.Name(), targetKey)
+	err = ip.uploadImage(ctx, tempFile.Name(), targetKey, outputContentType(out.format))
 	if err != nil {
 		return fmt.Errorf("failed to upload processed image %s: %v", targetKey, err)
 	}
 
-	duration := time.Since(startTime)
-	ip.logger.Printf("Successfully processed image %s in %v", key, duration)
+	// Upload provenance sidecar
+	if ip.provenance != nil {
+		record := ip.newProvenanceRecord(out, targetKey)
+		if err := ip.uploadProvenance(ctx, record); err != nil {
+			return err
+		}
+	}
+	ip.report.addOutput(targetKey)
+
 	return nil
 }
 
-// addWatermark adds watermarks to the given image
-func (ip *ImageProcessor) addWatermark(img image.Image) (image.Image, error) {
+// encodeImage encodes the processed image in the output format and
+// re-inserts the source metadata that isn't configured to be stripped, after
+// applying the EXIF scrubbing policy
+func (ip *ImageProcessor) encodeImage(key string, img image.Image, meta *imageMetadata) ([]byte, error) {
+	var encoded []byte
+	if ip.outputFormat == FormatWebP {
+		var err error
+		if encoded, err = encodeWebP(img, ip.lossless, ip.quality); err != nil {
+			return nil, err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(ip.quality)); err != nil {
+			return nil, err
+		}
+		encoded = buf.Bytes()
+	}
+
+	return ip.embedMetadata(key, encoded, ip.outputFormat, meta)
+}
+
+// embedMetadata applies the EXIF scrubbing policy and rights fields to the
+// source metadata and embeds it into an encoded output
+func (ip *ImageProcessor) embedMetadata(key string, encoded []byte, format string, meta *imageMetadata) ([]byte, error) {
+	hadGPS := meta.exif != nil && meta.exif.hasGPS()
+	hadPersonal := (meta.exif != nil && meta.exif.hasPersonal()) || (meta.xmp != nil && xmpHasPersonal(meta.xmp))
+	meta.strip(ip.stripMetadata)
+	if meta.exif != nil {
+		if meta.upright {
+			meta.exif.SetOrientation(1)
+		}
+		if removed := ip.exifPolicy.apply(meta.exif); removed > 0 {
+			ip.logger.Printf("Removed %d EXIF tags from %s", removed, key)
+		}
+	}
+	if meta.xmp != nil && xmpHasGPS(meta.xmp) && !ip.exifPolicy.keeps("gps", 0x0002) {
+		// XMP can't be scrubbed tag by tag, so drop it rather than leak the position
+		ip.logger.Printf("Removed XMP packet containing GPS data from %s", key)
+		meta.xmp = nil
+	}
+	if meta.xmp != nil {
+		if personal := ip.exifPolicy.xmpPersonal(meta.xmp); len(personal) > 0 {
+			ip.logger.Printf("Removed XMP packet containing %s from %s", strings.Join(personal, ", "), key)
+			meta.xmp = nil
+		}
+	}
+	if hadGPS {
+		ip.report.addGPS(key, meta.exif == nil || !meta.exif.hasGPS())
+	}
+	if hadPersonal {
+		ip.report.addPersonal(key, (meta.exif == nil || !meta.exif.hasPersonal()) && (meta.xmp == nil || !xmpHasPersonal(meta.xmp)))
+	}
+	meta.xmp = meta.rights.apply(meta.xmp)
+	switch format {
+	case FormatWebP:
+		return embedWebPMetadata(encoded, meta)
+	case FormatGIF:
+		// GIF has no standard place for EXIF or ICC profiles
+		return encoded, nil
+	default:
+		return embedJPEGMetadata(encoded, meta)
+	}
+}
+
+// imageTemplateVars collects the text template variables for an image from
+// its key, user metadata, tags and EXIF fields
+func (ip *ImageProcessor) imageTemplateVars(ctx context.Context, key string, metadata, exifFields map[string]string) templateVars {
+	var tags map[string]string
+	templates := ip.textTemplate + ip.hiddenPayload + ip.rights.templates()
+	if ip.qr != nil {
+		templates += ip.qr.template
+	}
+	if templateUsesTags(templates) {
+		var err error
+		if tags, err = ip.objectTags(ctx, key); err != nil {
+			ip.logger.Printf("WARNING: Failed to get tags for %s: %v", key, err)
+		}
+	}
+
+	vars := newTemplateVars(ip.sourceBucket, key, ip.runTime, metadata, tags, exifFields)
+	if ip.recipient != nil {
+		ip.recipient.addTo(vars)
+	}
+	return vars
+}
+
+// decodeImage decodes an image and rotates or flips it upright according to
+// its EXIF orientation, so watermarks land on the edges viewers see
+func decodeImage(data []byte) (image.Image, error) {
+	if pages := tiffIFDs(data); len(pages) > 0 {
+		return decodeTIFFPage(data, pages[0])
+	}
+	// imaging only reads the orientation of JPEG files
+	if _, err := jpegSegments(data); err == nil {
+		return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	}
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(img, exifOrientation(data)), nil
+}
+
+// addWatermark adds watermarks to the given image, along with the rendered
+// text watermark when text is not empty and a QR code when qrURL is not empty
+func (ip *ImageProcessor) addWatermark(img image.Image, text, qrURL string) (image.Image, error) {
 	ip.logger.Printf("Adding watermarks to image")
 	ip.logger.Printf("Original image dimensions: %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
 
 	// Convert to RGBA if it's not already
 	watermarked := imaging.Clone(img)
-	imgWidth := watermarked.Bounds().Dx()
-	imgHeight := watermarked.Bounds().Dy()
+	if ip.unmarked {
+		ip.logger.Printf("Profile %s draws no visible watermarks", ip.profile)
+		return watermarked, nil
+	}
+
+	var err error
+	switch {
+	case ip.mode == ModeTiled:
+		watermarked, err = ip.addTiledWatermark(watermarked, text)
+	case ip.caption != nil:
+		return ip.addCaptionBar(watermarked, text, qrURL)
+	default:
+		watermarked, err = ip.drawWatermarks(watermarked, ip.planWatermarks(watermarked, text != ""), text)
+	}
+	if err != nil || qrURL == "" {
+		return watermarked, err
+	}
+	return ip.drawQRCode(watermarked, qrURL)
+}
+
+// watermarkLayout is where each watermark goes and which variant is drawn
+type watermarkLayout struct {
+	leftAnchor     anchor
+	rightAnchor    anchor
+	leftWatermark  image.Image
+	rightWatermark image.Image
+}
 
-	// Create copies of watermarks for resizing
-	leftWatermark := ip.leftWatermark
-	rightWatermark := ip.rightWatermark
+// planWatermarks decides the position and variant of each watermark for an
+// image, so frames of an animation can share one layout
+func (ip *ImageProcessor) planWatermarks(img *image.NRGBA, hasText bool) watermarkLayout {
+	// Decide where each watermark goes
+	leftAnchor, rightAnchor := ip.placeWatermarks(img, hasText)
+
+	// Pick the variant of each watermark with the best contrast
+	leftWatermark := ip.selectVariant("left", img, ip.leftWatermark, ip.leftDark,
+		cornerRegion("left", leftAnchor, img.Bounds(), ip.leftWatermark))
+	rightWatermark := ip.selectVariant("right", img, ip.rightWatermark, ip.rightDark,
+		cornerRegion("right", rightAnchor, img.Bounds(), ip.rightWatermark))
 	
 	if leftWatermark.Bounds().Dy() > MaxWatermarkHeight {
 		leftWatermark = imaging.Resize(leftWatermark, 0, MaxWatermarkHeight, imaging.Lanczos)
@@ -334,24 +1128,50 @@ func (ip *ImageProcessor) addWatermark(img image.Image) (image.Image, error) {
 		rightWatermark = imaging.Resize(rightWatermark, 0, MaxWatermarkHeight, imaging.Lanczos)
 		ip.logger.Printf("Resized right watermark to height: %d", MaxWatermarkHeight)
 	}
-	
-	// Calculate positions for watermarks
-	leftX := WatermarkPadding
-	rightX := imgWidth - rightWatermark.Bounds().Dx() - WatermarkPadding
-	y := imgHeight - MaxWatermarkHeight - WatermarkPadding
-	
+
+	return watermarkLayout{
+		leftAnchor:     leftAnchor,
+		rightAnchor:    rightAnchor,
+		leftWatermark:  leftWatermark,
+		rightWatermark: rightWatermark,
+	}
+}
+
+// drawWatermarks draws the watermarks of a layout and the text watermark
+func (ip *ImageProcessor) drawWatermarks(watermarked *image.NRGBA, layout watermarkLayout, text string) (*image.NRGBA, error) {
 	// Add left watermark
-	watermarked = imaging.Overlay(watermarked, leftWatermark, image.Pt(leftX, y), 1.0)
+	watermarked = imaging.Overlay(watermarked, layout.leftWatermark,
+		watermarkPoint("left", layout.leftAnchor, watermarked.Bounds(), layout.leftWatermark.Bounds().Size()), ip.watermarkOpacity())
 	
 	// Add right watermark
-	watermarked = imaging.Overlay(watermarked, rightWatermark, image.Pt(rightX, y), 1.0)
+	watermarked = imaging.Overlay(watermarked, layout.rightWatermark,
+		watermarkPoint("right", layout.rightAnchor, watermarked.Bounds(), layout.rightWatermark.Bounds().Size()), ip.watermarkOpacity())
+
+	// Add text watermark
+	if text != "" {
+		var err error
+		if watermarked, err = ip.addTextWatermark(watermarked, text); err != nil {
+			return nil, err
+		}
+	}
 
 	ip.logger.Printf("Watermarks added successfully")
 	return watermarked, nil
 }
 
+// addTextWatermark renders text and places it at the configured anchor
+func (ip *ImageProcessor) addTextWatermark(img *image.NRGBA, text string) (*image.NRGBA, error) {
+	textImg, err := renderText(ip.textFont, ip.textSize, text, ip.textColor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render text watermark: %v", err)
+	}
+	pt := anchorPoint(ip.textPosition, img.Bounds(), textImg.Bounds().Size(), WatermarkPadding)
+	ip.logger.Printf("Added text watermark at %s", ip.textPosition)
+	return imaging.Overlay(img, textImg, pt, ip.watermarkOpacity()), nil
+}
+
 // uploadImage uploads the processed image to S3
-func (ip *ImageProcessor) uploadImage(ctx context.Context, filepath, targetKey string) error {
+func (ip *ImageProcessor) uploadImage(ctx context.Context, filepath, targetKey, contentType string) error {
 	ip.logger.Printf("Starting upload of file %s to S3 key: %s", filepath, targetKey)
 	
 	file, err := os.Open(filepath)
@@ -362,9 +1182,23 @@ func (ip *ImageProcessor) uploadImage(ctx context.Context, filepath, targetKey s
 	defer file.Close()
 
 	putInput := &s3.PutObjectInput{
-		Bucket: &ip.sourceBucket,
-		Key:    &targetKey,
-		Body:   file,
+		Bucket:      &ip.sourceBucket,
+		Key:         &targetKey,
+		Body:        file,
+		ContentType: &contentType,
+	}
+
+	// Sign the exact bytes that are uploaded
+	if ip.signer != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("failed to read file for signing: %v", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind file: %v", err)
+		}
+		putInput.Metadata = ip.signer.metadata(data)
+		ip.logger.Printf("Signed %s with key %s", targetKey, ip.signer.keyID)
 	}
 
 	startTime := time.Now()
@@ -379,16 +1213,41 @@ func (ip *ImageProcessor) uploadImage(ctx context.Context, filepath, targetKey s
 	return nil
 }
 
-// isImageFile checks if the file is an image based on extension
+// isImageFile checks if the file is an image based on extension. Formats
+// that need an external decoder only count once one is configured.
 func isImageFile(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+	for _, f := range imageFormats {
+		if f.name == formatFromExtension(filename) {
+			return f.builtin
+		}
+	}
+	return false
 }
 
 func main() {
 	logger := log.New(os.Stdout, "[S3-WATERMARK] ", log.LstdFlags|log.Lshortfile)
 	logger.Printf("Starting S3 Watermark Script")
 
+	ctx := context.Background()
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "verify":
+			err = runVerify(ctx, logger, os.Args[2:])
+		case "verify-signature":
+			err = runVerifySignature(ctx, logger, os.Args[2:])
+		case "explain":
+			err = runExplain(ctx, logger, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q, available commands: verify, verify-signature, explain", os.Args[1])
+		}
+		if err != nil {
+			logger.Printf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := validateEnvironment(); err != nil {
 		logger.Printf("Environment validation failed: %v\nRequired environment variables:\n"+
 			"  %s: S3 bucket name\n"+
@@ -400,14 +1259,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
 	processor, err := NewImageProcessor(ctx, logger)
 	if err != nil {
 		logger.Printf("Failed to initialize image processor: %v", err)
 		os.Exit(1)
 	}
 
-	if err := processor.ProcessImages(ctx); err != nil {
+	run := processor.ProcessImages
+	if len(processor.recipients) > 0 {
+		run = processor.ProcessDeliveries
+	}
+	if err := run(ctx); err != nil {
 		logger.Printf("Failed to process images: %v", err)
 		os.Exit(1)
 	}
@@ -304,6 +304,36 @@ func TestNewImageProcessor(t *testing.T) {
 	}
 }
 
+func TestDecodeImageOrientation(t *testing.T) {
+	tests := []struct {
+		name        string
+		orientation byte
+		wantWidth   int
+		wantHeight  int
+	}{
+		{"Normal", 1, 64, 32},
+		{"Rotated 90 CW", 6, 32, 64},
+		{"Rotated 90 CCW", 8, 32, 64},
+		{"Upside down", 3, 64, 32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exif := buildTestEXIF([]testIFDEntry{{tag: 0x0112, typ: 3, count: 1, value: []byte{tt.orientation, 0}}}, nil)
+			data := buildTestJPEG(t, image.NewRGBA(image.Rect(0, 0, 64, 32)), exif)
+
+			img, err := decodeImage(data)
+			if err != nil {
+				t.Fatalf("decodeImage() error = %v", err)
+			}
+			if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+				t.Errorf("decodeImage() dimensions = %dx%d, want %dx%d",
+					img.Bounds().Dx(), img.Bounds().Dy(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
 func TestAddWatermark(t *testing.T) {
 	// Create test watermark files
 	leftWatermark := createTestPNG(t, 100, 50, "left")
@@ -357,7 +387,7 @@ func TestAddWatermark(t *testing.T) {
 				}
 			}
 
-			result, err := processor.addWatermark(img)
+			result, err := processor.addWatermark(img, "", "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("addWatermark() error = %v, wantErr %v", err, tt.wantErr)
 				return
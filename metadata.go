@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Metadata groups preserved from source images
+const (
+	MetadataEXIF = "exif"
+	MetadataXMP  = "xmp"
+	MetadataICC  = "icc"
+)
+
+// Segment signatures used to embed metadata in JPEG files
+var (
+	jpegEXIFHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// pngXMPKeyword is the iTXt keyword under which PNG files store XMP
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// maxJPEGSegment is the largest payload a single JPEG marker segment can hold
+const maxJPEGSegment = 65533
+
+// imageMetadata holds the metadata carried over from a source image
+type imageMetadata struct {
+	exif    *exifData
+	xmp     []byte
+	icc     []byte
+	rights  xmpRights // Rendered rights fields merged into the XMP on output
+	upright bool      // The pixels were rotated by the EXIF orientation, so the tag is reset
+}
+
+// clone returns a copy that can be scrubbed without changing m
+func (m *imageMetadata) clone() *imageMetadata {
+	c := *m
+	if m.exif != nil {
+		exif := *m.exif
+		c.exif = &exif
+	}
+	return &c
+}
+
+// parseStripMetadata parses a comma separated list of metadata groups
+func parseStripMetadata(value string) (map[string]bool, error) {
+	groups := make(map[string]bool)
+	for _, group := range strings.Split(value, ",") {
+		group = strings.ToLower(strings.TrimSpace(group))
+		switch group {
+		case "":
+		case MetadataEXIF, MetadataXMP, MetadataICC:
+			groups[group] = true
+		default:
+			return nil, fmt.Errorf("invalid metadata group in %s: %s", EnvStripMetadata, group)
+		}
+	}
+	return groups, nil
+}
+
+// validateMetadataSettings checks the optional metadata settings
+func validateMetadataSettings() error {
+	_, err := parseStripMetadata(os.Getenv(EnvStripMetadata))
+	return err
+}
+
+// extractMetadata reads the EXIF, XMP and ICC profile embedded in a JPEG,
+// PNG, WebP or TIFF file. Files in other formats yield empty metadata.
+func extractMetadata(data []byte) (*imageMetadata, error) {
+	if isTIFF(data) {
+		return extractTIFFMetadata(data)
+	}
+
+	meta := &imageMetadata{}
+
+	if raw := extractEXIF(data); raw != nil {
+		ex, err := parseEXIF(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EXIF data: %v", err)
+		}
+		meta.exif = ex
+	}
+
+	if segments, err := jpegSegments(data); err == nil {
+		iccChunks := make(map[int][]byte)
+		for _, seg := range segments {
+			switch {
+			case seg.Marker == 0xE1 && bytes.HasPrefix(seg.Data, jpegXMPHeader):
+				meta.xmp = seg.Data[len(jpegXMPHeader):]
+			case seg.Marker == 0xE2 && bytes.HasPrefix(seg.Data, jpegICCHeader) && len(seg.Data) > len(jpegICCHeader)+2:
+				// ICC profiles are split across segments numbered from 1
+				seq := int(seg.Data[len(jpegICCHeader)])
+				iccChunks[seq] = seg.Data[len(jpegICCHeader)+2:]
+			}
+		}
+		meta.icc = joinICCChunks(iccChunks)
+		return meta, nil
+	}
+
+	if chunks, err := pngChunks(data); err == nil {
+		for _, chunk := range chunks {
+			switch chunk.Type {
+			case "iTXt":
+				if xmp, ok := parsePNGXMP(chunk.Data); ok {
+					meta.xmp = xmp
+				}
+			case "iCCP":
+				icc, err := parsePNGICC(chunk.Data)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read ICC profile: %v", err)
+				}
+				meta.icc = icc
+			}
+		}
+		return meta, nil
+	}
+
+	if chunks, err := webpChunks(data); err == nil {
+		for _, chunk := range chunks {
+			switch chunk.FourCC {
+			case "XMP ":
+				meta.xmp = chunk.Data
+			case "ICCP":
+				meta.icc = chunk.Data
+			}
+		}
+	}
+	return meta, nil
+}
+
+// joinICCChunks reassembles an ICC profile from numbered JPEG segments
+func joinICCChunks(chunks map[int][]byte) []byte {
+	if len(chunks) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	var icc []byte
+	for _, seq := range seqs {
+		icc = append(icc, chunks[seq]...)
+	}
+	return icc
+}
+
+// parsePNGXMP returns the XMP packet from a PNG iTXt chunk
+func parsePNGXMP(data []byte) ([]byte, bool) {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+
+	// Skip the language tag and translated keyword
+	for i := 0; i < 2; i++ {
+		if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+			return nil, false
+		}
+	}
+
+	if !compressed {
+		return rest, true
+	}
+	text, err := inflate(rest)
+	if err != nil {
+		return nil, false
+	}
+	return text, true
+}
+
+// parsePNGICC returns the ICC profile from a PNG iCCP chunk
+func parsePNGICC(data []byte) ([]byte, error) {
+	_, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || len(rest) < 1 {
+		return nil, fmt.Errorf("invalid iCCP chunk")
+	}
+	return inflate(rest[1:])
+}
+
+// inflate decompresses zlib data
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// strip removes the given metadata groups
+func (m *imageMetadata) strip(groups map[string]bool) {
+	if groups[MetadataEXIF] {
+		m.exif = nil
+	}
+	if groups[MetadataXMP] {
+		m.xmp = nil
+	}
+	if groups[MetadataICC] {
+		m.icc = nil
+	}
+}
+
+// embedJPEGMetadata inserts metadata segments right after the SOI marker of
+// an encoded JPEG, in the order EXIF, XMP, ICC profile
+func embedJPEGMetadata(data []byte, m *imageMetadata) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	var segments []byte
+	if m.exif != nil {
+		payload := append(append([]byte{}, jpegEXIFHeader...), m.exif.Encode()...)
+		if len(payload) > maxJPEGSegment {
+			return nil, fmt.Errorf("EXIF data too large for a JPEG segment: %d bytes", len(payload))
+		}
+		segments = appendJPEGSegment(segments, 0xE1, payload)
+	}
+	if m.xmp != nil {
+		payload := append(append([]byte{}, jpegXMPHeader...), m.xmp...)
+		if len(payload) > maxJPEGSegment {
+			return nil, fmt.Errorf("XMP packet too large for a JPEG segment: %d bytes", len(payload))
+		}
+		segments = appendJPEGSegment(segments, 0xE1, payload)
+	}
+	if m.icc != nil {
+		chunkSize := maxJPEGSegment - len(jpegICCHeader) - 2
+		count := (len(m.icc) + chunkSize - 1) / chunkSize
+		if count > 255 {
+			return nil, fmt.Errorf("ICC profile too large: %d bytes", len(m.icc))
+		}
+		for i := 0; i < count; i++ {
+			chunk := m.icc[i*chunkSize : min(len(m.icc), (i+1)*chunkSize)]
+			payload := append(append([]byte{}, jpegICCHeader...), byte(i+1), byte(count))
+			segments = appendJPEGSegment(segments, 0xE2, append(payload, chunk...))
+		}
+	}
+
+	out := make([]byte, 0, len(data)+len(segments))
+	out = append(out, data[:2]...)
+	out = append(out, segments...)
+	return append(out, data[2:]...), nil
+}
+
+// appendJPEGSegment appends a marker segment to buf
+func appendJPEGSegment(buf []byte, marker byte, payload []byte) []byte {
+	buf = append(buf, 0xFF, marker)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)+2))
+	return append(buf, payload...)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"testing"
+)
+
+// insertPNGChunks inserts chunks right after the IHDR chunk of a PNG file
+func insertPNGChunks(t *testing.T, data []byte, chunks ...pngChunk) []byte {
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if string(data[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		t.Fatalf("PNG does not start with IHDR")
+	}
+
+	out := append([]byte{}, data[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(c.Data)))
+		typeAndData := append([]byte(c.Type), c.Data...)
+		out = append(out, typeAndData...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(typeAndData))
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+// deflate compresses data with zlib
+func deflate(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// testICCProfile returns fake ICC profile bytes large enough to span
+// several JPEG segments
+func testICCProfile() []byte {
+	icc := make([]byte, 150000)
+	for i := range icc {
+		icc[i] = byte(i % 251)
+	}
+	return icc
+}
+
+func TestEXIFEncodeRoundTrip(t *testing.T) {
+	raw := buildTestEXIF(
+		[]testIFDEntry{
+			{tag: 0x013B, typ: 2, count: 11, value: asciiValue("Jane Smith")},
+			{tag: exifTagOrientation, typ: 3, count: 1, value: []byte{6, 0}},
+		},
+		[]testIFDEntry{
+			{tag: 0x9003, typ: 2, count: 20, value: asciiValue("2024:05:01 12:30:00")},
+		},
+	)
+	ex, err := parseEXIF(raw)
+	if err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+	ex.SetOrientation(1)
+
+	decoded, err := parseEXIF(ex.Encode())
+	if err != nil {
+		t.Fatalf("parseEXIF() of encoded data error = %v", err)
+	}
+	fields := decoded.Fields()
+	want := map[string]string{
+		"Artist":           "Jane Smith",
+		"Orientation":      "1",
+		"DateTimeOriginal": "2024:05:01 12:30:00",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("Fields()[%s] = %q, want %q", name, fields[name], value)
+		}
+	}
+}
+
+func TestJPEGMetadataRoundTrip(t *testing.T) {
+	exif := buildTestEXIF([]testIFDEntry{{tag: 0x013B, typ: 2, count: 11, value: asciiValue("Jane Smith")}}, nil)
+	source := &imageMetadata{
+		xmp: []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`),
+		icc: testICCProfile(),
+	}
+	var err error
+	if source.exif, err = parseEXIF(exif); err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	embedded, err := embedJPEGMetadata(buf.Bytes(), source)
+	if err != nil {
+		t.Fatalf("embedJPEGMetadata() error = %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(embedded)); err != nil {
+		t.Fatalf("Output with metadata is not a valid JPEG: %v", err)
+	}
+
+	meta, err := extractMetadata(embedded)
+	if err != nil {
+		t.Fatalf("extractMetadata() error = %v", err)
+	}
+	if meta.exif == nil || meta.exif.Fields()["Artist"] != "Jane Smith" {
+		t.Errorf("extractMetadata() did not preserve EXIF")
+	}
+	if !bytes.Equal(meta.xmp, source.xmp) {
+		t.Errorf("extractMetadata() xmp = %q, want %q", meta.xmp, source.xmp)
+	}
+	if !bytes.Equal(meta.icc, source.icc) {
+		t.Errorf("extractMetadata() did not preserve the ICC profile (%d bytes, want %d)", len(meta.icc), len(source.icc))
+	}
+}
+
+func TestExtractPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+
+	exif := buildTestEXIF([]testIFDEntry{{tag: 0x8298, typ: 2, count: 9, value: asciiValue("(c) Acme")}}, nil)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)
+	icc := []byte("fake icc profile")
+	data := insertPNGChunks(t, buf.Bytes(),
+		pngChunk{Type: "eXIf", Data: exif},
+		pngChunk{Type: "iTXt", Data: append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), xmp...)},
+		pngChunk{Type: "iCCP", Data: append([]byte("sRGB\x00\x00"), deflate(t, icc)...)},
+	)
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Test PNG is invalid: %v", err)
+	}
+
+	meta, err := extractMetadata(data)
+	if err != nil {
+		t.Fatalf("extractMetadata() error = %v", err)
+	}
+	if meta.exif == nil || meta.exif.Fields()["Copyright"] != "(c) Acme" {
+		t.Errorf("extractMetadata() did not read EXIF")
+	}
+	if !bytes.Equal(meta.xmp, xmp) {
+		t.Errorf("extractMetadata() xmp = %q, want %q", meta.xmp, xmp)
+	}
+	if !bytes.Equal(meta.icc, icc) {
+		t.Errorf("extractMetadata() icc = %q, want %q", meta.icc, icc)
+	}
+}
+
+func TestPNGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 32))); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	exif := buildTestEXIF([]testIFDEntry{{tag: 0x0112, typ: 3, count: 1, value: []byte{6, 0}}}, nil)
+	data := insertPNGChunks(t, buf.Bytes(), pngChunk{Type: "eXIf", Data: exif})
+
+	img, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("decodeImage() error = %v", err)
+	}
+	if img.Bounds().Dx() != 32 || img.Bounds().Dy() != 64 {
+		t.Fatalf("decodeImage() dimensions = %dx%d, want 32x64", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	ip := &ImageProcessor{exifPolicy: &exifPolicy{}, logger: log.New(io.Discard, "", 0)}
+	for _, upright := range []bool{true, false} {
+		meta, err := extractMetadata(data)
+		if err != nil {
+			t.Fatalf("extractMetadata() error = %v", err)
+		}
+		meta.upright = upright
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, img, nil); err != nil {
+			t.Fatalf("Failed to encode output: %v", err)
+		}
+		embedded, err := ip.embedMetadata("photo.png", out.Bytes(), FormatJPEG, meta)
+		if err != nil {
+			t.Fatalf("embedMetadata() error = %v", err)
+		}
+
+		// The output is upright, and only tagged normal once it was rotated
+		decoded, err := jpeg.Decode(bytes.NewReader(embedded))
+		if err != nil {
+			t.Fatalf("Output is not a valid JPEG: %v", err)
+		}
+		if decoded.Bounds().Dx() != 32 || decoded.Bounds().Dy() != 64 {
+			t.Errorf("output dimensions = %dx%d, want 32x64", decoded.Bounds().Dx(), decoded.Bounds().Dy())
+		}
+		want := 6
+		if upright {
+			want = 1
+		}
+		if got := exifOrientation(embedded); got != want {
+			t.Errorf("output orientation with upright %v = %d, want %d", upright, got, want)
+		}
+	}
+}
+
+func TestParseStripMetadata(t *testing.T) {
+	groups, err := parseStripMetadata("exif, ICC")
+	if err != nil {
+		t.Fatalf("parseStripMetadata() error = %v", err)
+	}
+	if !groups[MetadataEXIF] || !groups[MetadataICC] || groups[MetadataXMP] {
+		t.Errorf("parseStripMetadata() = %v", groups)
+	}
+
+	meta := &imageMetadata{exif: &exifData{}, xmp: []byte("x"), icc: []byte("i")}
+	meta.strip(groups)
+	if meta.exif != nil || meta.icc != nil || meta.xmp == nil {
+		t.Errorf("strip() left %+v", meta)
+	}
+
+	if _, err := parseStripMetadata("exif,iptc"); err == nil {
+		t.Error("parseStripMetadata() expected error for unknown group")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Output formats
+const (
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+	FormatGIF  = "gif"
+)
+
+// Default encoder quality per output format
+const (
+	DefaultJPEGQuality = 95
+	DefaultWebPQuality = 80
+)
+
+// validateOutputSettings checks the optional output format settings
+func validateOutputSettings() error {
+	switch v := os.Getenv(EnvOutputFormat); v {
+	case "", FormatJPEG:
+	case FormatWebP:
+		if err := checkWebPEncoder(EnvOutputFormat); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid %s: %s (must be %s or %s)", EnvOutputFormat, v, FormatJPEG, FormatWebP)
+	}
+	if v := os.Getenv(EnvOutputQuality); v != "" {
+		if quality, err := strconv.Atoi(v); err != nil || quality < 1 || quality > 100 {
+			return fmt.Errorf("%s must be a number between 1 and 100: %s", EnvOutputQuality, v)
+		}
+	}
+	switch v := os.Getenv(EnvAnimationFormat); v {
+	case "", FormatGIF:
+	case FormatWebP:
+		if err := checkWebPEncoder(EnvAnimationFormat); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid %s: %s (must be %s or %s)", EnvAnimationFormat, v, FormatGIF, FormatWebP)
+	}
+	if v := os.Getenv(EnvWebPLossless); v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%s must be true or false: %s", EnvWebPLossless, v)
+		}
+	}
+	return nil
+}
+
+// outputKey returns the target key with the extension of the output format.
+// JPEG outputs keep the source key unless it names a format browsers can't
+// display, such as a TIFF master.
+func (ip *ImageProcessor) outputKey(targetKey, format string) string {
+	ext := "." + format
+	if format == FormatJPEG {
+		if source := formatFromExtension(targetKey); source == "" || isWebFormat(source) {
+			return targetKey
+		}
+		ext = ".jpg"
+	}
+	return strings.TrimSuffix(targetKey, path.Ext(targetKey)) + ext
+}
+
+// outputContentType returns the MIME type of an output format
+func outputContentType(format string) string {
+	return "image/" + format
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Sources of per-image overrides
+const (
+	OverridesTags    = "tags"    // S3 object tags such as watermark-position=top-left
+	OverridesSidecar = "sidecar" // A <key>.watermark.json object next to the image
+)
+
+// overrideSuffix is appended to an image key to find its override sidecar
+const overrideSuffix = ".watermark.json"
+
+// Override names, shared by tags and sidecars
+const (
+	OverrideWatermark     = "watermark"                // "skip" leaves the image unprocessed
+	OverridePosition      = "watermark-position"       // Corner of the left logo, the right logo takes the mirrored corner
+	OverrideLeftPosition  = "watermark-left-position"  // Anchor of the left logo
+	OverrideRightPosition = "watermark-right-position" // Anchor of the right logo
+	OverrideTextPosition  = "watermark-text-position"  // Anchor of the text watermark
+	OverrideOpacity       = "watermark-opacity"        // Opacity of logos, text and tiles between 0 and 1
+)
+
+// Values of the watermark override
+const (
+	WatermarkApply = "apply"
+	WatermarkSkip  = "skip"
+	WatermarkNone  = "none" // Rule profiles only: processes the image without visible watermarks
+)
+
+// mirroredCorners maps each corner to the corner across the image width
+var mirroredCorners = map[anchor]anchor{
+	anchorTopLeft:     anchorTopRight,
+	anchorTopRight:    anchorTopLeft,
+	anchorBottomLeft:  anchorBottomRight,
+	anchorBottomRight: anchorBottomLeft,
+}
+
+// overrideSources parses the WATERMARK_OVERRIDES list of sources
+func overrideSources() (map[string]bool, error) {
+	sources := make(map[string]bool)
+	for _, source := range strings.Split(os.Getenv(EnvWatermarkOverrides), ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		switch source {
+		case "":
+		case OverridesTags, OverridesSidecar:
+			sources[source] = true
+		default:
+			return nil, fmt.Errorf("invalid %s source: %s (must be %s or %s)", EnvWatermarkOverrides, source, OverridesTags, OverridesSidecar)
+		}
+	}
+	return sources, nil
+}
+
+// validateOverrideSettings checks the optional per-image override settings
+func validateOverrideSettings() error {
+	_, err := overrideSources()
+	return err
+}
+
+// watermarkOverrides are the per-image settings, by override name
+type watermarkOverrides map[string]string
+
+// parseOverrideSidecar parses a JSON object of override names and values.
+// Numbers are accepted for opacity, and unknown names are rejected so a
+// misspelled override isn't silently ignored.
+func parseOverrideSidecar(data []byte) (watermarkOverrides, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the sidecar object")
+	}
+
+	overrides := make(watermarkOverrides, len(fields))
+	for name, value := range fields {
+		if !isOverrideName(name) {
+			return nil, fmt.Errorf("unknown override %s", name)
+		}
+		switch v := value.(type) {
+		case string:
+			overrides[name] = v
+		case json.Number:
+			overrides[name] = v.String()
+		default:
+			return nil, fmt.Errorf("override %s must be a string or a number", name)
+		}
+	}
+	return overrides, overrides.check()
+}
+
+// isOverrideName reports whether name is a known override
+func isOverrideName(name string) bool {
+	switch name {
+	case OverrideWatermark, OverridePosition, OverrideLeftPosition, OverrideRightPosition, OverrideTextPosition, OverrideOpacity:
+		return true
+	}
+	return false
+}
+
+// check validates the override values
+func (o watermarkOverrides) check() error {
+	for name, value := range o {
+		var err error
+		switch name {
+		case OverrideWatermark:
+			if value != WatermarkApply && value != WatermarkSkip {
+				err = fmt.Errorf("must be %s or %s", WatermarkApply, WatermarkSkip)
+			}
+		case OverridePosition:
+			var a anchor
+			if a, err = parseAnchor(value); err == nil && mirroredCorners[a] == "" {
+				err = fmt.Errorf("must be a corner, such as top-left")
+			}
+		case OverrideLeftPosition, OverrideRightPosition, OverrideTextPosition:
+			_, err = parseAnchor(value)
+		case OverrideOpacity:
+			if opacity, perr := strconv.ParseFloat(value, 64); perr != nil || opacity <= 0 || opacity > 1 {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// String formats the overrides as sorted name=value pairs for logs
+func (o watermarkOverrides) String() string {
+	pairs := make([]string, 0, len(o))
+	for name, value := range o {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// objectTags returns the S3 tags of a source object
+func (ip *ImageProcessor) objectTags(ctx context.Context, key string) (map[string]string, error) {
+	return fetchObjectTags(ctx, ip.s3Client, ip.sourceBucket, key)
+}
+
+// fetchObjectTags returns the S3 tags of an object
+func fetchObjectTags(ctx context.Context, client *s3.Client, bucket, key string) (map[string]string, error) {
+	tagging, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(tagging.TagSet))
+	for _, tag := range tagging.TagSet {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags, nil
+}
+
+// loadOverrides reads the overrides of an image from its tags and sidecar,
+// where the sidecar wins. Tags that aren't overrides are ignored. Since an
+// override may skip the image, any failure to read them is an error.
+func (ip *ImageProcessor) loadOverrides(ctx context.Context, key string) (watermarkOverrides, error) {
+	overrides := make(watermarkOverrides)
+	if ip.overrideFrom[OverridesTags] {
+		tags, err := ip.objectTags(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tags for %s: %v", key, err)
+		}
+		for name, value := range tags {
+			if isOverrideName(name) {
+				overrides[name] = value
+			}
+		}
+		if err := overrides.check(); err != nil {
+			return nil, fmt.Errorf("invalid override tag on %s: %v", key, err)
+		}
+	}
+
+	if ip.overrideFrom[OverridesSidecar] {
+		sidecarKey := key + overrideSuffix
+		result, err := ip.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &ip.sourceBucket,
+			Key:    &sidecarKey,
+		})
+		var missing *types.NoSuchKey
+		switch {
+		case errors.As(err, &missing):
+		case err != nil:
+			return nil, fmt.Errorf("failed to get override sidecar %s: %v", sidecarKey, err)
+		default:
+			data, err := io.ReadAll(result.Body)
+			result.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read override sidecar %s: %v", sidecarKey, err)
+			}
+			sidecar, err := parseOverrideSidecar(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid override sidecar %s: %v", sidecarKey, err)
+			}
+			for name, value := range sidecar {
+				overrides[name] = value
+			}
+		}
+	}
+	return overrides, nil
+}
+
+// withOverrides returns a copy of the processor with the overrides of one
+// image applied. Values have already been checked.
+func (ip *ImageProcessor) withOverrides(o watermarkOverrides) *ImageProcessor {
+	overridden := *ip
+	overridden.overridden = o
+	if v, ok := o[OverridePosition]; ok {
+		corner, _ := parseAnchor(v)
+		overridden.leftPosition = corner
+		overridden.rightPosition = mirroredCorners[corner]
+	}
+	if v, ok := o[OverrideLeftPosition]; ok {
+		overridden.leftPosition, _ = parseAnchor(v)
+	}
+	if v, ok := o[OverrideRightPosition]; ok {
+		overridden.rightPosition, _ = parseAnchor(v)
+	}
+	if v, ok := o[OverrideTextPosition]; ok {
+		overridden.textPosition, _ = parseAnchor(v)
+	}
+	if v, ok := o[OverrideOpacity]; ok {
+		overridden.opacity, _ = strconv.ParseFloat(v, 64)
+		overridden.tileOpacity = overridden.opacity
+	}
+	return &overridden
+}
+
+// watermarkOpacity returns the opacity logos and text are drawn with. Unset
+// means opaque.
+func (ip *ImageProcessor) watermarkOpacity() float64 {
+	if ip.opacity == 0 {
+		return 1.0
+	}
+	return ip.opacity
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestOverrideSources(t *testing.T) {
+	t.Setenv(EnvWatermarkOverrides, "tags, sidecar")
+	sources, err := overrideSources()
+	if err != nil {
+		t.Fatalf("overrideSources() error = %v", err)
+	}
+	if !sources[OverridesTags] || !sources[OverridesSidecar] {
+		t.Errorf("overrideSources() = %v, want tags and sidecar", sources)
+	}
+
+	t.Setenv(EnvWatermarkOverrides, "tags,headers")
+	if _, err := overrideSources(); err == nil {
+		t.Errorf("overrideSources() with an unknown source expected error")
+	}
+}
+
+func TestParseOverrideSidecar(t *testing.T) {
+	overrides, err := parseOverrideSidecar([]byte(`{"watermark-position": "top-left", "watermark-opacity": 0.5}`))
+	if err != nil {
+		t.Fatalf("parseOverrideSidecar() error = %v", err)
+	}
+	if overrides[OverridePosition] != "top-left" || overrides[OverrideOpacity] != "0.5" {
+		t.Errorf("parseOverrideSidecar() = %v", overrides)
+	}
+
+	for name, data := range map[string]string{
+		"syntax":        `{"watermark": `,
+		"unknown":       `{"watermark-colour": "red"}`,
+		"type":          `{"watermark-opacity": true}`,
+		"watermark":     `{"watermark": "maybe"}`,
+		"position":      `{"watermark-position": "top-center"}`,
+		"text position": `{"watermark-text-position": "middle"}`,
+		"opacity":       `{"watermark-opacity": 1.5}`,
+		"trailing data": `{} {}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseOverrideSidecar([]byte(data)); err == nil {
+				t.Errorf("parseOverrideSidecar(%s) expected error", data)
+			}
+		})
+	}
+}
+
+func TestWithOverrides(t *testing.T) {
+	ip := &ImageProcessor{textPosition: anchorBottomCenter, tileOpacity: DefaultTileOpacity}
+	if got := ip.watermarkOpacity(); got != 1.0 {
+		t.Errorf("watermarkOpacity() without override = %v, want 1", got)
+	}
+
+	overridden := ip.withOverrides(watermarkOverrides{
+		OverridePosition:      "top-right",
+		OverrideTextPosition:  "top-center",
+		OverrideOpacity:       "0.4",
+		OverrideRightPosition: "center",
+	})
+	if overridden.leftPosition != anchorTopRight || overridden.rightPosition != anchorCenter {
+		t.Errorf("withOverrides() positions = %s, %s, want %s, %s", overridden.leftPosition, overridden.rightPosition, anchorTopRight, anchorCenter)
+	}
+	if overridden.textPosition != anchorTopCenter {
+		t.Errorf("withOverrides() text position = %s, want %s", overridden.textPosition, anchorTopCenter)
+	}
+	if overridden.watermarkOpacity() != 0.4 || overridden.tileOpacity != 0.4 {
+		t.Errorf("withOverrides() opacity = %v, tiles %v, want 0.4", overridden.watermarkOpacity(), overridden.tileOpacity)
+	}
+	if ip.leftPosition != "" || ip.textPosition != anchorBottomCenter || ip.opacity != 0 {
+		t.Errorf("withOverrides() changed the run settings")
+	}
+
+	// The mirrored corner of the shorthand
+	if o := ip.withOverrides(watermarkOverrides{OverridePosition: "bottom-left"}); o.rightPosition != anchorBottomRight {
+		t.Errorf("withOverrides() right position = %s, want %s", o.rightPosition, anchorBottomRight)
+	}
+}
+
+func TestPlaceWatermarksOverride(t *testing.T) {
+	ip := &ImageProcessor{
+		leftWatermark:  image.NewNRGBA(image.Rect(0, 0, 100, 50)),
+		rightWatermark: image.NewNRGBA(image.Rect(0, 0, 100, 50)),
+		placement:      PlacementAuto,
+		leftPosition:   anchorBottomLeft,
+		rightPosition:  anchorBottomRight,
+		logger:         log.New(io.Discard, "", 0),
+	}
+
+	// Overridden positions win even where automatic placement would move
+	// the logos away from the busy bottom half
+	img := noisyImage(800, 600, image.Rect(0, 300, 800, 600))
+	if left, right := ip.placeWatermarks(img, false); left != anchorBottomLeft || right != anchorBottomRight {
+		t.Errorf("placeWatermarks() = %s, %s, want %s, %s", left, right, anchorBottomLeft, anchorBottomRight)
+	}
+}
+
+func TestPlaceWatermarksSingleOverride(t *testing.T) {
+	logo := image.NewNRGBA(image.Rect(0, 0, 100, MaxWatermarkHeight))
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 600))
+	tests := []struct {
+		name                string
+		left, right         anchor
+		wantLeft, wantRight anchor
+	}{
+		{"left clear of the right corner", anchorTopLeft, "", anchorTopLeft, ""},
+		{"left onto the right corner", anchorBottomRight, "", anchorBottomRight, anchorBottomLeft},
+		{"right onto the left corner", "", anchorBottomLeft, anchorBottomRight, anchorBottomLeft},
+		{"left in the center", anchorCenter, "", anchorCenter, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &ImageProcessor{
+				leftWatermark:  logo,
+				rightWatermark: logo,
+				leftPosition:   tt.left,
+				rightPosition:  tt.right,
+				logger:         log.New(io.Discard, "", 0),
+			}
+			left, right := ip.placeWatermarks(img, false)
+			if left != tt.wantLeft || right != tt.wantRight {
+				t.Errorf("placeWatermarks() = %q, %q, want %q, %q", left, right, tt.wantLeft, tt.wantRight)
+			}
+			if cornerRegion("left", left, img.Bounds(), logo).Overlaps(cornerRegion("right", right, img.Bounds(), logo)) {
+				t.Errorf("placeWatermarks() put the logos on top of each other")
+			}
+		})
+	}
+}
+
+func TestOverrideOpacity(t *testing.T) {
+	white := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for i := range white.Pix {
+		white.Pix[i] = 255
+	}
+	ip := &ImageProcessor{
+		leftWatermark:  white,
+		rightWatermark: white,
+		logger:         log.New(io.Discard, "", 0),
+	}
+	img := solidImage(400, 400, color.Black)
+
+	overridden := ip.withOverrides(watermarkOverrides{OverrideOpacity: "0.5"})
+	watermarked, err := overridden.addWatermark(img, "", "")
+	if err != nil {
+		t.Fatalf("addWatermark() error = %v", err)
+	}
+	pt := cornerPoint("left", img.Bounds(), image.Pt(40, 40)).Add(image.Pt(20, 20))
+	if r, _, _, _ := watermarked.At(pt.X, pt.Y).RGBA(); r>>8 < 100 || r>>8 > 155 {
+		t.Errorf("logo pixel at half opacity = %d, want about 128", r>>8)
+	}
+}
+
+func TestSidecarsNotQueued(t *testing.T) {
+	ip := &ImageProcessor{detection: DetectContent, overrideFrom: map[string]bool{OverridesSidecar: true}}
+	if queue, _ := ip.needsSniffing("photos/beach.jpg.watermark.json"); queue {
+		t.Errorf("needsSniffing() queued an override sidecar")
+	}
+	ip.overrideFrom = map[string]bool{OverridesTags: true}
+	if queue, _ := ip.needsSniffing("photos/data.json"); !queue {
+		t.Errorf("needsSniffing() skipped a key without sidecars enabled")
+	}
+}
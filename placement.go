@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermark placement strategies
+const (
+	PlacementFixed = "fixed" // Logos in the bottom corners
+	PlacementAuto  = "auto"  // Logos where they hide the least detail
+)
+
+// placementCandidates are the anchors evaluated by automatic placement, in
+// order of preference when scores tie
+var placementCandidates = []anchor{
+	anchorBottomLeft,
+	anchorBottomRight,
+	anchorTopLeft,
+	anchorTopRight,
+	anchorBottomCenter,
+	anchorTopCenter,
+}
+
+// validatePlacementSettings checks the optional placement strategy
+func validatePlacementSettings() error {
+	switch placement := os.Getenv(EnvWatermarkPlacement); placement {
+	case "", PlacementFixed, PlacementAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid watermark placement: %s", placement)
+	}
+}
+
+// detailMap scores how much visual detail regions of an image contain
+type detailMap struct {
+	gray *image.Gray
+}
+
+// newDetailMap prepares img for region scoring
+func newDetailMap(img image.Image) *detailMap {
+	gray := imaging.Grayscale(img)
+	g := image.NewGray(gray.Bounds())
+	for i := 0; i < len(g.Pix); i++ {
+		g.Pix[i] = gray.Pix[i*4]
+	}
+	return &detailMap{gray: g}
+}
+
+// score returns the amount of detail in r as the sum of its normalized edge
+// density and luminance entropy, both in the range 0-1
+func (d *detailMap) score(r image.Rectangle) float64 {
+	r = r.Intersect(d.gray.Bounds())
+	if r.Empty() {
+		return math.Inf(1)
+	}
+
+	var histogram [256]int
+	var edges float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			histogram[d.gray.GrayAt(x, y).Y]++
+			edges += d.sobel(x, y)
+		}
+	}
+
+	pixels := float64(r.Dx() * r.Dy())
+	var entropy float64
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / pixels
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	// The largest possible Sobel magnitude on 8-bit pixels is about 1443
+	return math.Min(edges/pixels/1443, 1) + entropy/8
+}
+
+// sobel returns the gradient magnitude at x, y
+func (d *detailMap) sobel(x, y int) float64 {
+	at := func(dx, dy int) float64 {
+		p := image.Pt(x+dx, y+dy)
+		if !p.In(d.gray.Bounds()) {
+			p = image.Pt(x, y)
+		}
+		return float64(d.gray.GrayAt(p.X, p.Y).Y)
+	}
+
+	gx := at(1, -1) + 2*at(1, 0) + at(1, 1) - at(-1, -1) - 2*at(-1, 0) - at(-1, 1)
+	gy := at(-1, 1) + 2*at(0, 1) + at(1, 1) - at(-1, -1) - 2*at(0, -1) - at(1, -1)
+	return math.Sqrt(gx*gx + gy*gy)
+}
+
+// bestAnchor returns the candidate anchor whose region for a watermark of the
+// given size has the least detail, skipping anchors in exclude and regions
+// overlapping occupied. Scores are a pure function of the pixels, so the
+// same image always gets the same placement.
+func (d *detailMap) bestAnchor(size image.Point, exclude []anchor, occupied []image.Rectangle) (anchor, image.Rectangle, bool) {
+	var best anchor
+	var bestRegion image.Rectangle
+	bestScore := math.Inf(1)
+
+	for _, candidate := range placementCandidates {
+		if containsAnchor(exclude, candidate) {
+			continue
+		}
+		pt := anchorPoint(candidate, d.gray.Bounds(), size, WatermarkPadding)
+		region := image.Rectangle{Min: pt, Max: pt.Add(size)}
+		if overlapsAny(region, occupied) {
+			continue
+		}
+		if score := d.score(region); score < bestScore {
+			best, bestRegion, bestScore = candidate, region, score
+		}
+	}
+	return best, bestRegion, best != ""
+}
+
+// placeWatermarks returns the anchors for the left and right watermarks. An
+// empty anchor means the watermark keeps its fixed corner position.
+// Positions overridden for the image take precedence over either strategy,
+// and a side that wasn't overridden moves out of the way of one that was.
+func (ip *ImageProcessor) placeWatermarks(img *image.NRGBA, hasText bool) (anchor, anchor) {
+	bounds := img.Bounds()
+	switch {
+	case ip.leftPosition != "" && ip.rightPosition != "":
+		return ip.leftPosition, ip.rightPosition
+	case ip.leftPosition != "":
+		taken := cornerRegion("left", ip.leftPosition, bounds, ip.leftWatermark)
+		return ip.leftPosition, ip.freePosition("right", ip.rightWatermark, ip.leftPosition, taken, bounds)
+	case ip.rightPosition != "":
+		taken := cornerRegion("right", ip.rightPosition, bounds, ip.rightWatermark)
+		return ip.freePosition("left", ip.leftWatermark, ip.rightPosition, taken, bounds), ip.rightPosition
+	}
+	if ip.placement != PlacementAuto {
+		return "", ""
+	}
+
+	detail := newDetailMap(img)
+	var exclude []anchor
+	if hasText {
+		exclude = append(exclude, ip.textPosition)
+	}
+	if ip.qr != nil {
+		exclude = append(exclude, ip.qr.position)
+	}
+
+	left, leftRegion, ok := detail.bestAnchor(watermarkSize(ip.leftWatermark), exclude, nil)
+	if !ok {
+		ip.logger.Printf("No free position for left watermark, using fixed placement")
+		return "", ""
+	}
+	right, _, ok := detail.bestAnchor(watermarkSize(ip.rightWatermark), append(exclude, left), []image.Rectangle{leftRegion})
+	if !ok {
+		ip.logger.Printf("No free position for right watermark, using fixed placement")
+		return "", ""
+	}
+
+	ip.logger.Printf("Automatic placement chose %s for left watermark and %s for right watermark", left, right)
+	return left, right
+}
+
+// freePosition places the watermark whose position wasn't overridden clear of
+// the one that was: at its fixed corner when that's free, otherwise at the
+// corner mirroring the overridden position, otherwise at any free corner
+func (ip *ImageProcessor) freePosition(slot string, wm image.Image, other anchor, taken, bounds image.Rectangle) anchor {
+	candidates := []anchor{"", mirroredCorners[other], anchorBottomLeft, anchorBottomRight, anchorTopLeft, anchorTopRight}
+	for _, a := range candidates {
+		if !cornerRegion(slot, a, bounds, wm).Overlaps(taken) {
+			return a
+		}
+	}
+	ip.logger.Printf("No free position for %s watermark, using fixed placement", slot)
+	return ""
+}
+
+// watermarkPoint returns where a watermark of the given size is drawn for
+// an anchor chosen by placeWatermarks
+func watermarkPoint(slot string, a anchor, bounds image.Rectangle, size image.Point) image.Point {
+	if a == "" {
+		return cornerPoint(slot, bounds, size)
+	}
+	return anchorPoint(a, bounds, size, WatermarkPadding)
+}
+
+// containsAnchor reports whether anchors contains a
+func containsAnchor(anchors []anchor, a anchor) bool {
+	for _, candidate := range anchors {
+		if candidate == a {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsAny reports whether r overlaps any of the rectangles
+func overlapsAny(r image.Rectangle, rects []image.Rectangle) bool {
+	for _, other := range rects {
+		if r.Overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
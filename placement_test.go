@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math/rand"
+	"testing"
+)
+
+// noisyImage returns a flat gray image with random noise in the given region
+func noisyImage(width, height int, busy image.Rectangle) *image.NRGBA {
+	img := solidImage(width, height, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+	rng := rand.New(rand.NewSource(1))
+	for x := busy.Min.X; x < busy.Max.X; x++ {
+		for y := busy.Min.Y; y < busy.Max.Y; y++ {
+			v := uint8(rng.Intn(256))
+			img.Set(x, y, color.NRGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestDetailMapScore(t *testing.T) {
+	img := noisyImage(200, 200, image.Rect(0, 0, 100, 200))
+	detail := newDetailMap(img)
+
+	busy := detail.score(image.Rect(0, 0, 100, 100))
+	flat := detail.score(image.Rect(110, 0, 200, 100))
+	if busy <= flat {
+		t.Errorf("score() busy = %v, flat = %v, want busy > flat", busy, flat)
+	}
+	if flat != 0 {
+		t.Errorf("score() of a flat region = %v, want 0", flat)
+	}
+}
+
+func TestPlaceWatermarks(t *testing.T) {
+	ip := &ImageProcessor{
+		leftWatermark:  image.NewNRGBA(image.Rect(0, 0, 100, 50)),
+		rightWatermark: image.NewNRGBA(image.Rect(0, 0, 100, 50)),
+		placement:      PlacementAuto,
+		textPosition:   anchorBottomCenter,
+		logger:         log.New(io.Discard, "", 0),
+	}
+
+	// Busy bottom half, so both logos should move to the top corners
+	img := noisyImage(800, 600, image.Rect(0, 300, 800, 600))
+	left, right := ip.placeWatermarks(img, true)
+	if left != anchorTopLeft || right != anchorTopRight {
+		t.Errorf("placeWatermarks() = %s, %s, want %s, %s", left, right, anchorTopLeft, anchorTopRight)
+	}
+
+	// Placement must be stable across runs
+	for i := 0; i < 3; i++ {
+		if l, r := ip.placeWatermarks(img, true); l != left || r != right {
+			t.Fatalf("placeWatermarks() not deterministic: %s, %s then %s, %s", left, right, l, r)
+		}
+	}
+
+	// Fixed placement keeps the default corners
+	ip.placement = PlacementFixed
+	if l, r := ip.placeWatermarks(img, true); l != "" || r != "" {
+		t.Errorf("placeWatermarks() with fixed placement = %s, %s, want empty anchors", l, r)
+	}
+}
+
+func TestBestAnchorSkipsOccupied(t *testing.T) {
+	detail := newDetailMap(solidImage(400, 300, color.White))
+	size := image.Pt(100, 50)
+
+	first, region, ok := detail.bestAnchor(size, nil, nil)
+	if !ok || first != placementCandidates[0] {
+		t.Fatalf("bestAnchor() = %s, %v, want %s", first, ok, placementCandidates[0])
+	}
+
+	second, _, ok := detail.bestAnchor(size, []anchor{first}, []image.Rectangle{region})
+	if !ok || second == first {
+		t.Errorf("bestAnchor() = %s, want an anchor other than %s", second, first)
+	}
+}
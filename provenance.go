@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/disintegration/imaging"
+)
+
+// Version is the tool version recorded in provenance sidecars, set at build
+// time with -ldflags "-X main.Version=1.2.3"
+var Version = "dev"
+
+// ProvenanceSchemaVersion is bumped whenever the sidecar format changes
+const ProvenanceSchemaVersion = 1
+
+// provenanceConfig holds what is needed to write provenance sidecars
+type provenanceConfig struct {
+	prefix     string // Empty writes sidecars next to the outputs
+	settings   provenanceSettings
+	watermarks map[string]string // SHA-256 of each configured watermark image
+}
+
+// provenanceSettings records the settings of the run that shape an output
+type provenanceSettings struct {
+	Mode               string   `json:"mode"`
+	Placement          string   `json:"placement"`
+	TextTemplate       string   `json:"text_template,omitempty"`
+	TextPosition       string   `json:"text_position,omitempty"`
+	TileSource         string   `json:"tile_source,omitempty"`
+	TileAngle          float64  `json:"tile_angle,omitempty"`
+	TileSpacing        int      `json:"tile_spacing,omitempty"`
+	TileOpacity        float64  `json:"tile_opacity,omitempty"`
+	LuminanceThreshold float64  `json:"luminance_threshold"`
+	StripMetadata      []string `json:"strip_metadata,omitempty"`
+	ExifAllowTags      string   `json:"exif_allow_tags,omitempty"`
+	ExifDenyTags       string   `json:"exif_deny_tags,omitempty"`
+	InvisibleTemplate  string   `json:"invisible_template,omitempty"`
+	InvisibleStrength  float64  `json:"invisible_strength,omitempty"`
+	Transforms         string   `json:"transforms,omitempty"`
+	BarHeight          string   `json:"bar_height,omitempty"`
+	BarStyle           string   `json:"bar_style,omitempty"`
+	BarColor           string   `json:"bar_color,omitempty"`
+	FrameWidth         string   `json:"frame_width,omitempty"`
+}
+
+// provenanceRecord is the JSON sidecar written for each output
+type provenanceRecord struct {
+	SchemaVersion int                `json:"schema_version"`
+	Tool          string             `json:"tool"`
+	ToolVersion   string             `json:"tool_version"`
+	Created       time.Time          `json:"created"`
+	Source        provenanceSource   `json:"source"`
+	Output        provenanceOutput   `json:"output"`
+	Watermarks    map[string]string  `json:"watermarks"`
+	Text          string             `json:"text,omitempty"`
+	QRCode        string             `json:"qr_code,omitempty"`
+	Invisible     string             `json:"invisible_payload,omitempty"`
+	Redactions    int                `json:"redacted_regions,omitempty"`
+	Overrides     map[string]string  `json:"overrides,omitempty"`
+	Profile       string             `json:"profile,omitempty"`
+	Recipient     string             `json:"recipient,omitempty"`
+	Settings      provenanceSettings `json:"settings"`
+}
+
+// provenanceSource identifies the exact source object version
+type provenanceSource struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+	SHA256    string `json:"sha256"`
+	Page      int    `json:"page,omitempty"`
+}
+
+// provenanceOutput describes the uploaded output
+type provenanceOutput struct {
+	Key            string `json:"key"`
+	SHA256         string `json:"sha256"`
+	Size           int    `json:"size"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Derivative     string `json:"derivative,omitempty"`
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+}
+
+// validateProvenanceSettings checks the optional provenance settings
+func validateProvenanceSettings() error {
+	if v := os.Getenv(EnvProvenance); v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%s must be true or false: %s", EnvProvenance, v)
+		}
+	}
+	return nil
+}
+
+// toolVersion returns Version, or the module version when installed with
+// go install
+func toolVersion() string {
+	if Version != "dev" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return Version
+}
+
+// sha256Hex returns the hex SHA-256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// imageHash hashes the decoded pixels of an image, so the same watermark
+// hashes the same whether it was loaded from a file or a URL
+func imageHash(img image.Image) string {
+	pixels := imaging.Clone(img)
+	h := sha256.New()
+	fmt.Fprintf(h, "%dx%d:", pixels.Bounds().Dx(), pixels.Bounds().Dy())
+	h.Write(pixels.Pix)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newProvenanceConfig captures the run settings and watermark hashes
+func (ip *ImageProcessor) newProvenanceConfig(prefix string) *provenanceConfig {
+	var strip []string
+	for group := range ip.stripMetadata {
+		strip = append(strip, group)
+	}
+	sort.Strings(strip)
+
+	settings := provenanceSettings{
+		Mode:               ip.mode,
+		Placement:          ip.placement,
+		TextTemplate:       ip.textTemplate,
+		LuminanceThreshold: ip.lumaThreshold,
+		StripMetadata:      strip,
+		ExifAllowTags:      os.Getenv(EnvExifAllowTags),
+		ExifDenyTags:       os.Getenv(EnvExifDenyTags),
+		InvisibleTemplate:  ip.hiddenPayload,
+		Transforms:         ip.transforms.String(),
+	}
+	if ip.textTemplate != "" {
+		settings.TextPosition = string(ip.textPosition)
+	}
+	if ip.mode == ModeTiled {
+		settings.TileSource = ip.tileSource
+		settings.TileAngle = ip.tileAngle
+		settings.TileSpacing = ip.tileSpacing
+		settings.TileOpacity = ip.tileOpacity
+	}
+	if ip.hiddenPayload != "" {
+		settings.InvisibleStrength = ip.hiddenStrength
+	}
+	if ip.caption != nil {
+		settings.BarHeight = ip.caption.height.String()
+		settings.BarStyle = ip.caption.style
+		settings.BarColor = fmt.Sprintf("#%02X%02X%02X", ip.caption.color.R, ip.caption.color.G, ip.caption.color.B)
+		if ip.mode == ModeFrame {
+			settings.FrameWidth = ip.caption.frame.String()
+		}
+	}
+
+	return &provenanceConfig{prefix: prefix, settings: settings, watermarks: ip.watermarkHashes()}
+}
+
+// watermarkHashes hashes each configured watermark image
+func (ip *ImageProcessor) watermarkHashes() map[string]string {
+	watermarks := make(map[string]string)
+	for name, img := range map[string]image.Image{
+		"left":       ip.leftWatermark,
+		"right":      ip.rightWatermark,
+		"left-dark":  ip.leftDark,
+		"right-dark": ip.rightDark,
+	} {
+		if img != nil {
+			watermarks[name] = imageHash(img)
+		}
+	}
+	return watermarks
+}
+
+// sidecarKey returns where the sidecar of an output is stored
+func (ip *ImageProcessor) sidecarKey(targetKey string) string {
+	if ip.provenance.prefix == "" {
+		return targetKey + ".json"
+	}
+	return prefixDir(ip.provenance.prefix) + strings.TrimPrefix(strings.TrimPrefix(targetKey, ip.targetPrefix), "/") + ".json"
+}
+
+// uploadProvenance writes the provenance sidecar of an output
+func (ip *ImageProcessor) uploadProvenance(ctx context.Context, record *provenanceRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance: %v", err)
+	}
+
+	key := ip.sidecarKey(record.Output.Key)
+	contentType := "application/json"
+	putInput := &s3.PutObjectInput{
+		Bucket:      &ip.sourceBucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: &contentType,
+	}
+	if ip.signer != nil {
+		putInput.Metadata = ip.signer.metadata(data)
+	}
+	if _, err := ip.s3Client.PutObject(ctx, putInput); err != nil {
+		return fmt.Errorf("failed to upload provenance %s: %v", key, err)
+	}
+	ip.logger.Printf("Uploaded provenance sidecar to: %s", key)
+	return nil
+}
+
+// newProvenanceRecord describes how an output was made from its source
+func (ip *ImageProcessor) newProvenanceRecord(out *processedImage, targetKey string) *provenanceRecord {
+	record := &provenanceRecord{
+		SchemaVersion: ProvenanceSchemaVersion,
+		Tool:          "s3-watermark",
+		ToolVersion:   toolVersion(),
+		Created:       time.Now().UTC(),
+		Source: provenanceSource{
+			Bucket: ip.sourceBucket,
+			Key:    out.key,
+			SHA256: sha256Hex(out.data),
+			Page:   out.page,
+		},
+		Output: provenanceOutput{
+			Key:        targetKey,
+			SHA256:     sha256Hex(out.encoded),
+			Size:       len(out.encoded),
+			Width:      out.bounds.Dx(),
+			Height:     out.bounds.Dy(),
+			Derivative: out.derivative,
+		},
+		Watermarks: ip.provenance.watermarks,
+		Text:       out.text,
+		QRCode:     out.qrURL,
+		Invisible:  out.payload,
+		Redactions: out.redacted,
+		Overrides:  ip.overridden,
+		Profile:    ip.profile,
+		Settings:   ip.provenance.settings,
+	}
+	if out.source.ETag != nil {
+		record.Source.ETag = strings.Trim(*out.source.ETag, `"`)
+	}
+	if out.source.VersionId != nil {
+		record.Source.VersionID = *out.source.VersionId
+	}
+	if ip.signer != nil {
+		record.Output.SignatureKeyID = ip.signer.keyID
+	}
+	if ip.recipient != nil {
+		record.Recipient = ip.recipient.ID
+	}
+	return record
+}
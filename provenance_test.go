@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestSidecarKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		prefix       string
+		targetPrefix string
+		targetKey    string
+		want         string
+	}{
+		{"Next to output", "", "processed/", "processed/2024/photo.jpg", "processed/2024/photo.jpg.json"},
+		{"Manifest prefix", "provenance/", "processed/", "processed/2024/photo.jpg", "provenance/2024/photo.jpg.json"},
+		{"Manifest prefix without slash", "provenance", "processed/", "processed/2024/photo.jpg", "provenance/2024/photo.jpg.json"},
+		{"Target prefix without slash", "provenance/", "processed", "processed/2024/photo.jpg", "provenance/2024/photo.jpg.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &ImageProcessor{targetPrefix: tt.targetPrefix, provenance: &provenanceConfig{prefix: tt.prefix}}
+			if got := ip.sidecarKey(tt.targetKey); got != tt.want {
+				t.Errorf("sidecarKey() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageHash(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			rgba.Set(x, y, color.RGBA{R: 200, G: 10, B: 10, A: 255})
+			nrgba.Set(x, y, color.NRGBA{R: 200, G: 10, B: 10, A: 255})
+		}
+	}
+	if imageHash(rgba) != imageHash(nrgba) {
+		t.Error("imageHash() differs for the same pixels in different image types")
+	}
+	nrgba.Set(0, 0, color.Black)
+	if imageHash(rgba) == imageHash(nrgba) {
+		t.Error("imageHash() is the same for different pixels")
+	}
+}
+
+func TestNewProvenanceRecord(t *testing.T) {
+	ip := &ImageProcessor{
+		sourceBucket:   "bucket",
+		targetPrefix:   "processed/acme/",
+		leftWatermark:  solidImage(10, 10, color.White),
+		rightWatermark: solidImage(10, 10, color.Black),
+		mode:           ModeCorners,
+		placement:      PlacementFixed,
+		textTemplate:   "© {year}",
+		textPosition:   anchorBottomCenter,
+		recipient:      &recipient{ID: "acme"},
+	}
+	ip.provenance = ip.newProvenanceConfig("")
+
+	etag, version := `"abc123"`, "v7"
+	source := &s3.GetObjectOutput{ETag: &etag, VersionId: &version}
+	out := &processedImage{
+		key:     "source/photo.jpg",
+		source:  source,
+		data:    []byte("source"),
+		encoded: []byte("output"),
+		format:  FormatJPEG,
+		bounds:  image.Rect(0, 0, 800, 600),
+		text:    "© 2024",
+		payload: "acme",
+	}
+	record := ip.newProvenanceRecord(out, "processed/acme/photo.jpg")
+
+	if record.Source.ETag != "abc123" || record.Source.VersionID != "v7" {
+		t.Errorf("source = %+v, want unquoted ETag and version", record.Source)
+	}
+	if record.Output.SHA256 != sha256Hex([]byte("output")) || record.Output.Width != 800 {
+		t.Errorf("output = %+v", record.Output)
+	}
+	if len(record.Watermarks) != 2 || record.Watermarks["left"] == record.Watermarks["right"] {
+		t.Errorf("watermarks = %v, want two distinct hashes", record.Watermarks)
+	}
+	if record.Recipient != "acme" || record.Settings.TextTemplate != "© {year}" {
+		t.Errorf("record = %+v", record)
+	}
+	if _, err := json.Marshal(record); err != nil {
+		t.Errorf("json.Marshal() error = %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"rsc.io/qr"
+)
+
+// QR code defaults
+const (
+	DefaultQRLevel     = "M"
+	DefaultQRSize      = "150"
+	DefaultQRQuietZone = 4 // Modules of white border the QR specification asks for
+	DefaultQRPosition  = anchorTopRight
+)
+
+// qrLevels maps error correction names to levels, from 7% to 30% of the
+// code being recoverable
+var qrLevels = map[string]qr.Level{"L": qr.L, "M": qr.M, "Q": qr.Q, "H": qr.H}
+
+// qrSettings holds the QR code watermark settings
+type qrSettings struct {
+	template string
+	level    qr.Level
+	size     relativeSize // Percentages are of the shorter image side
+	quiet    int
+	position anchor
+}
+
+// newQRSettings reads the QR code settings, or returns nil when no URL
+// template is configured
+func newQRSettings() (*qrSettings, error) {
+	template := os.Getenv(EnvQRCodeURL)
+	if template == "" {
+		return nil, nil
+	}
+	settings := &qrSettings{template: template, quiet: DefaultQRQuietZone, position: DefaultQRPosition}
+
+	levelValue := strings.ToUpper(os.Getenv(EnvQRCodeLevel))
+	if levelValue == "" {
+		levelValue = DefaultQRLevel
+	}
+	level, ok := qrLevels[levelValue]
+	if !ok {
+		return nil, fmt.Errorf("invalid %s: %s (must be L, M, Q or H)", EnvQRCodeLevel, levelValue)
+	}
+	settings.level = level
+
+	sizeValue := os.Getenv(EnvQRCodeSize)
+	if sizeValue == "" {
+		sizeValue = DefaultQRSize
+	}
+	var err error
+	if settings.size, err = parseRelativeSize(EnvQRCodeSize, sizeValue); err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv(EnvQRCodeQuietZone); v != "" {
+		if settings.quiet, err = strconv.Atoi(v); err != nil || settings.quiet < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number of modules: %s", EnvQRCodeQuietZone, v)
+		}
+	}
+	if v := os.Getenv(EnvQRCodePosition); v != "" {
+		if settings.position, err = parseAnchor(v); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// validateQRSettings checks the optional QR code settings
+func validateQRSettings() error {
+	_, err := newQRSettings()
+	return err
+}
+
+// render encodes url as a black on white QR code no larger than size pixels,
+// including the quiet zone. Modules are whole pixels so scanners read them
+// cleanly, which may leave the code slightly smaller than size.
+func (q *qrSettings) render(url string, size int) (*image.NRGBA, error) {
+	code, err := qr.Encode(url, q.level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code for %q: %v", url, err)
+	}
+	modules := code.Size + 2*q.quiet
+	scale := max(size/modules, 1)
+
+	img := imaging.New(modules*scale, modules*scale, color.White)
+	black := image.NewUniform(color.Black)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				r := image.Rect(x+q.quiet, y+q.quiet, x+q.quiet+1, y+q.quiet+1)
+				draw.Draw(img, image.Rectangle{Min: r.Min.Mul(scale), Max: r.Max.Mul(scale)}, black, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img, nil
+}
+
+// drawQRCode draws a QR code encoding url at the configured anchor
+func (ip *ImageProcessor) drawQRCode(img *image.NRGBA, url string) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	code, err := ip.qr.render(url, ip.qr.size.of(min(bounds.Dx(), bounds.Dy())))
+	if err != nil {
+		return nil, err
+	}
+	pt := anchorPoint(ip.qr.position, bounds, code.Bounds().Size(), WatermarkPadding)
+	ip.logger.Printf("Added %dpx QR code for %s at %s", code.Bounds().Dx(), url, ip.qr.position)
+	return imaging.Overlay(img, code, pt, 1.0), nil
+}
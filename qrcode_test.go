@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"rsc.io/qr"
+)
+
+func TestNewQRSettings(t *testing.T) {
+	t.Setenv(EnvQRCodeURL, "")
+	if settings, err := newQRSettings(); settings != nil || err != nil {
+		t.Errorf("newQRSettings() without a URL = %v, %v, want nil", settings, err)
+	}
+
+	t.Setenv(EnvQRCodeURL, "https://photos.example/license/{name}")
+	settings, err := newQRSettings()
+	if err != nil {
+		t.Fatalf("newQRSettings() error = %v", err)
+	}
+	if settings.level != qr.M || settings.size.of(1000) != 150 || settings.quiet != DefaultQRQuietZone || settings.position != anchorTopRight {
+		t.Errorf("newQRSettings() defaults = %+v", settings)
+	}
+
+	for env, value := range map[string]string{
+		EnvQRCodeLevel:     "X",
+		EnvQRCodeSize:      "0",
+		EnvQRCodeQuietZone: "-1",
+		EnvQRCodePosition:  "middle",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := newQRSettings(); err == nil {
+				t.Errorf("newQRSettings() with %s=%s expected error", env, value)
+			}
+		})
+	}
+}
+
+func TestRenderQRCode(t *testing.T) {
+	const url = "https://photos.example/license/beach"
+	settings := &qrSettings{level: qr.H, quiet: 4}
+	img, err := settings.render(url, 200)
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+
+	code, err := qr.Encode(url, qr.H)
+	if err != nil {
+		t.Fatalf("qr.Encode() error = %v", err)
+	}
+	modules := code.Size + 8
+	scale := 200 / modules
+	if got := img.Bounds().Dx(); got != modules*scale || img.Bounds().Dy() != got {
+		t.Fatalf("render() size = %v, want %dx%d", img.Bounds().Size(), modules*scale, modules*scale)
+	}
+
+	// Sample the middle of every module, including the quiet zone
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			dark := img.NRGBAAt(x*scale+scale/2, y*scale+scale/2).R < 128
+			if want := code.Black(x-4, y-4); dark != want {
+				t.Fatalf("module (%d, %d) dark = %v, want %v", x, y, dark, want)
+			}
+		}
+	}
+
+	if small, err := settings.render(url, 10); err != nil || small.Bounds().Dx() != modules {
+		t.Errorf("render() below one pixel per module = %v, %v, want %d pixels", small.Bounds(), err, modules)
+	}
+}
+
+func TestDrawQRCodePosition(t *testing.T) {
+	ip := &ImageProcessor{
+		qr:     &qrSettings{level: qr.M, size: relativeSize{percent: 20}, quiet: 4, position: anchorTopLeft},
+		logger: log.New(io.Discard, "", 0),
+	}
+	img := solidImage(800, 600, color.NRGBA{R: 200, G: 30, B: 30, A: 255})
+	out, err := ip.drawQRCode(img, "https://photos.example/license/beach")
+	if err != nil {
+		t.Fatalf("drawQRCode() error = %v", err)
+	}
+
+	// The quiet zone is white and starts at the padding
+	pad := WatermarkPadding
+	if c := out.NRGBAAt(pad, pad); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("quiet zone corner = %v, want white", c)
+	}
+	if c := out.NRGBAAt(pad-1, pad-1); c != img.NRGBAAt(0, 0) {
+		t.Errorf("pixel outside the code = %v, want the image", c)
+	}
+	if c := out.NRGBAAt(pad+121, pad+121); c != img.NRGBAAt(0, 0) {
+		t.Errorf("pixel past the 120px code = %v, want the image", c)
+	}
+	if got := ip.qr.size.of(min(img.Bounds().Dx(), img.Bounds().Dy())); got != 120 {
+		t.Errorf("size = %d, want 120", got)
+	}
+}
+
+func TestQRCodeURLFromTags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["tagging"]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `<Tagging><TagSet><Tag><Key>asset</Key><Value>A-17</Value></Tag></TagSet></Tagging>`)
+	}))
+	defer server.Close()
+
+	// Only the QR code URL references a tag
+	ip := &ImageProcessor{
+		s3Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(server.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		sourceBucket: "source-bucket",
+		qr:           &qrSettings{template: "https://photos.example/license/{tag.asset}"},
+		logger:       log.New(io.Discard, "", 0),
+	}
+
+	vars := ip.imageTemplateVars(context.Background(), "photos/beach.jpg", nil, nil)
+	if got := renderTemplate(ip.qr.template, vars); got != "https://photos.example/license/A-17" {
+		t.Errorf("QR code URL = %q, want https://photos.example/license/A-17", got)
+	}
+}
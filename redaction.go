@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/disintegration/imaging"
+)
+
+// Redaction styles
+const (
+	RedactPixelate = "pixelate" // Replace the region with coarse blocks
+	RedactBlur     = "blur"     // Replace the region with a heavy blur
+)
+
+// Units of redaction coordinates
+const (
+	UnitsPixels   = "pixels"   // Pixels of the decoded, upright image
+	UnitsRelative = "relative" // Fractions of the image width and height from 0 to 1
+)
+
+// redactionSuffix is appended to an image key to find its sidecar
+const redactionSuffix = ".json"
+
+// Strength of the redaction effects relative to the longer region side, with
+// a floor so small regions stay unreadable
+const (
+	pixelateDivisor = 8  // Blocks across the longer side
+	minPixelateSize = 8  // Smallest block in pixels
+	blurDivisor     = 10 // Blur sigma is the longer side over this
+	minBlurSigma    = 4
+)
+
+// redactionSidecar lists the areas of an image that must be hidden
+type redactionSidecar struct {
+	Style   string            `json:"style"`
+	Units   string            `json:"units"`
+	Regions []redactionRegion `json:"regions"`
+}
+
+// redactionRegion is a rectangle or polygon to hide
+type redactionRegion struct {
+	Label   string       `json:"label"`
+	Rect    []float64    `json:"rect"`    // x, y, width, height
+	Polygon [][2]float64 `json:"polygon"` // Vertices as [x, y]
+	Style   string       `json:"style"`   // Overrides the sidecar style
+	Page    int          `json:"page"`    // Page of a multi-page TIFF, 0 for every page
+}
+
+// redactionStyle returns the configured default redaction style
+func redactionStyle() (string, error) {
+	style := os.Getenv(EnvRedactionStyle)
+	if style == "" {
+		return RedactPixelate, nil
+	}
+	if style != RedactPixelate && style != RedactBlur {
+		return "", fmt.Errorf("invalid %s: %s (must be %s or %s)", EnvRedactionStyle, style, RedactPixelate, RedactBlur)
+	}
+	return style, nil
+}
+
+// validateRedactionSettings checks the optional redaction settings
+func validateRedactionSettings() error {
+	if v := os.Getenv(EnvRedactionSidecars); v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%s must be true or false: %s", EnvRedactionSidecars, v)
+		}
+	}
+	_, err := redactionStyle()
+	return err
+}
+
+// parseRedactions parses and checks a sidecar, filling in the default style
+// and units. Unknown fields are rejected so a misspelled region isn't
+// silently left visible.
+func parseRedactions(data []byte, defaultStyle string) (*redactionSidecar, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var sidecar redactionSidecar
+	if err := decoder.Decode(&sidecar); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the sidecar object")
+	}
+
+	switch sidecar.Style {
+	case "":
+		sidecar.Style = defaultStyle
+	case RedactPixelate, RedactBlur:
+	default:
+		return nil, fmt.Errorf("invalid style %s (must be %s or %s)", sidecar.Style, RedactPixelate, RedactBlur)
+	}
+	switch sidecar.Units {
+	case "":
+		sidecar.Units = UnitsPixels
+	case UnitsPixels, UnitsRelative:
+	default:
+		return nil, fmt.Errorf("invalid units %s (must be %s or %s)", sidecar.Units, UnitsPixels, UnitsRelative)
+	}
+
+	for i := range sidecar.Regions {
+		r := &sidecar.Regions[i]
+		name := r.name(i)
+		switch {
+		case r.Rect != nil && r.Polygon != nil:
+			return nil, fmt.Errorf("%s has both rect and polygon", name)
+		case r.Rect != nil:
+			if len(r.Rect) != 4 {
+				return nil, fmt.Errorf("%s: rect must be [x, y, width, height]", name)
+			}
+			if r.Rect[2] <= 0 || r.Rect[3] <= 0 {
+				return nil, fmt.Errorf("%s: rect width and height must be positive", name)
+			}
+		case r.Polygon != nil:
+			if len(r.Polygon) < 3 {
+				return nil, fmt.Errorf("%s: polygon needs at least 3 points", name)
+			}
+		default:
+			return nil, fmt.Errorf("%s has neither rect nor polygon", name)
+		}
+		for _, pt := range r.points() {
+			if math.IsNaN(pt[0]) || math.IsNaN(pt[1]) || math.IsInf(pt[0], 0) || math.IsInf(pt[1], 0) {
+				return nil, fmt.Errorf("%s has an invalid coordinate", name)
+			}
+		}
+
+		switch r.Style {
+		case "":
+			r.Style = sidecar.Style
+		case RedactPixelate, RedactBlur:
+		default:
+			return nil, fmt.Errorf("%s: invalid style %s (must be %s or %s)", name, r.Style, RedactPixelate, RedactBlur)
+		}
+		if r.Page < 0 {
+			return nil, fmt.Errorf("%s: page must not be negative", name)
+		}
+	}
+	return &sidecar, nil
+}
+
+// name identifies a region in errors and logs
+func (r *redactionRegion) name(index int) string {
+	if r.Label != "" {
+		return fmt.Sprintf("region %d (%s)", index+1, r.Label)
+	}
+	return fmt.Sprintf("region %d", index+1)
+}
+
+// points returns the outline of a region as written in the sidecar
+func (r *redactionRegion) points() [][2]float64 {
+	if r.Rect == nil {
+		return r.Polygon
+	}
+	x, y, w, h := r.Rect[0], r.Rect[1], r.Rect[2], r.Rect[3]
+	return [][2]float64{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}
+}
+
+// loadRedactions fetches the sidecar of an image. A missing sidecar means
+// nothing to redact; any other failure is an error so the image isn't
+// published unredacted.
+func (ip *ImageProcessor) loadRedactions(ctx context.Context, key string) (*redactionSidecar, error) {
+	sidecarKey := key + redactionSuffix
+	result, err := ip.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &ip.sourceBucket,
+		Key:    &sidecarKey,
+	})
+	if err != nil {
+		var missing *types.NoSuchKey
+		if errors.As(err, &missing) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get redaction sidecar %s: %v", sidecarKey, err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redaction sidecar %s: %v", sidecarKey, err)
+	}
+	sidecar, err := parseRedactions(data, ip.redactStyle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction sidecar %s: %v", sidecarKey, err)
+	}
+	ip.logger.Printf("Loaded %d redaction regions for %s", len(sidecar.Regions), key)
+	return sidecar, nil
+}
+
+// apply hides the regions of a sidecar that belong to page, counting pages
+// from 1, and returns the redacted image and how many regions it hid. A
+// region that misses the image entirely is an error, since it means the
+// sidecar doesn't describe this image.
+func (s *redactionSidecar) apply(img image.Image, page int) (*image.NRGBA, int, error) {
+	redacted := imaging.Clone(img)
+	bounds := redacted.Bounds()
+	count := 0
+	for i := range s.Regions {
+		r := &s.Regions[i]
+		if r.Page != 0 && r.Page != page {
+			continue
+		}
+
+		// Resolve the outline to pixels
+		points := r.points()
+		polygon := make([][2]float64, len(points))
+		for j, pt := range points {
+			if s.Units == UnitsRelative {
+				pt = [2]float64{pt[0] * float64(bounds.Dx()), pt[1] * float64(bounds.Dy())}
+			}
+			polygon[j] = pt
+		}
+		minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+		for _, pt := range polygon {
+			minX, maxX = math.Min(minX, pt[0]), math.Max(maxX, pt[0])
+			minY, maxY = math.Min(minY, pt[1]), math.Max(maxY, pt[1])
+		}
+		area := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY))).Intersect(bounds)
+		if area.Empty() {
+			return nil, 0, fmt.Errorf("%s lies outside the %dx%d image", r.name(i), bounds.Dx(), bounds.Dy())
+		}
+
+		var effect *image.NRGBA
+		if r.Style == RedactBlur {
+			effect = blurArea(redacted, area)
+		} else {
+			effect = pixelateArea(redacted, area)
+		}
+		rect := r.Rect != nil
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if rect || insidePolygon(polygon, float64(x)+0.5, float64(y)+0.5) {
+					redacted.SetNRGBA(x, y, effect.NRGBAAt(x-area.Min.X, y-area.Min.Y))
+				}
+			}
+		}
+		count++
+	}
+	return redacted, count, nil
+}
+
+// pixelateArea returns area averaged over square blocks, as an image whose
+// origin is the top left corner of area
+func pixelateArea(img *image.NRGBA, area image.Rectangle) *image.NRGBA {
+	block := max(max(area.Dx(), area.Dy())/pixelateDivisor, minPixelateSize)
+	out := image.NewNRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+	for by := area.Min.Y; by < area.Max.Y; by += block {
+		for bx := area.Min.X; bx < area.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(area)
+			var r, g, b, a, n int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					c := img.NRGBAAt(x, y)
+					r, g, b, a = r+int(c.R), g+int(c.G), b+int(c.B), a+int(c.A)
+					n++
+				}
+			}
+			average := color.NRGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)}
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					out.SetNRGBA(x-area.Min.X, y-area.Min.Y, average)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// blurArea returns area blurred with only its own pixels, so sharp detail
+// from around it doesn't bleed back in, as an image whose origin is the top
+// left corner of area
+func blurArea(img *image.NRGBA, area image.Rectangle) *image.NRGBA {
+	sigma := math.Max(float64(max(area.Dx(), area.Dy()))/blurDivisor, minBlurSigma)
+	return imaging.Blur(imaging.Crop(img, area), sigma)
+}
+
+// insidePolygon reports whether a point is inside a polygon by the even-odd
+// rule
+func insidePolygon(polygon [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
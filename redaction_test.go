@@ -0,0 +1,147 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseRedactions(t *testing.T) {
+	sidecar, err := parseRedactions([]byte(`{
+		"regions": [
+			{"label": "plate", "rect": [10, 20, 30, 40]},
+			{"label": "face", "polygon": [[0, 0], [10, 0], [5, 8]], "style": "blur", "page": 2}
+		]
+	}`), RedactPixelate)
+	if err != nil {
+		t.Fatalf("parseRedactions() error = %v", err)
+	}
+	if sidecar.Style != RedactPixelate || sidecar.Units != UnitsPixels {
+		t.Errorf("parseRedactions() defaults = %s, %s", sidecar.Style, sidecar.Units)
+	}
+	if len(sidecar.Regions) != 2 || sidecar.Regions[0].Style != RedactPixelate || sidecar.Regions[1].Style != RedactBlur {
+		t.Errorf("parseRedactions() regions = %+v", sidecar.Regions)
+	}
+
+	for name, data := range map[string]string{
+		"syntax":        `{"regions": [`,
+		"unknown field": `{"regions": [{"rectangle": [0, 0, 10, 10]}]}`,
+		"no shape":      `{"regions": [{"label": "face"}]}`,
+		"both shapes":   `{"regions": [{"rect": [0, 0, 1, 1], "polygon": [[0, 0], [1, 0], [1, 1]]}]}`,
+		"short rect":    `{"regions": [{"rect": [0, 0, 10]}]}`,
+		"empty rect":    `{"regions": [{"rect": [0, 0, 0, 10]}]}`,
+		"short polygon": `{"regions": [{"polygon": [[0, 0], [1, 1]]}]}`,
+		"style":         `{"style": "smudge", "regions": []}`,
+		"units":         `{"units": "inches", "regions": []}`,
+		"region style":  `{"regions": [{"rect": [0, 0, 1, 1], "style": "smudge"}]}`,
+		"page":          `{"regions": [{"rect": [0, 0, 1, 1], "page": -1}]}`,
+		"trailing data": `{"regions": []} {}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseRedactions([]byte(data), RedactPixelate); err == nil {
+				t.Errorf("parseRedactions(%s) expected error", data)
+			}
+		})
+	}
+}
+
+func TestApplyRedactions(t *testing.T) {
+	img := noisyImage(200, 200, image.Rect(0, 0, 200, 200))
+	sidecar, err := parseRedactions([]byte(`{"regions": [{"rect": [40, 40, 64, 64]}]}`), RedactPixelate)
+	if err != nil {
+		t.Fatalf("parseRedactions() error = %v", err)
+	}
+	redacted, count, err := sidecar.apply(img, 1)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("apply() count = %d, want 1", count)
+	}
+	if img.NRGBAAt(50, 50) == redacted.NRGBAAt(50, 50) && img.NRGBAAt(51, 50) == redacted.NRGBAAt(51, 50) {
+		t.Errorf("apply() left the region unchanged")
+	}
+	if redacted.NRGBAAt(40, 40) != redacted.NRGBAAt(47, 47) {
+		t.Errorf("apply() pixels of one block differ: %v, %v", redacted.NRGBAAt(40, 40), redacted.NRGBAAt(47, 47))
+	}
+	for _, pt := range []image.Point{{39, 50}, {104, 50}, {50, 39}, {50, 104}} {
+		if img.NRGBAAt(pt.X, pt.Y) != redacted.NRGBAAt(pt.X, pt.Y) {
+			t.Errorf("apply() changed pixel %v outside the region", pt)
+		}
+	}
+}
+
+func TestApplyRedactionPolygon(t *testing.T) {
+	img := noisyImage(100, 100, image.Rect(0, 0, 100, 100))
+	sidecar, err := parseRedactions([]byte(`{
+		"style": "blur",
+		"units": "relative",
+		"regions": [{"polygon": [[0.1, 0.1], [0.9, 0.1], [0.1, 0.9]]}]
+	}`), RedactPixelate)
+	if err != nil {
+		t.Fatalf("parseRedactions() error = %v", err)
+	}
+	redacted, _, err := sidecar.apply(img, 1)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if img.NRGBAAt(20, 20) == redacted.NRGBAAt(20, 20) && img.NRGBAAt(21, 20) == redacted.NRGBAAt(21, 20) {
+		t.Errorf("apply() left the inside of the polygon unchanged")
+	}
+	// Inside the bounding box but across the diagonal edge
+	if img.NRGBAAt(80, 80) != redacted.NRGBAAt(80, 80) {
+		t.Errorf("apply() changed a pixel outside the polygon")
+	}
+}
+
+func TestApplyRedactionPages(t *testing.T) {
+	img := noisyImage(100, 100, image.Rect(0, 0, 100, 100))
+	sidecar, err := parseRedactions([]byte(`{"regions": [{"rect": [0, 0, 10, 10], "page": 2}]}`), RedactPixelate)
+	if err != nil {
+		t.Fatalf("parseRedactions() error = %v", err)
+	}
+	if _, count, _ := sidecar.apply(img, 1); count != 0 {
+		t.Errorf("apply() on page 1 count = %d, want 0", count)
+	}
+	if _, count, _ := sidecar.apply(img, 2); count != 1 {
+		t.Errorf("apply() on page 2 count = %d, want 1", count)
+	}
+}
+
+func TestApplyRedactionOutside(t *testing.T) {
+	img := noisyImage(100, 100, image.Rect(0, 0, 100, 100))
+	sidecar, err := parseRedactions([]byte(`{"regions": [{"label": "plate", "rect": [150, 150, 20, 20]}]}`), RedactPixelate)
+	if err != nil {
+		t.Fatalf("parseRedactions() error = %v", err)
+	}
+	if _, _, err := sidecar.apply(img, 1); err == nil {
+		t.Errorf("apply() with a region outside the image expected error")
+	}
+}
+
+func TestInsidePolygon(t *testing.T) {
+	square := [][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	tests := []struct {
+		x, y float64
+		want bool
+	}{
+		{5, 5, true},
+		{0.5, 9.5, true},
+		{-1, 5, false},
+		{5, 11, false},
+	}
+	for _, tt := range tests {
+		if got := insidePolygon(square, tt.x, tt.y); got != tt.want {
+			t.Errorf("insidePolygon(%v, %v) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestRedactionSidecarsNotQueued(t *testing.T) {
+	ip := &ImageProcessor{detection: DetectContent, redact: true}
+	if queue, _ := ip.needsSniffing("photos/beach.jpg.json"); queue {
+		t.Errorf("needsSniffing() queued a redaction sidecar")
+	}
+	if queue, _ := ip.needsSniffing("photos/beach.jpg"); !queue {
+		t.Errorf("needsSniffing() skipped an image")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// runReport collects per-image findings from the workers of a run
+type runReport struct {
+	mu       sync.Mutex
+	GPS      []metadataFinding `json:"gps"`
+	Personal []metadataFinding `json:"personal"`
+	Skipped  []skippedObject   `json:"skipped"`
+	outputs  []string
+}
+
+// metadataFinding records an image whose source contained GPS coordinates,
+// or owner names and serial numbers, and whether the output still does
+type metadataFinding struct {
+	Key     string `json:"key"`
+	Removed bool   `json:"removed"`
+}
+
+// skippedObject records an object that wasn't processed and why
+type skippedObject struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// addGPS records that the source of key contained GPS data
+func (r *runReport) addGPS(key string, removed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.GPS = addFinding(r.GPS, key, removed)
+}
+
+// addPersonal records that the source of key contained owner names or serial
+// numbers
+func (r *runReport) addPersonal(key string, removed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Personal = addFinding(r.Personal, key, removed)
+}
+
+// addFinding records a finding once per key. Derivatives and pages of a
+// source report it once per output, and the data counts as removed only if
+// every output lost it.
+func addFinding(findings []metadataFinding, key string, removed bool) []metadataFinding {
+	for i := range findings {
+		if findings[i].Key == key {
+			findings[i].Removed = findings[i].Removed && removed
+			return findings
+		}
+	}
+	return append(findings, metadataFinding{Key: key, Removed: removed})
+}
+
+// addSkipped records an object that wasn't processed
+func (r *runReport) addSkipped(key, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, skippedObject{Key: key, Reason: reason})
+}
+
+// addOutput records a successfully uploaded output
+func (r *runReport) addOutput(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs = append(r.outputs, key)
+}
+
+// outputKeys returns the sorted keys of the images uploaded during the run
+func (r *runReport) outputKeys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := append([]string(nil), r.outputs...)
+	sort.Strings(keys)
+	return keys
+}
+
+// log writes the report summary
+func (r *runReport) log(ip *ImageProcessor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.Slice(r.Skipped, func(i, j int) bool { return r.Skipped[i].Key < r.Skipped[j].Key })
+	if len(r.Skipped) > 0 {
+		ip.logger.Printf("%d objects were skipped:", len(r.Skipped))
+		for _, skipped := range r.Skipped {
+			ip.logger.Printf("  %s (%s)", skipped.Key, skipped.Reason)
+		}
+	}
+
+	sort.Slice(r.GPS, func(i, j int) bool { return r.GPS[i].Key < r.GPS[j].Key })
+	if len(r.GPS) == 0 {
+		ip.logger.Printf("No images contained GPS data")
+	} else {
+		ip.logger.Printf("%d images contained GPS data:", len(r.GPS))
+		logFindings(ip, r.GPS, "GPS")
+	}
+
+	sort.Slice(r.Personal, func(i, j int) bool { return r.Personal[i].Key < r.Personal[j].Key })
+	if len(r.Personal) > 0 {
+		ip.logger.Printf("%d images contained owner names or serial numbers:", len(r.Personal))
+		logFindings(ip, r.Personal, "personal data")
+	}
+}
+
+// logFindings writes one line per finding, saying whether the data was kept
+func logFindings(ip *ImageProcessor, findings []metadataFinding, what string) {
+	for _, finding := range findings {
+		status := "kept"
+		if finding.Removed {
+			status = "removed"
+		}
+		ip.logger.Printf("  %s (%s %s)", finding.Key, what, status)
+	}
+}
+
+// write saves the report as JSON
+func (r *runReport) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// NoWatermark in place of a logo path leaves that logo slot empty
+const NoWatermark = "none"
+
+// watermarkProfile is a named set of watermark settings that replaces the
+// run settings for the keys its rules match. Empty fields keep the run
+// settings.
+type watermarkProfile struct {
+	Watermark          string             `json:"watermark,omitempty"` // "apply", "none" or "skip"
+	LeftWatermark      string             `json:"left_watermark,omitempty"`
+	RightWatermark     string             `json:"right_watermark,omitempty"`
+	LeftWatermarkDark  string             `json:"left_watermark_dark,omitempty"`
+	RightWatermarkDark string             `json:"right_watermark_dark,omitempty"`
+	Text               *string            `json:"text,omitempty"` // Text template, "" for no text
+	Overrides          watermarkOverrides `json:"overrides,omitempty"`
+
+	left, right, leftDark, rightDark image.Image
+}
+
+// watermarkRule selects a profile for keys matching a pattern and, when
+// given, carrying the listed tags and user metadata
+type watermarkRule struct {
+	Name     string            `json:"name"`
+	Match    string            `json:"match"` // Glob such as "brand-a/**"
+	Regex    string            `json:"regex"`
+	Tags     map[string]string `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	Profile  string            `json:"profile"`
+
+	pattern *regexp.Regexp
+}
+
+// ruleSet is a parsed rules file
+type ruleSet struct {
+	Profiles map[string]*watermarkProfile `json:"profiles"`
+	Rules    []*watermarkRule             `json:"rules"`
+}
+
+// ruleTrace records why a rule did or didn't match a key
+type ruleTrace struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// loadRules reads and checks a rules file. Logos are only checked, and are
+// loaded by loadLogos.
+func loadRules(path string) (*ruleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules %s: %v", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var rules ruleSet
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %v", path, err)
+	}
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("rules %s has no rules", path)
+	}
+
+	for name, p := range rules.Profiles {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	for i, r := range rules.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		switch {
+		case r.Match != "" && r.Regex != "":
+			return nil, fmt.Errorf("%s has both match and regex", r.Name)
+		case r.Match != "":
+			r.pattern = globRegexp(r.Match)
+		case r.Regex != "":
+			if r.pattern, err = regexp.Compile(r.Regex); err != nil {
+				return nil, fmt.Errorf("%s: invalid regex: %v", r.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s has neither match nor regex", r.Name)
+		}
+		if rules.Profiles[r.Profile] == nil {
+			return nil, fmt.Errorf("%s uses unknown profile %q", r.Name, r.Profile)
+		}
+		// The SDK returns user metadata keys in lowercase
+		metadata := make(map[string]string, len(r.Metadata))
+		for k, v := range r.Metadata {
+			metadata[strings.ToLower(k)] = v
+		}
+		r.Metadata = metadata
+	}
+	return &rules, nil
+}
+
+// check validates the settings of a profile
+func (p *watermarkProfile) check() error {
+	switch p.Watermark {
+	case "", WatermarkApply, WatermarkNone, WatermarkSkip:
+	default:
+		return fmt.Errorf("invalid watermark %s (must be %s, %s or %s)", p.Watermark, WatermarkApply, WatermarkNone, WatermarkSkip)
+	}
+	for _, path := range []string{p.LeftWatermark, p.RightWatermark, p.LeftWatermarkDark, p.RightWatermarkDark} {
+		if path == "" || path == NoWatermark {
+			continue
+		}
+		if err := validateWatermarkPath(path); err != nil {
+			return err
+		}
+	}
+	if p.LeftWatermarkDark != "" && p.LeftWatermark == "" {
+		return fmt.Errorf("left_watermark_dark needs left_watermark")
+	}
+	if p.RightWatermarkDark != "" && p.RightWatermark == "" {
+		return fmt.Errorf("right_watermark_dark needs right_watermark")
+	}
+	if _, ok := p.Overrides[OverrideWatermark]; ok {
+		return fmt.Errorf("use the watermark field of the profile instead of the %s override", OverrideWatermark)
+	}
+	for name := range p.Overrides {
+		if !isOverrideName(name) {
+			return fmt.Errorf("unknown override %s", name)
+		}
+	}
+	return p.Overrides.check()
+}
+
+// loadLogos loads the logos of every profile
+func (rs *ruleSet) loadLogos() error {
+	load := func(path string) (image.Image, error) {
+		switch path {
+		case "":
+			return nil, nil
+		case NoWatermark:
+			// A transparent pixel keeps placement and variant selection
+			// working while drawing nothing
+			return image.NewNRGBA(image.Rect(0, 0, 1, 1)), nil
+		}
+		img, err := loadWatermarkImage(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load watermark %s: %v", path, err)
+		}
+		return img, nil
+	}
+	for name, p := range rs.Profiles {
+		var err error
+		for _, logo := range []struct {
+			path string
+			img  *image.Image
+		}{
+			{p.LeftWatermark, &p.left},
+			{p.RightWatermark, &p.right},
+			{p.LeftWatermarkDark, &p.leftDark},
+			{p.RightWatermarkDark, &p.rightDark},
+		} {
+			if *logo.img, err = load(logo.path); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRulesSettings checks the optional rules file
+func validateRulesSettings() error {
+	if path := os.Getenv(EnvRulesPath); path != "" {
+		_, err := loadRules(path)
+		return err
+	}
+	return nil
+}
+
+// globRegexp converts a glob to an anchored regular expression. "*" and "?"
+// don't cross "/", "**" does, and "**/" also matches no directory at all.
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if !strings.HasPrefix(glob[i:], "**") {
+				b.WriteString("[^/]*")
+				continue
+			}
+			i++
+			if strings.HasPrefix(glob[i+1:], "/") {
+				i++
+				b.WriteString("(?:.*/)?")
+			} else {
+				b.WriteString(".*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// objectFacts fetches the tags and user metadata that rule conditions test,
+// at most once per object and only when a rule needs them
+type objectFacts struct {
+	ctx      context.Context
+	client   *s3.Client
+	bucket   string
+	key      string
+	tags     map[string]string
+	metadata map[string]string
+}
+
+func (f *objectFacts) getTags() (map[string]string, error) {
+	if f.tags == nil {
+		tags, err := fetchObjectTags(f.ctx, f.client, f.bucket, f.key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tags: %v", err)
+		}
+		f.tags = tags
+	}
+	return f.tags, nil
+}
+
+func (f *objectFacts) getMetadata() (map[string]string, error) {
+	if f.metadata == nil {
+		head, err := f.client.HeadObject(f.ctx, &s3.HeadObjectInput{Bucket: &f.bucket, Key: &f.key})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get metadata: %v", err)
+		}
+		f.metadata = make(map[string]string, len(head.Metadata))
+		for k, v := range head.Metadata {
+			f.metadata[k] = v
+		}
+	}
+	return f.metadata, nil
+}
+
+// evaluate returns the first rule matching key, which is relative to
+// SOURCE_PREFIX, or nil when none does, along with the outcome of every
+// rule that was tried
+func (rs *ruleSet) evaluate(key string, facts *objectFacts) (*watermarkRule, []ruleTrace, error) {
+	var traces []ruleTrace
+	for _, r := range rs.Rules {
+		reason, err := r.mismatch(key, facts)
+		if err != nil {
+			return nil, traces, fmt.Errorf("%s: %v", r.Name, err)
+		}
+		traces = append(traces, ruleTrace{Rule: r.Name, Matched: reason == "", Reason: reason})
+		if reason == "" {
+			return r, traces, nil
+		}
+	}
+	return nil, traces, nil
+}
+
+// mismatch returns why a rule doesn't match key, or "" when it does.
+// Conditions are only fetched for keys matching the pattern.
+func (r *watermarkRule) mismatch(key string, facts *objectFacts) (string, error) {
+	if !r.pattern.MatchString(key) {
+		if r.Match != "" {
+			return fmt.Sprintf("key doesn't match %s", r.Match), nil
+		}
+		return fmt.Sprintf("key doesn't match /%s/", r.Regex), nil
+	}
+	if len(r.Tags) > 0 {
+		tags, err := facts.getTags()
+		if err != nil {
+			return "", err
+		}
+		if reason := fieldMismatch("tag", r.Tags, tags); reason != "" {
+			return reason, nil
+		}
+	}
+	if len(r.Metadata) > 0 {
+		metadata, err := facts.getMetadata()
+		if err != nil {
+			return "", err
+		}
+		if reason := fieldMismatch("metadata", r.Metadata, metadata); reason != "" {
+			return reason, nil
+		}
+	}
+	return "", nil
+}
+
+// fieldMismatch returns why fields don't have the wanted values, or "" when
+// they do. A wanted value of "*" only requires the field to be present.
+func fieldMismatch(kind string, want, have map[string]string) string {
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := have[name]
+		switch {
+		case !ok:
+			return fmt.Sprintf("%s %s is missing", kind, name)
+		case want[name] != "*" && value != want[name]:
+			return fmt.Sprintf("%s %s is %q, want %q", kind, name, value, want[name])
+		}
+	}
+	return ""
+}
+
+// processKey processes an image with the profile of the first rule that
+// matches it, or with the run settings when none does
+func (ip *ImageProcessor) processKey(ctx context.Context, key string) error {
+	if ip.rules == nil {
+		return ip.processImage(ctx, key)
+	}
+	facts := &objectFacts{ctx: ctx, client: ip.s3Client, bucket: ip.sourceBucket, key: key}
+	rule, _, err := ip.rules.evaluate(strings.TrimPrefix(key, ip.sourcePrefix), facts)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate rules for %s: %v", key, err)
+	}
+	if rule == nil {
+		ip.logger.Printf("No rule matches %s, using the run settings", key)
+		return ip.processImage(ctx, key)
+	}
+
+	profile := ip.rules.Profiles[rule.Profile]
+	if profile.Watermark == WatermarkSkip {
+		return &skipError{reason: fmt.Sprintf("%s selects profile %s, which skips images", rule.Name, rule.Profile)}
+	}
+	ip.logger.Printf("%s matches %s, using profile %s", rule.Name, key, rule.Profile)
+	return ip.withProfile(rule.Profile, profile).processImage(ctx, key)
+}
+
+// withProfile returns a copy of the processor with a profile applied. A
+// replaced logo drops the dark variant of the run logo in its slot.
+func (ip *ImageProcessor) withProfile(name string, p *watermarkProfile) *ImageProcessor {
+	profiled := *ip
+	profiled.profile = name
+	profiled.unmarked = p.Watermark == WatermarkNone
+	if p.left != nil {
+		profiled.leftWatermark, profiled.leftDark = p.left, p.leftDark
+	}
+	if p.right != nil {
+		profiled.rightWatermark, profiled.rightDark = p.right, p.rightDark
+	}
+	if p.Text != nil {
+		profiled.textTemplate = *p.Text
+	}
+	if ip.provenance != nil {
+		provenance := *ip.provenance
+		provenance.settings.TextTemplate = profiled.textTemplate
+		provenance.watermarks = profiled.watermarkHashes()
+		profiled.provenance = &provenance
+	}
+	if len(p.Overrides) == 0 {
+		return &profiled
+	}
+	// Provenance records the profile rather than its overrides
+	overridden := profiled.withOverrides(p.Overrides)
+	overridden.overridden = nil
+	return overridden
+}
+
+// explainReport is the outcome of the explain command
+type explainReport struct {
+	Key     string            `json:"key"`
+	Rules   []ruleTrace       `json:"rules"`
+	Rule    string            `json:"rule,omitempty"`
+	Profile string            `json:"profile,omitempty"`
+	Applied *watermarkProfile `json:"settings,omitempty"`
+}
+
+// runExplain implements the explain command, which shows the rule and
+// profile a key would be processed with
+func runExplain(ctx context.Context, logger *log.Logger, args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: explain [-json] <key | s3://bucket/key>")
+	}
+	path := os.Getenv(EnvRulesPath)
+	if path == "" {
+		return fmt.Errorf("%s is not set", EnvRulesPath)
+	}
+	rules, err := loadRules(path)
+	if err != nil {
+		return err
+	}
+
+	bucket, key := os.Getenv(EnvBucket), flags.Arg(0)
+	if rest, ok := strings.CutPrefix(key, "s3://"); ok {
+		bucket, key, _ = strings.Cut(rest, "/")
+	}
+	facts := &objectFacts{ctx: ctx, bucket: bucket, key: key}
+	if bucket != "" {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to load SDK config: %v", err)
+		}
+		facts.client = s3.NewFromConfig(cfg)
+	} else {
+		// Without a bucket, rules with conditions see no tags or metadata
+		for _, r := range rules.Rules {
+			if len(r.Tags) > 0 || len(r.Metadata) > 0 {
+				logger.Printf("WARNING: %s is not set, tag and metadata conditions won't match", EnvBucket)
+				break
+			}
+		}
+		facts.tags, facts.metadata = map[string]string{}, map[string]string{}
+	}
+
+	report := &explainReport{Key: key}
+	rule, traces, err := rules.evaluate(strings.TrimPrefix(key, os.Getenv(EnvSourcePrefix)), facts)
+	report.Rules = traces
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		report.Rule = rule.Name
+		report.Profile = rule.Profile
+		report.Applied = rules.Profiles[rule.Profile]
+	}
+
+	if *asJSON {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+		return nil
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+// print writes a human readable report
+func (r *explainReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Key: %s\n", r.Key)
+	for _, trace := range r.Rules {
+		if trace.Matched {
+			fmt.Fprintf(w, "  %s: matched\n", trace.Rule)
+		} else {
+			fmt.Fprintf(w, "  %s: %s\n", trace.Rule, trace.Reason)
+		}
+	}
+	if r.Applied == nil {
+		fmt.Fprintf(w, "No rule matches, the run settings apply\n")
+		return
+	}
+
+	p := r.Applied
+	fmt.Fprintf(w, "Profile: %s\n", r.Profile)
+	watermark := p.Watermark
+	if watermark == "" {
+		watermark = WatermarkApply
+	}
+	fmt.Fprintf(w, "  watermark: %s\n", watermark)
+	for _, setting := range []struct{ name, value string }{
+		{"left watermark", p.LeftWatermark},
+		{"right watermark", p.RightWatermark},
+		{"left watermark dark", p.LeftWatermarkDark},
+		{"right watermark dark", p.RightWatermarkDark},
+	} {
+		if setting.value != "" {
+			fmt.Fprintf(w, "  %s: %s\n", setting.name, setting.value)
+		}
+	}
+	if p.Text != nil {
+		fmt.Fprintf(w, "  text: %q\n", *p.Text)
+	}
+	if len(p.Overrides) > 0 {
+		fmt.Fprintf(w, "  overrides: %s\n", p.Overrides)
+	}
+}
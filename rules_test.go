@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// writeRules writes a rules file, and a badge.png logo next to it
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := imaging.Save(solidImage(40, 20, color.White), filepath.Join(dir, "badge.png")); err != nil {
+		t.Fatalf("failed to write badge: %v", err)
+	}
+	path := filepath.Join(dir, "rules.json")
+	rules = strings.ReplaceAll(rules, "{dir}", dir)
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	return path
+}
+
+const testRules = `{
+	"profiles": {
+		"brand-a": {"text": "© Brand A {year}"},
+		"partner": {"left_watermark": "{dir}/badge.png", "right_watermark": "none", "overrides": {"watermark-opacity": "0.8"}},
+		"internal": {"watermark": "none"},
+		"embargo": {"watermark": "skip"}
+	},
+	"rules": [
+		{"name": "embargoed", "match": "**", "tags": {"embargo": "true"}, "profile": "embargo"},
+		{"name": "brand-a", "match": "brand-a/**", "profile": "brand-a"},
+		{"match": "partners/**/*.jpg", "metadata": {"Partner": "*"}, "profile": "partner"},
+		{"name": "internal", "regex": "^internal/", "profile": "internal"}
+	]
+}`
+
+func TestLoadRules(t *testing.T) {
+	rules, err := loadRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatalf("loadRules() error = %v", err)
+	}
+	if len(rules.Rules) != 4 || len(rules.Profiles) != 4 {
+		t.Fatalf("loadRules() = %d rules, %d profiles", len(rules.Rules), len(rules.Profiles))
+	}
+	if rules.Rules[2].Name != "rule 3" {
+		t.Errorf("loadRules() default name = %q, want %q", rules.Rules[2].Name, "rule 3")
+	}
+	if rules.Rules[2].Metadata["partner"] != "*" {
+		t.Errorf("loadRules() metadata keys = %v, want lowercase", rules.Rules[2].Metadata)
+	}
+
+	if err := rules.loadLogos(); err != nil {
+		t.Fatalf("loadLogos() error = %v", err)
+	}
+	partner := rules.Profiles["partner"]
+	if partner.left == nil || partner.left.Bounds().Dx() != 40 || partner.right == nil || partner.right.Bounds().Dx() != 1 {
+		t.Errorf("loadLogos() partner logos = %v, %v", partner.left, partner.right)
+	}
+
+	for name, data := range map[string]string{
+		"syntax":          `{"rules": [`,
+		"unknown field":   `{"profiles": {"a": {}}, "rules": [{"glob": "**", "profile": "a"}]}`,
+		"no rules":        `{"profiles": {"a": {}}, "rules": []}`,
+		"no pattern":      `{"profiles": {"a": {}}, "rules": [{"profile": "a"}]}`,
+		"both patterns":   `{"profiles": {"a": {}}, "rules": [{"match": "**", "regex": ".*", "profile": "a"}]}`,
+		"bad regex":       `{"profiles": {"a": {}}, "rules": [{"regex": "(", "profile": "a"}]}`,
+		"unknown profile": `{"profiles": {"a": {}}, "rules": [{"match": "**", "profile": "b"}]}`,
+		"watermark":       `{"profiles": {"a": {"watermark": "maybe"}}, "rules": [{"match": "**", "profile": "a"}]}`,
+		"missing logo":    `{"profiles": {"a": {"left_watermark": "{dir}/missing.png"}}, "rules": [{"match": "**", "profile": "a"}]}`,
+		"dark only":       `{"profiles": {"a": {"left_watermark_dark": "{dir}/badge.png"}}, "rules": [{"match": "**", "profile": "a"}]}`,
+		"skip override":   `{"profiles": {"a": {"overrides": {"watermark": "skip"}}}, "rules": [{"match": "**", "profile": "a"}]}`,
+		"bad override":    `{"profiles": {"a": {"overrides": {"watermark-opacity": "2"}}}, "rules": [{"match": "**", "profile": "a"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadRules(writeRules(t, data)); err == nil {
+				t.Errorf("loadRules(%s) expected error", data)
+			}
+		})
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, key string
+		want      bool
+	}{
+		{"brand-a/**", "brand-a/2024/beach.jpg", true},
+		{"brand-a/**", "brand-a-old/beach.jpg", false},
+		{"**/*.jpg", "beach.jpg", true},
+		{"**/*.jpg", "a/b/beach.jpg", true},
+		{"**/*.jpg", "a/b/beach.png", false},
+		{"partners/*.jpg", "partners/x/beach.jpg", false},
+		{"photo-?.jpg", "photo-1.jpg", true},
+		{"photo-?.jpg", "photo-12.jpg", false},
+		{"a+b/(1).jpg", "a+b/(1).jpg", true},
+	}
+	for _, tt := range tests {
+		if got := globRegexp(tt.glob).MatchString(tt.key); got != tt.want {
+			t.Errorf("glob %s matching %s = %v, want %v", tt.glob, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	rules, err := loadRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatalf("loadRules() error = %v", err)
+	}
+	facts := func(tags, metadata map[string]string) *objectFacts {
+		return &objectFacts{tags: tags, metadata: metadata}
+	}
+	none := map[string]string{}
+
+	tests := []struct {
+		key       string
+		facts     *objectFacts
+		want      string
+		evaluated int
+	}{
+		{"brand-a/beach.jpg", facts(none, none), "brand-a", 2},
+		{"brand-a/beach.jpg", facts(map[string]string{"embargo": "true"}, none), "embargoed", 1},
+		{"partners/acme/beach.jpg", facts(none, map[string]string{"partner": "acme"}), "rule 3", 3},
+		{"partners/acme/beach.jpg", facts(none, none), "", 4},
+		{"internal/beach.jpg", facts(none, none), "internal", 4},
+		{"other/beach.jpg", facts(none, none), "", 4},
+	}
+	for _, tt := range tests {
+		rule, traces, err := rules.evaluate(tt.key, tt.facts)
+		if err != nil {
+			t.Fatalf("evaluate(%s) error = %v", tt.key, err)
+		}
+		got := ""
+		if rule != nil {
+			got = rule.Name
+		}
+		if got != tt.want || len(traces) != tt.evaluated {
+			t.Errorf("evaluate(%s) = %q after %d rules, want %q after %d", tt.key, got, len(traces), tt.want, tt.evaluated)
+		}
+	}
+
+	// Rules without conditions never fetch facts
+	if _, _, err := rules.evaluate("brand-a/beach.jpg", &objectFacts{tags: none}); err != nil {
+		t.Errorf("evaluate() fetched metadata for a rule without conditions: %v", err)
+	}
+}
+
+func TestFieldMismatch(t *testing.T) {
+	have := map[string]string{"brand": "a", "license": "editorial"}
+	if reason := fieldMismatch("tag", map[string]string{"brand": "a", "license": "*"}, have); reason != "" {
+		t.Errorf("fieldMismatch() = %q, want match", reason)
+	}
+	if reason := fieldMismatch("tag", map[string]string{"brand": "b"}, have); reason != `tag brand is "a", want "b"` {
+		t.Errorf("fieldMismatch() = %q", reason)
+	}
+	if reason := fieldMismatch("metadata", map[string]string{"owner": "*"}, have); reason != "metadata owner is missing" {
+		t.Errorf("fieldMismatch() = %q", reason)
+	}
+}
+
+func TestWithProfile(t *testing.T) {
+	rules, err := loadRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatalf("loadRules() error = %v", err)
+	}
+	if err := rules.loadLogos(); err != nil {
+		t.Fatalf("loadLogos() error = %v", err)
+	}
+	logo := solidImage(100, 50, color.White)
+	ip := &ImageProcessor{
+		leftWatermark:  logo,
+		rightWatermark: logo,
+		leftDark:       logo,
+		rightDark:      logo,
+		textTemplate:   "© {year}",
+		provenance:     &provenanceConfig{settings: provenanceSettings{TextTemplate: "© {year}"}},
+		logger:         log.New(io.Discard, "", 0),
+	}
+
+	partner := ip.withProfile("partner", rules.Profiles["partner"])
+	if partner.leftWatermark.Bounds().Dx() != 40 || partner.leftDark != nil {
+		t.Errorf("withProfile() left logo = %v, dark %v, want the badge without a dark variant", partner.leftWatermark.Bounds(), partner.leftDark)
+	}
+	if partner.rightWatermark.Bounds().Dx() != 1 {
+		t.Errorf("withProfile() right logo = %v, want an empty slot", partner.rightWatermark.Bounds())
+	}
+	if partner.textTemplate != "© {year}" || partner.watermarkOpacity() != 0.8 || partner.overridden != nil {
+		t.Errorf("withProfile() text = %q, opacity %v, overrides %v", partner.textTemplate, partner.watermarkOpacity(), partner.overridden)
+	}
+	if partner.profile != "partner" || partner.provenance.watermarks["left"] == ip.provenance.watermarks["left"] {
+		t.Errorf("withProfile() profile = %q, provenance watermarks not updated", partner.profile)
+	}
+
+	brand := ip.withProfile("brand-a", rules.Profiles["brand-a"])
+	if brand.textTemplate != "© Brand A {year}" || brand.provenance.settings.TextTemplate != brand.textTemplate || brand.leftDark == nil {
+		t.Errorf("withProfile() brand-a = %q, provenance %q", brand.textTemplate, brand.provenance.settings.TextTemplate)
+	}
+	if ip.textTemplate != "© {year}" || ip.leftDark == nil || ip.provenance.settings.TextTemplate != "© {year}" {
+		t.Errorf("withProfile() changed the run settings")
+	}
+
+	// The internal profile leaves the pixels alone
+	internal := ip.withProfile("internal", rules.Profiles["internal"])
+	img := solidImage(400, 300, color.Black)
+	watermarked, err := internal.addWatermark(img, "text", "")
+	if err != nil {
+		t.Fatalf("addWatermark() error = %v", err)
+	}
+	if !bytes.Equal(imaging.Clone(watermarked).Pix, img.Pix) {
+		t.Errorf("addWatermark() with watermark none changed the image")
+	}
+}
+
+func TestExplainReportPrint(t *testing.T) {
+	text := ""
+	report := &explainReport{
+		Key: "partners/acme/beach.jpg",
+		Rules: []ruleTrace{
+			{Rule: "brand-a", Reason: "key doesn't match brand-a/**"},
+			{Rule: "partner", Matched: true},
+		},
+		Rule:    "partner",
+		Profile: "partner",
+		Applied: &watermarkProfile{LeftWatermark: "badge.png", RightWatermark: NoWatermark, Text: &text},
+	}
+	var buf bytes.Buffer
+	report.print(&buf)
+	for _, want := range []string{
+		"brand-a: key doesn't match brand-a/**",
+		"partner: matched",
+		"Profile: partner",
+		"watermark: apply",
+		"left watermark: badge.png",
+		"right watermark: none",
+		`text: ""`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("print() output missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	(&explainReport{Key: "other.jpg"}).print(&buf)
+	if !strings.Contains(buf.String(), "No rule matches") {
+		t.Errorf("print() without a match = %q", buf.String())
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EXIF tag groups usable in allow and deny lists
+const (
+	ExifGroupGPS      = "gps"      // The whole GPS IFD
+	ExifGroupPersonal = "personal" // Owner names, serial numbers and maker notes
+)
+
+// exifTagRef identifies a tag within an IFD. An empty IFD matches the tag in
+// any IFD, and anyTag matches every tag of the IFD.
+type exifTagRef struct {
+	ifd    string
+	tag    uint16
+	anyTag bool
+}
+
+// exifPersonalTags are removed by the personal group. Maker notes are
+// included because most cameras store serial numbers in them.
+var exifPersonalTags = []exifTagRef{
+	{ifd: "exif", tag: 0xA430}, // CameraOwnerName
+	{ifd: "exif", tag: 0xA431}, // BodySerialNumber
+	{ifd: "exif", tag: 0xA435}, // LensSerialNumber
+	{ifd: "exif", tag: 0x927C}, // MakerNote
+}
+
+// xmpPersonalProperties are the XMP counterparts of the personal tags, which
+// cameras and editors write in the exifEX and aux namespaces
+var xmpPersonalProperties = []struct {
+	name string
+	ref  exifTagRef
+}{
+	{"exifEX:CameraOwnerName", exifTagRef{ifd: "exif", tag: 0xA430}},
+	{"aux:OwnerName", exifTagRef{ifd: "exif", tag: 0xA430}},
+	{"exifEX:BodySerialNumber", exifTagRef{ifd: "exif", tag: 0xA431}},
+	{"aux:SerialNumber", exifTagRef{ifd: "exif", tag: 0xA431}},
+	{"exifEX:LensSerialNumber", exifTagRef{ifd: "exif", tag: 0xA435}},
+	{"aux:LensSerialNumber", exifTagRef{ifd: "exif", tag: 0xA435}},
+}
+
+// exifPolicy decides which EXIF entries are written to outputs
+type exifPolicy struct {
+	allow []exifTagRef // Empty means all tags are allowed
+	deny  []exifTagRef
+}
+
+// parseExifTagList parses a comma separated list of tag names, hex tag IDs
+// such as 0x927c and tag groups
+func parseExifTagList(value string) ([]exifTagRef, error) {
+	var refs []exifTagRef
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case strings.EqualFold(item, ExifGroupGPS):
+			refs = append(refs, exifTagRef{ifd: "gps", anyTag: true})
+		case strings.EqualFold(item, ExifGroupPersonal):
+			refs = append(refs, exifPersonalTags...)
+		case strings.HasPrefix(strings.ToLower(item), "0x"):
+			tag, err := strconv.ParseUint(item[2:], 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXIF tag ID: %s", item)
+			}
+			refs = append(refs, exifTagRef{tag: uint16(tag)})
+		default:
+			ref, ok := lookupExifTag(item)
+			if !ok {
+				return nil, fmt.Errorf("unknown EXIF tag: %s", item)
+			}
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// lookupExifTag finds a tag by its conventional name
+func lookupExifTag(name string) (exifTagRef, bool) {
+	for ifd, tags := range exifTagNames {
+		for tag, tagName := range tags {
+			if strings.EqualFold(tagName, name) {
+				return exifTagRef{ifd: ifd, tag: tag}, true
+			}
+		}
+	}
+	return exifTagRef{}, false
+}
+
+// parseExifPolicy builds the scrubbing policy from allow and deny lists
+func parseExifPolicy(allow, deny string) (*exifPolicy, error) {
+	allowRefs, err := parseExifTagList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", EnvExifAllowTags, err)
+	}
+	denyRefs, err := parseExifTagList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", EnvExifDenyTags, err)
+	}
+	return &exifPolicy{allow: allowRefs, deny: denyRefs}, nil
+}
+
+// validateScrubSettings checks the optional EXIF allow and deny lists
+func validateScrubSettings() error {
+	_, err := parseExifPolicy(os.Getenv(EnvExifAllowTags), os.Getenv(EnvExifDenyTags))
+	return err
+}
+
+// matches reports whether an entry is selected by refs
+func matches(refs []exifTagRef, ifd string, tag uint16) bool {
+	for _, ref := range refs {
+		if ref.ifd != "" && ref.ifd != ifd {
+			continue
+		}
+		if ref.anyTag || ref.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// keeps reports whether the policy keeps an entry. Denied tags always go,
+// and when an allow list is set only the listed tags stay.
+func (p *exifPolicy) keeps(ifd string, tag uint16) bool {
+	if matches(p.deny, ifd, tag) {
+		return false
+	}
+	if len(p.allow) > 0 && ifd != "interop" {
+		return matches(p.allow, ifd, tag)
+	}
+	return true
+}
+
+// apply removes the entries the policy doesn't keep and returns how many
+// were removed
+func (p *exifPolicy) apply(ex *exifData) int {
+	removed := 0
+	filter := func(ifd string, entries []exifEntry) []exifEntry {
+		var kept []exifEntry
+		for _, e := range entries {
+			isPointer := e.Tag == exifTagExifIFD || e.Tag == exifTagGPSIFD || e.Tag == exifTagInteropIFD
+			if isPointer || p.keeps(ifd, e.Tag) {
+				kept = append(kept, e)
+			} else {
+				removed++
+			}
+		}
+		return kept
+	}
+
+	ex.ifd0 = filter("ifd0", ex.ifd0)
+	ex.exif = filter("exif", ex.exif)
+	ex.gps = filter("gps", ex.gps)
+	ex.interop = filter("interop", ex.interop)
+	return removed
+}
+
+// xmpHasGPS reports whether an XMP packet contains a GPS position
+func xmpHasGPS(xmp []byte) bool {
+	return bytes.Contains(xmp, []byte("GPSLatitude")) || bytes.Contains(xmp, []byte("GPSLongitude"))
+}
+
+// xmpPersonal returns the personal properties of an XMP packet the policy
+// doesn't keep
+func (p *exifPolicy) xmpPersonal(xmp []byte) []string {
+	var found []string
+	for _, prop := range xmpPersonalProperties {
+		if bytes.Contains(xmp, []byte(prop.name)) && !p.keeps(prop.ref.ifd, prop.ref.tag) {
+			found = append(found, prop.name)
+		}
+	}
+	return found
+}
+
+// xmpHasPersonal reports whether an XMP packet contains owner names or serial
+// numbers
+func xmpHasPersonal(xmp []byte) bool {
+	for _, prop := range xmpPersonalProperties {
+		if bytes.Contains(xmp, []byte(prop.name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPersonal reports whether the EXIF data contains any of the personal tags
+func (ex *exifData) hasPersonal() bool {
+	for _, e := range ex.exif {
+		if matches(exifPersonalTags, "exif", e.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGPS reports whether the EXIF data contains a GPS position
+func (ex *exifData) hasGPS() bool {
+	for _, e := range ex.gps {
+		if e.Tag == 0x0002 || e.Tag == 0x0004 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPrivateEXIF returns EXIF data with GPS coordinates, an owner name and
+// a serial number
+func testPrivateEXIF(t *testing.T) *exifData {
+	raw := buildTestEXIF(
+		[]testIFDEntry{
+			{tag: 0x013B, typ: 2, count: 11, value: asciiValue("Jane Smith")},
+			{tag: 0x0110, typ: 2, count: 6, value: asciiValue("EOS R")},
+		},
+		[]testIFDEntry{
+			{tag: 0xA430, typ: 2, count: 5, value: asciiValue("Jane")},
+			{tag: 0xA431, typ: 2, count: 7, value: asciiValue("123456")},
+			{tag: 0x9003, typ: 2, count: 20, value: asciiValue("2024:05:01 12:30:00")},
+		},
+	)
+	ex, err := parseEXIF(raw)
+	if err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+	ex.gps = []exifEntry{
+		{Tag: 0x0001, Type: 2, Count: 2, Value: []byte("N\x00")},
+		{Tag: 0x0002, Type: 5, Count: 3, Value: make([]byte, 24)},
+		{Tag: 0x0003, Type: 2, Count: 2, Value: []byte("E\x00")},
+		{Tag: 0x0004, Type: 5, Count: 3, Value: make([]byte, 24)},
+	}
+	return ex
+}
+
+func TestExifPolicyDeny(t *testing.T) {
+	policy, err := parseExifPolicy("", "gps, personal")
+	if err != nil {
+		t.Fatalf("parseExifPolicy() error = %v", err)
+	}
+
+	ex := testPrivateEXIF(t)
+	if !ex.hasGPS() {
+		t.Fatal("hasGPS() = false before scrubbing")
+	}
+	if removed := policy.apply(ex); removed != 6 {
+		t.Errorf("apply() removed %d tags, want 6", removed)
+	}
+
+	// Scrubbed data must survive a round trip through the encoder
+	decoded, err := parseEXIF(ex.Encode())
+	if err != nil {
+		t.Fatalf("parseEXIF() of scrubbed data error = %v", err)
+	}
+	if decoded.hasGPS() || len(decoded.gps) > 0 {
+		t.Error("scrubbed EXIF still contains GPS data")
+	}
+	fields := decoded.Fields()
+	for _, name := range []string{"CameraOwnerName", "BodySerialNumber"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("scrubbed EXIF still contains %s", name)
+		}
+	}
+	for _, name := range []string{"Artist", "Model", "DateTimeOriginal"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("scrubbing removed %s", name)
+		}
+	}
+}
+
+func TestExifPolicyAllow(t *testing.T) {
+	policy, err := parseExifPolicy("Artist, 0x9003", "")
+	if err != nil {
+		t.Fatalf("parseExifPolicy() error = %v", err)
+	}
+
+	ex := testPrivateEXIF(t)
+	policy.apply(ex)
+
+	decoded, err := parseEXIF(ex.Encode())
+	if err != nil {
+		t.Fatalf("parseEXIF() of scrubbed data error = %v", err)
+	}
+	fields := decoded.Fields()
+	if len(fields) != 2 || fields["Artist"] == "" || fields["DateTimeOriginal"] == "" {
+		t.Errorf("allow list kept %v, want only Artist and DateTimeOriginal", fields)
+	}
+}
+
+func TestParseExifTagList(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"Empty", "", false},
+		{"Names", "Artist,Model", false},
+		{"Groups", "GPS,Personal", false},
+		{"Hex ID", "0x927c", false},
+		{"Unknown name", "Photographer", true},
+		{"Bad hex", "0xZZ", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseExifTagList(tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("parseExifTagList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestXMPHasGPS(t *testing.T) {
+	if !xmpHasGPS([]byte(`<rdf:Description exif:GPSLatitude="51,30.0N"/>`)) {
+		t.Error("xmpHasGPS() = false, want true")
+	}
+	if xmpHasGPS([]byte(`<rdf:Description dc:creator="Jane"/>`)) {
+		t.Error("xmpHasGPS() = true, want false")
+	}
+}
+
+func TestXMPPersonal(t *testing.T) {
+	xmp := []byte(`<rdf:Description aux:SerialNumber="123456" exifEX:CameraOwnerName="Jane" dc:creator="Jane"/>`)
+	if !xmpHasPersonal(xmp) {
+		t.Error("xmpHasPersonal() = false, want true")
+	}
+	if xmpHasPersonal([]byte(`<rdf:Description dc:creator="Jane"/>`)) {
+		t.Error("xmpHasPersonal() = true, want false")
+	}
+
+	tests := []struct {
+		allow, deny string
+		want        int
+	}{
+		{"", "personal", 2},
+		{"", "BodySerialNumber", 1},
+		{"", "gps", 0},
+		{"Artist, Model", "", 2},
+		{"CameraOwnerName", "", 1},
+	}
+	for _, tt := range tests {
+		policy, err := parseExifPolicy(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("parseExifPolicy() error = %v", err)
+		}
+		if got := policy.xmpPersonal(xmp); len(got) != tt.want {
+			t.Errorf("xmpPersonal() with allow %q, deny %q = %v, want %d properties", tt.allow, tt.deny, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedMetadataScrubsPersonalXMP(t *testing.T) {
+	policy, err := parseExifPolicy("", "personal")
+	if err != nil {
+		t.Fatalf("parseExifPolicy() error = %v", err)
+	}
+	ip := &ImageProcessor{exifPolicy: policy, report: &runReport{}, logger: log.New(io.Discard, "", 0)}
+	jpegData := buildTestJPEG(t, solidImage(16, 16, color.Black), nil)
+
+	meta := &imageMetadata{exif: testPrivateEXIF(t), xmp: []byte(`<rdf:Description aux:OwnerName="Jane" exifEX:BodySerialNumber="123456"/>`)}
+	embedded, err := ip.embedMetadata("owned.jpg", jpegData, FormatJPEG, meta)
+	if err != nil {
+		t.Fatalf("embedMetadata() error = %v", err)
+	}
+	if bytes.Contains(embedded, []byte("OwnerName")) || bytes.Contains(embedded, []byte("123456")) {
+		t.Error("embedMetadata() kept the owner name or serial number")
+	}
+
+	// A packet without personal properties is kept
+	meta = &imageMetadata{xmp: []byte(`<rdf:Description dc:creator="Jane"/>`)}
+	if embedded, err = ip.embedMetadata("plain.jpg", jpegData, FormatJPEG, meta); err != nil {
+		t.Fatalf("embedMetadata() error = %v", err)
+	}
+	if !bytes.Contains(embedded, []byte("dc:creator")) {
+		t.Error("embedMetadata() dropped XMP without personal properties")
+	}
+
+	if len(ip.report.Personal) != 1 || ip.report.Personal[0].Key != "owned.jpg" || !ip.report.Personal[0].Removed {
+		t.Errorf("report personal findings = %+v, want owned.jpg removed", ip.report.Personal)
+	}
+}
+
+func TestRunReportWrite(t *testing.T) {
+	report := &runReport{}
+	report.addGPS("b.jpg", true)
+	report.addGPS("a.jpg", false)
+	report.addPersonal("a.jpg", true)
+	// Derivatives and TIFF pages report the findings of their source again
+	report.addGPS("b.jpg", false)
+	report.addGPS("a.jpg", true)
+	report.addPersonal("a.jpg", true)
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := report.write(path); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var decoded struct {
+		GPS      []metadataFinding `json:"gps"`
+		Personal []metadataFinding `json:"personal"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Report is not valid JSON: %v", err)
+	}
+	if len(decoded.GPS) != 2 {
+		t.Errorf("report has %d GPS findings, want 2", len(decoded.GPS))
+	}
+	for _, finding := range decoded.GPS {
+		if finding.Removed {
+			t.Errorf("report GPS finding %+v, want not removed from every output", finding)
+		}
+	}
+	if len(decoded.Personal) != 1 || !decoded.Personal[0].Removed {
+		t.Errorf("report personal findings = %+v, want a.jpg removed", decoded.Personal)
+	}
+}
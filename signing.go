@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// S3 user metadata written with signed outputs
+const (
+	MetaSignature      = "signature"
+	MetaSignatureKeyID = "signature-key-id"
+	MetaSignatureAlg   = "signature-alg"
+	SignatureAlgorithm = "ed25519"
+)
+
+// signer signs output bytes with an Ed25519 key
+type signer struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// signingKeyID identifies a public key by the first 8 bytes of its SHA-256
+// fingerprint
+func signingKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadSigner reads a PEM encoded PKCS #8 Ed25519 private key
+func loadSigner(path string) (*signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("signing key %s is not a PEM encoded PKCS #8 private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %v", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return &signer{key: private, keyID: signingKeyID(private.Public().(ed25519.PublicKey))}, nil
+}
+
+// validateSigningSettings checks the optional signing key
+func validateSigningSettings() error {
+	if v := os.Getenv(EnvSigningKeyPath); v != "" {
+		if _, err := loadSigner(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadata signs data and returns the S3 user metadata carrying the signature
+func (s *signer) metadata(data []byte) map[string]string {
+	return map[string]string{
+		MetaSignature:      base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data)),
+		MetaSignatureKeyID: s.keyID,
+		MetaSignatureAlg:   SignatureAlgorithm,
+	}
+}
+
+// loadPublicKeys reads PEM encoded Ed25519 public keys, or private keys whose
+// public half is used, indexed by key ID
+func loadPublicKeys(paths []string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %v", path, err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("key %s is not PEM encoded", path)
+		}
+
+		var pub ed25519.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+			}
+			pub, _ = key.(ed25519.PublicKey)
+		case "PRIVATE KEY":
+			s, err := loadSigner(path)
+			if err != nil {
+				return nil, err
+			}
+			pub = s.key.Public().(ed25519.PublicKey)
+		}
+		if pub == nil {
+			return nil, fmt.Errorf("key %s is not an Ed25519 key", path)
+		}
+		keys[signingKeyID(pub)] = pub
+	}
+	return keys, nil
+}
+
+// verifySignature checks the signature metadata of an object against the
+// known public keys and returns the ID of the key that signed it
+func verifySignature(data []byte, metadata map[string]string, keys map[string]ed25519.PublicKey) (string, error) {
+	encoded := metadata[MetaSignature]
+	if encoded == "" {
+		return "", fmt.Errorf("no signature found")
+	}
+	if alg := metadata[MetaSignatureAlg]; alg != "" && alg != SignatureAlgorithm {
+		return "", fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %v", err)
+	}
+
+	keyID := metadata[MetaSignatureKeyID]
+	pub, ok := keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("signed with unknown key %q", keyID)
+	}
+	if !ed25519.Verify(pub, data, signature) {
+		return "", fmt.Errorf("signature does not match, the image was modified or re-encoded")
+	}
+	return keyID, nil
+}
+
+// runVerifySignature implements the verify-signature command
+func runVerifySignature(ctx context.Context, logger *log.Logger, args []string) error {
+	flags := flag.NewFlagSet("verify-signature", flag.ContinueOnError)
+	keyPaths := flags.String("key", os.Getenv(EnvSigningKeyPath), "comma separated public (or private) key files")
+	signature := flags.String("signature", "", "base64 signature, for local files")
+	keyID := flags.String("key-id", "", "ID of the signing key, for local files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *keyPaths == "" {
+		return fmt.Errorf("usage: verify-signature -key pub.pem[,pub2.pem] [-signature sig -key-id id] <file | s3://bucket/key | key>")
+	}
+	source := flags.Arg(0)
+
+	keys, err := loadPublicKeys(strings.Split(*keyPaths, ","))
+	if err != nil {
+		return err
+	}
+	data, metadata, err := readVerifySource(ctx, source)
+	if err != nil {
+		return err
+	}
+	if *signature != "" {
+		metadata = map[string]string{MetaSignature: *signature, MetaSignatureKeyID: *keyID}
+	}
+
+	signedBy, err := verifySignature(data, metadata, keys)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	logger.Printf("%s: valid signature by key %s", source, signedBy)
+	fmt.Printf("%s: OK (key %s)\n", source, signedBy)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestKeys writes a PEM private and public key pair and returns their paths
+func writeTestKeys(t *testing.T) (string, string) {
+	pub, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "signing.pem")
+	pubPath := filepath.Join(dir, "signing.pub.pem")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o644); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privatePath, pubPath
+}
+
+func TestSignAndVerify(t *testing.T) {
+	privatePath, pubPath := writeTestKeys(t)
+	_, otherPubPath := writeTestKeys(t)
+
+	s, err := loadSigner(privatePath)
+	if err != nil {
+		t.Fatalf("loadSigner() error = %v", err)
+	}
+	data := []byte("watermarked image bytes")
+	metadata := s.metadata(data)
+
+	keys, err := loadPublicKeys([]string{pubPath})
+	if err != nil {
+		t.Fatalf("loadPublicKeys() error = %v", err)
+	}
+	otherKeys, err := loadPublicKeys([]string{otherPubPath})
+	if err != nil {
+		t.Fatalf("loadPublicKeys() error = %v", err)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name     string
+		data     []byte
+		metadata map[string]string
+		keys     map[string]ed25519.PublicKey
+		wantErr  bool
+	}{
+		{"Valid", data, metadata, keys, false},
+		{"Modified bytes", tampered, metadata, keys, true},
+		{"Unknown key", data, metadata, otherKeys, true},
+		{"Unsigned", data, nil, keys, true},
+		{"Wrong algorithm", data, map[string]string{MetaSignature: metadata[MetaSignature], MetaSignatureKeyID: s.keyID, MetaSignatureAlg: "rsa"}, keys, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyID, err := verifySignature(tt.data, tt.metadata, tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifySignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && keyID != s.keyID {
+				t.Errorf("verifySignature() key ID = %s, want %s", keyID, s.keyID)
+			}
+		})
+	}
+}
+
+func TestLoadSignerRejectsPublicKey(t *testing.T) {
+	_, pubPath := writeTestKeys(t)
+	if _, err := loadSigner(pubPath); err == nil {
+		t.Error("loadSigner() accepted a public key")
+	}
+}
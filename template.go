@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// templateVars holds the values available to text watermark templates
+type templateVars map[string]string
+
+// newTemplateVars builds the template variables for a single image. Values
+// from the object key and run take precedence, then user metadata, object
+// tags and EXIF fields are exposed both with their meta., tag. and exif.
+// prefixes and as bare names.
+func newTemplateVars(bucket, key string, runTime time.Time, metadata, tags, exif map[string]string) templateVars {
+	ext := path.Ext(key)
+	vars := templateVars{
+		"bucket":   bucket,
+		"key":      key,
+		"filename": path.Base(key),
+		"name":     strings.TrimSuffix(path.Base(key), ext),
+		"ext":      strings.TrimPrefix(ext, "."),
+		"dir":      path.Dir(key),
+		"date":     runTime.Format("2006-01-02"),
+		"datetime": runTime.Format(time.RFC3339),
+		"year":     runTime.Format("2006"),
+		"month":    runTime.Format("01"),
+		"day":      runTime.Format("02"),
+	}
+
+	for _, src := range []struct {
+		prefix string
+		values map[string]string
+	}{
+		{"meta.", metadata},
+		{"tag.", tags},
+		{"exif.", exif},
+	} {
+		for k, v := range src.values {
+			vars[src.prefix+k] = v
+			if _, exists := vars[k]; !exists {
+				vars[k] = v
+			}
+		}
+	}
+	return vars
+}
+
+// renderTemplate expands {name} and {name|default} placeholders in tmpl.
+// Unknown variables without a default expand to an empty string and "{{"
+// produces a literal brace.
+func renderTemplate(tmpl string, vars templateVars) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			out.WriteString(tmpl)
+			break
+		}
+		out.WriteString(tmpl[:start])
+		tmpl = tmpl[start+1:]
+
+		if strings.HasPrefix(tmpl, "{") {
+			out.WriteByte('{')
+			tmpl = tmpl[1:]
+			continue
+		}
+
+		end := strings.IndexByte(tmpl, '}')
+		if end < 0 {
+			// Unterminated placeholder, keep it verbatim
+			out.WriteByte('{')
+			out.WriteString(tmpl)
+			break
+		}
+
+		name, fallback, _ := strings.Cut(tmpl[:end], "|")
+		if value := vars[strings.TrimSpace(name)]; value != "" {
+			out.WriteString(value)
+		} else {
+			out.WriteString(fallback)
+		}
+		tmpl = tmpl[end+1:]
+	}
+	return out.String()
+}
+
+// templateUsesTags reports whether a template references object tags, which
+// cost an extra S3 request per image
+func templateUsesTags(tmpl string) bool {
+	return strings.Contains(tmpl, "{tag.")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	vars := templateVars{
+		"key":          "photos/beach.jpg",
+		"photographer": "Jane Smith",
+		"year":         "2024",
+	}
+
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"Plain text", "Hello", "Hello"},
+		{"Variables", "© {photographer} {year} — {key}", "© Jane Smith 2024 — photos/beach.jpg"},
+		{"Unknown variable", "by {author}", "by "},
+		{"Default value", "by {author|Unknown}", "by Unknown"},
+		{"Default unused", "by {photographer|Unknown}", "by Jane Smith"},
+		{"Escaped brace", "{{literal}", "{literal}"},
+		{"Unterminated", "oops {key", "oops {key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderTemplate(tt.tmpl, vars); got != tt.want {
+				t.Errorf("renderTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTemplateVars(t *testing.T) {
+	runTime := time.Date(2024, 12, 30, 15, 47, 3, 0, time.UTC)
+	vars := newTemplateVars("bucket", "source/photos/beach.jpg", runTime,
+		map[string]string{"photographer": "Jane", "key": "shadowed"},
+		map[string]string{"license": "CC-BY"},
+		map[string]string{"Artist": "J. Smith"},
+	)
+
+	want := map[string]string{
+		"bucket":       "bucket",
+		"key":          "source/photos/beach.jpg",
+		"filename":     "beach.jpg",
+		"name":         "beach",
+		"ext":          "jpg",
+		"dir":          "source/photos",
+		"date":         "2024-12-30",
+		"year":         "2024",
+		"photographer": "Jane",
+		"meta.key":     "shadowed",
+		"tag.license":  "CC-BY",
+		"license":      "CC-BY",
+		"exif.Artist":  "J. Smith",
+		"Artist":       "J. Smith",
+	}
+	for name, value := range want {
+		if vars[name] != value {
+			t.Errorf("vars[%s] = %q, want %q", name, vars[name], value)
+		}
+	}
+}
+
+func TestTemplateUsesTags(t *testing.T) {
+	if !templateUsesTags("© {tag.owner}") {
+		t.Error("templateUsesTags() = false, want true")
+	}
+	if templateUsesTags("© {photographer}") {
+		t.Error("templateUsesTags() = true, want false")
+	}
+}
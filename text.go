@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// anchor names a position on the image where a watermark is placed
+type anchor string
+
+const (
+	anchorTopLeft      anchor = "top-left"
+	anchorTopCenter    anchor = "top-center"
+	anchorTopRight     anchor = "top-right"
+	anchorCenter       anchor = "center"
+	anchorBottomLeft   anchor = "bottom-left"
+	anchorBottomCenter anchor = "bottom-center"
+	anchorBottomRight  anchor = "bottom-right"
+)
+
+// parseAnchor validates an anchor name
+func parseAnchor(s string) (anchor, error) {
+	switch a := anchor(strings.ToLower(strings.TrimSpace(s))); a {
+	case anchorTopLeft, anchorTopCenter, anchorTopRight, anchorCenter,
+		anchorBottomLeft, anchorBottomCenter, anchorBottomRight:
+		return a, nil
+	}
+	return "", fmt.Errorf("invalid watermark position: %s", s)
+}
+
+// anchorPoint returns the top-left point at which an overlay of the given size
+// is drawn so that it sits at the anchor, inset by padding
+func anchorPoint(a anchor, bounds image.Rectangle, size image.Point, padding int) image.Point {
+	x := bounds.Min.X + (bounds.Dx()-size.X)/2
+	y := bounds.Min.Y + (bounds.Dy()-size.Y)/2
+
+	switch a {
+	case anchorTopLeft, anchorBottomLeft:
+		x = bounds.Min.X + padding
+	case anchorTopRight, anchorBottomRight:
+		x = bounds.Max.X - size.X - padding
+	}
+	switch a {
+	case anchorTopLeft, anchorTopCenter, anchorTopRight:
+		y = bounds.Min.Y + padding
+	case anchorBottomLeft, anchorBottomCenter, anchorBottomRight:
+		y = bounds.Max.Y - size.Y - padding
+	}
+	return image.Pt(x, y)
+}
+
+// parseHexColor parses #RGB, #RRGGBB or #RRGGBBAA colors
+func parseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// loadFont loads a TrueType/OpenType font from a file, falling back to the
+// bundled Go Regular font when path is empty
+func loadFont(path string) (*opentype.Font, error) {
+	if path == "" {
+		return opentype.Parse(goregular.TTF)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read font %s: %v", path, err)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// renderText renders a single line of text onto a transparent image sized to
+// fit it, with a soft shadow so it stays legible on any background
+func renderText(f *opentype.Font, size float64, text string, col color.NRGBA) (*image.NRGBA, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create font face: %v", err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := int(size/16) + 1
+	width := font.MeasureString(face, text).Ceil() + shadow
+	height := (metrics.Ascent + metrics.Descent).Ceil() + shadow
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	drawer := &font.Drawer{
+		Dst:  img,
+		Face: face,
+	}
+	baseline := metrics.Ascent.Ceil()
+
+	drawer.Src = image.NewUniform(color.NRGBA{A: col.A / 2})
+	drawer.Dot = fixed.P(shadow, baseline+shadow)
+	drawer.DrawString(text)
+
+	drawer.Src = image.NewUniform(col)
+	drawer.Dot = fixed.P(0, baseline)
+	drawer.DrawString(text)
+
+	return img, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseAnchor(t *testing.T) {
+	if got, err := parseAnchor(" Bottom-Center "); err != nil || got != anchorBottomCenter {
+		t.Errorf("parseAnchor() = %v, %v, want %v", got, err, anchorBottomCenter)
+	}
+	if _, err := parseAnchor("middle"); err == nil {
+		t.Error("parseAnchor() expected error for invalid anchor")
+	}
+}
+
+func TestAnchorPoint(t *testing.T) {
+	bounds := image.Rect(0, 0, 800, 600)
+	size := image.Pt(100, 50)
+
+	tests := []struct {
+		anchor anchor
+		want   image.Point
+	}{
+		{anchorTopLeft, image.Pt(20, 20)},
+		{anchorTopCenter, image.Pt(350, 20)},
+		{anchorTopRight, image.Pt(680, 20)},
+		{anchorCenter, image.Pt(350, 275)},
+		{anchorBottomLeft, image.Pt(20, 530)},
+		{anchorBottomCenter, image.Pt(350, 530)},
+		{anchorBottomRight, image.Pt(680, 530)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.anchor), func(t *testing.T) {
+			if got := anchorPoint(tt.anchor, bounds, size, 20); got != tt.want {
+				t.Errorf("anchorPoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{"#FFF", color.NRGBA{255, 255, 255, 255}, false},
+		{"#102030", color.NRGBA{16, 32, 48, 255}, false},
+		{"10203080", color.NRGBA{16, 32, 48, 128}, false},
+		{"#12", color.NRGBA{}, true},
+		{"#GGGGGG", color.NRGBA{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseHexColor(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHexColor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseHexColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	f, err := loadFont("")
+	if err != nil {
+		t.Fatalf("loadFont() error = %v", err)
+	}
+
+	img, err := renderText(f, 24, "© Test 2024", color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	if err != nil {
+		t.Fatalf("renderText() error = %v", err)
+	}
+	if img.Bounds().Dx() == 0 || img.Bounds().Dy() < 24 {
+		t.Fatalf("renderText() image too small: %v", img.Bounds())
+	}
+
+	opaque := 0
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] > 0 {
+			opaque++
+		}
+	}
+	if opaque == 0 {
+		t.Error("renderText() produced no visible pixels")
+	}
+}
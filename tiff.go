@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/tiff"
+)
+
+// Multi-page TIFF handling
+const (
+	TIFFPagesFirst = "first" // Only the first page is processed
+	TIFFPagesAll   = "all"   // Every page becomes its own output
+)
+
+// TIFF tags holding XMP and ICC profiles in IFD0
+const (
+	tiffTagXMP = 0x02BC
+	tiffTagICC = 0x8773
+)
+
+// maxTIFFPages guards against IFD chains that loop
+const maxTIFFPages = 1000
+
+// isTIFF reports whether data starts with a TIFF header
+func isTIFF(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*"))
+}
+
+// isBMP reports whether data starts with a BMP header
+func isBMP(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("BM"))
+}
+
+// validateTIFFSettings checks the optional multi-page TIFF setting
+func validateTIFFSettings() error {
+	switch v := os.Getenv(EnvTIFFPages); v {
+	case "", TIFFPagesFirst, TIFFPagesAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid %s: %s (must be %s or %s)", EnvTIFFPages, v, TIFFPagesFirst, TIFFPagesAll)
+	}
+}
+
+// tiffOrder returns the byte order of a TIFF file
+func tiffOrder(data []byte) binary.ByteOrder {
+	if data[0] == 'M' {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// tiffIFDs returns the offsets of the IFDs of every page of a TIFF file
+func tiffIFDs(data []byte) []uint32 {
+	if len(data) < 8 || !isTIFF(data) {
+		return nil
+	}
+	order := tiffOrder(data)
+
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	offset := order.Uint32(data[4:])
+	for offset != 0 && !seen[offset] && len(offsets) < maxTIFFPages {
+		if int(offset)+2 > len(data) {
+			break
+		}
+		next := int(offset) + 2 + int(order.Uint16(data[offset:]))*12
+		if next+4 > len(data) {
+			break
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+		offset = order.Uint32(data[next:])
+	}
+	return offsets
+}
+
+// decodeTIFFPage decodes the page whose IFD is at offset, by pointing the
+// header at it, and rotates it upright according to its orientation tag
+func decodeTIFFPage(data []byte, offset uint32) (image.Image, error) {
+	page := append([]byte(nil), data...)
+	tiffOrder(page).PutUint32(page[4:], offset)
+
+	img, err := tiff.Decode(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	if ex, err := parseEXIF(page); err == nil {
+		if orientation, err := strconv.Atoi(ex.Fields()["Orientation"]); err == nil {
+			img = applyOrientation(img, orientation)
+		}
+	}
+	return img, nil
+}
+
+// applyOrientation rotates and flips an image according to an EXIF
+// orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// extractTIFFMetadata reads the descriptive EXIF tags, XMP and ICC profile
+// of the first page of a TIFF file. Tags describing the TIFF image data are
+// dropped since they don't apply to the output.
+func extractTIFFMetadata(data []byte) (*imageMetadata, error) {
+	ex, err := parseEXIF(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TIFF tags: %v", err)
+	}
+
+	meta := &imageMetadata{exif: ex}
+	var ifd0 []exifEntry
+	for _, e := range ex.ifd0 {
+		switch {
+		case e.Tag == tiffTagXMP:
+			meta.xmp = e.Value
+		case e.Tag == tiffTagICC:
+			meta.icc = e.Value
+		case e.Tag == exifTagExifIFD, e.Tag == exifTagGPSIFD, exifTagNames["ifd0"][e.Tag] != "":
+			ifd0 = append(ifd0, e)
+		}
+	}
+	ex.ifd0 = ifd0
+	return meta, nil
+}
+
+// pageKey inserts a page number before the extension of a key
+func pageKey(key string, page int) string {
+	ext := path.Ext(key)
+	return fmt.Sprintf("%s-page%d%s", strings.TrimSuffix(key, ext), page, ext)
+}
+
+// processPages watermarks every page of a multi-page TIFF and stores each as
+// its own output named <name>-page<N>. The page number is available to
+// templates as {page}.
+func (ip *ImageProcessor) processPages(ctx context.Context, source *processedImage, pages []uint32, vars templateVars, meta *imageMetadata) error {
+	startTime := time.Now()
+	ip.logger.Printf("Processing %d pages of TIFF: %s", len(pages), source.key)
+
+	for i, offset := range pages {
+		img, err := decodeTIFFPage(source.data, offset)
+		if err != nil {
+			return fmt.Errorf("failed to decode page %d of %s: %v", i+1, source.key, err)
+		}
+
+		text, qrURL, payload := source.text, source.qrURL, ""
+		if vars != nil {
+			vars["page"] = strconv.Itoa(i + 1)
+			if ip.textTemplate != "" {
+				text = renderTemplate(ip.textTemplate, vars)
+			}
+			if ip.qr != nil {
+				qrURL = renderTemplate(ip.qr.template, vars)
+			}
+		}
+		if ip.hiddenPayload != "" {
+			payload = renderTemplate(ip.hiddenPayload, vars)
+		}
+
+		// Every page starts from the source metadata, which encoding scrubs
+		out := *source
+		out.text = text
+		out.qrURL = qrURL
+		out.payload = payload
+		out.page = i + 1
+		if err := ip.storeImage(ctx, &out, img, meta.clone()); err != nil {
+			return err
+		}
+	}
+
+	ip.logger.Printf("Successfully processed %d pages of %s in %v", len(pages), source.key, time.Since(startTime))
+	return nil
+}
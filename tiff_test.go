@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"sort"
+	"testing"
+)
+
+// buildTestTIFF writes an uncompressed little endian RGB TIFF with one page
+// per image. The first page gets the given orientation and an Artist tag.
+func buildTestTIFF(pages []*image.NRGBA, orientation uint16) []byte {
+	order := binary.LittleEndian
+	data := []byte("II*\x00\x00\x00\x00\x00")
+	nextPointer := 4
+
+	for i, img := range pages {
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		pixels := make([]byte, 0, w*h*3)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := img.NRGBAAt(x, y)
+				pixels = append(pixels, c.R, c.G, c.B)
+			}
+		}
+		pixelOffset := len(data)
+		data = append(data, pixels...)
+		bitsOffset := len(data)
+		data = append(data, 8, 0, 8, 0, 8, 0)
+		artistOffset := len(data)
+		data = append(data, "Jane Smith\x00"...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+
+		entries := [][3]uint32{ // tag, type, value
+			{256, 4, uint32(w)},
+			{257, 4, uint32(h)},
+			{258, 3, uint32(bitsOffset)},
+			{259, 3, 1},
+			{262, 3, 2},
+			{273, 4, uint32(pixelOffset)},
+			{277, 3, 3},
+			{278, 4, uint32(h)},
+			{279, 4, uint32(len(pixels))},
+		}
+		if i == 0 {
+			entries = append(entries, [3]uint32{274, 3, uint32(orientation)}, [3]uint32{315, 2, uint32(artistOffset)})
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a][0] < entries[b][0] })
+
+		ifdOffset := len(data)
+		order.PutUint32(data[nextPointer:], uint32(ifdOffset))
+		data = order.AppendUint16(data, uint16(len(entries)))
+		for _, e := range entries {
+			count := uint32(1)
+			switch e[0] {
+			case 258:
+				count = 3
+			case 315:
+				count = 11
+			}
+			data = order.AppendUint16(data, uint16(e[0]))
+			data = order.AppendUint16(data, uint16(e[1]))
+			data = order.AppendUint32(data, count)
+			if e[1] == 3 && count == 1 {
+				data = order.AppendUint16(data, uint16(e[2]))
+				data = append(data, 0, 0)
+			} else {
+				data = order.AppendUint32(data, e[2])
+			}
+		}
+		nextPointer = len(data)
+		data = append(data, 0, 0, 0, 0)
+	}
+	return data
+}
+
+func TestTIFFPages(t *testing.T) {
+	red := solidImage(40, 20, color.NRGBA{R: 255, A: 255})
+	blue := solidImage(30, 30, color.NRGBA{B: 255, A: 255})
+	data := buildTestTIFF([]*image.NRGBA{red, blue}, 1)
+
+	if sniffFormat(data) != "tiff" {
+		t.Fatalf("sniffFormat() = %q, want tiff", sniffFormat(data))
+	}
+	pages := tiffIFDs(data)
+	if len(pages) != 2 {
+		t.Fatalf("tiffIFDs() returned %d pages, want 2", len(pages))
+	}
+
+	for i, want := range []struct {
+		size image.Point
+		col  color.NRGBA
+	}{
+		{image.Pt(40, 20), color.NRGBA{R: 255, A: 255}},
+		{image.Pt(30, 30), color.NRGBA{B: 255, A: 255}},
+	} {
+		img, err := decodeTIFFPage(data, pages[i])
+		if err != nil {
+			t.Fatalf("decodeTIFFPage(%d) error = %v", i, err)
+		}
+		if img.Bounds().Size() != want.size {
+			t.Errorf("page %d size = %v, want %v", i, img.Bounds().Size(), want.size)
+		}
+		if c := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X, img.Bounds().Min.Y)); c != want.col {
+			t.Errorf("page %d color = %v, want %v", i, c, want.col)
+		}
+	}
+}
+
+func TestDecodeTIFFOrientation(t *testing.T) {
+	data := buildTestTIFF([]*image.NRGBA{solidImage(40, 20, color.White)}, 6)
+	img, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("decodeImage() error = %v", err)
+	}
+	if img.Bounds().Size() != image.Pt(20, 40) {
+		t.Errorf("decodeImage() size = %v, want 20x40 after rotation", img.Bounds().Size())
+	}
+}
+
+func TestExtractTIFFMetadata(t *testing.T) {
+	data := buildTestTIFF([]*image.NRGBA{solidImage(8, 8, color.White)}, 1)
+	meta, err := extractMetadata(data)
+	if err != nil {
+		t.Fatalf("extractMetadata() error = %v", err)
+	}
+	if meta.exif == nil || meta.exif.Fields()["Artist"] != "Jane Smith" {
+		t.Fatalf("extractMetadata() did not read the Artist tag")
+	}
+	for _, e := range meta.exif.ifd0 {
+		if e.Tag == 273 || e.Tag == 256 {
+			t.Errorf("extractMetadata() kept TIFF image data tag %d", e.Tag)
+		}
+	}
+}
+
+func TestPageKey(t *testing.T) {
+	ip := &ImageProcessor{}
+	if got := ip.outputKey(pageKey("processed/master.tif", 2), FormatJPEG); got != "processed/master-page2.jpg" {
+		t.Errorf("page output key = %s, want processed/master-page2.jpg", got)
+	}
+	if got := ip.outputKey("processed/scan.bmp", FormatWebP); got != "processed/scan.webp" {
+		t.Errorf("BMP output key = %s, want processed/scan.webp", got)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermark modes
+const (
+	ModeCorners = "corners" // Logos in the bottom corners
+	ModeTiled   = "tiled"   // A single watermark repeated across the image
+	ModeBar     = "bar"     // Logos and text in a bar added below the image
+	ModeFrame   = "frame"   // Like bar, with a border around the other sides
+)
+
+// Tile sources
+const (
+	TileSourceLeft  = "left"
+	TileSourceRight = "right"
+	TileSourceText  = "text"
+)
+
+// validateTileSettings checks the optional watermark mode and tiling settings
+func validateTileSettings() error {
+	switch mode := os.Getenv(EnvWatermarkMode); mode {
+	case "", ModeCorners, ModeTiled, ModeBar, ModeFrame:
+	default:
+		return fmt.Errorf("invalid watermark mode: %s", mode)
+	}
+
+	switch source := os.Getenv(EnvTileSource); source {
+	case "", TileSourceLeft, TileSourceRight:
+	case TileSourceText:
+		if os.Getenv(EnvWatermarkText) == "" {
+			return fmt.Errorf("%s=%s requires %s to be set", EnvTileSource, source, EnvWatermarkText)
+		}
+	default:
+		return fmt.Errorf("invalid tile source: %s", source)
+	}
+
+	if v := os.Getenv(EnvTileAngle); v != "" {
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%s must be a number: %s", EnvTileAngle, v)
+		}
+	}
+	if v := os.Getenv(EnvTileSpacing); v != "" {
+		if spacing, err := strconv.Atoi(v); err != nil || spacing < 0 {
+			return fmt.Errorf("%s must be a non-negative integer: %s", EnvTileSpacing, v)
+		}
+	}
+	if v := os.Getenv(EnvTileOpacity); v != "" {
+		if opacity, err := strconv.ParseFloat(v, 64); err != nil || opacity <= 0 || opacity > 1 {
+			return fmt.Errorf("%s must be between 0 and 1: %s", EnvTileOpacity, v)
+		}
+	}
+	return nil
+}
+
+// addTiledWatermark repeats the configured tile source across the whole image
+func (ip *ImageProcessor) addTiledWatermark(img *image.NRGBA, text string) (*image.NRGBA, error) {
+	var tile image.Image
+	switch ip.tileSource {
+	case TileSourceText:
+		if text == "" {
+			ip.logger.Printf("Text watermark is empty, skipping tiled watermark")
+			return img, nil
+		}
+		textImg, err := renderText(ip.textFont, ip.textSize, text, ip.textColor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render text watermark: %v", err)
+		}
+		tile = textImg
+	case TileSourceRight:
+		tile = ip.selectVariant("right", img, ip.rightWatermark, ip.rightDark, img.Bounds())
+	default:
+		tile = ip.selectVariant("left", img, ip.leftWatermark, ip.leftDark, img.Bounds())
+	}
+
+	if tile.Bounds().Dy() > MaxWatermarkHeight {
+		tile = imaging.Resize(tile, 0, MaxWatermarkHeight, imaging.Lanczos)
+	}
+
+	watermarked := tileWatermark(img, tile, ip.tileAngle, ip.tileSpacing, ip.tileOpacity)
+	ip.logger.Printf("Added tiled %s watermark at %.1f degrees, spacing %dpx, opacity %.2f",
+		ip.tileSource, ip.tileAngle, ip.tileSpacing, ip.tileOpacity)
+
+	if text != "" && ip.tileSource != TileSourceText {
+		return ip.addTextWatermark(watermarked, text)
+	}
+	return watermarked, nil
+}
+
+// tileWatermark overlays copies of tile rotated by angle degrees across the
+// whole image in a staggered grid with spacing pixels between copies
+func tileWatermark(img *image.NRGBA, tile image.Image, angle float64, spacing int, opacity float64) *image.NRGBA {
+	if angle != 0 {
+		tile = imaging.Rotate(tile, angle, color.Transparent)
+	}
+
+	bounds := img.Bounds()
+	stepX := tile.Bounds().Dx() + spacing
+	stepY := tile.Bounds().Dy() + spacing
+	if stepX <= 0 || stepY <= 0 {
+		return img
+	}
+
+	// Draw all copies onto a single layer so the opacity is applied once
+	layer := image.NewNRGBA(bounds)
+	for row, y := 0, bounds.Min.Y-stepY/2; y < bounds.Max.Y; row, y = row+1, y+stepY {
+		offset := (row % 2) * stepX / 2
+		for x := bounds.Min.X - stepX + offset; x < bounds.Max.X; x += stepX {
+			r := image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x, y).Add(tile.Bounds().Size())}
+			draw.Draw(layer, r, tile, tile.Bounds().Min, draw.Over)
+		}
+	}
+
+	return imaging.Overlay(img, layer, bounds.Min, opacity)
+}
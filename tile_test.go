@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTileWatermark(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	tile := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			tile.Set(x, y, color.NRGBA{A: 255})
+		}
+	}
+
+	result := tileWatermark(img, tile, 30, 20, 0.5)
+	if result.Bounds() != img.Bounds() {
+		t.Fatalf("tileWatermark() bounds = %v, want %v", result.Bounds(), img.Bounds())
+	}
+
+	// Every quadrant of the image should contain part of a tile
+	quadrants := []image.Rectangle{
+		image.Rect(0, 0, 200, 150),
+		image.Rect(200, 0, 400, 150),
+		image.Rect(0, 150, 200, 300),
+		image.Rect(200, 150, 400, 300),
+	}
+	for _, q := range quadrants {
+		marked := false
+		for x := q.Min.X; x < q.Max.X && !marked; x++ {
+			for y := q.Min.Y; y < q.Max.Y; y++ {
+				if c := result.NRGBAAt(x, y); c.R < 200 {
+					marked = true
+					break
+				}
+			}
+		}
+		if !marked {
+			t.Errorf("tileWatermark() left quadrant %v unmarked", q)
+		}
+	}
+
+	// Opacity should keep the underlying image visible through the tiles
+	for i := 0; i < len(result.Pix); i += 4 {
+		if result.Pix[i] < 100 {
+			t.Fatalf("tileWatermark() pixel darker than opacity allows: %d", result.Pix[i])
+		}
+	}
+}
+
+func TestValidateTileSettings(t *testing.T) {
+	envVars := []string{EnvWatermarkMode, EnvTileSource, EnvTileAngle, EnvTileSpacing, EnvTileOpacity, EnvWatermarkText}
+	savedEnv := make(map[string]string)
+	for _, env := range envVars {
+		savedEnv[env] = os.Getenv(env)
+	}
+	defer func() {
+		for env, value := range savedEnv {
+			if value != "" {
+				os.Setenv(env, value)
+			} else {
+				os.Unsetenv(env)
+			}
+		}
+	}()
+
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		errContains string
+	}{
+		{"Defaults", map[string]string{}, ""},
+		{"Tiled text", map[string]string{EnvWatermarkMode: ModeTiled, EnvTileSource: TileSourceText, EnvWatermarkText: "© {year}"}, ""},
+		{"Invalid mode", map[string]string{EnvWatermarkMode: "scattered"}, "invalid watermark mode"},
+		{"Text without template", map[string]string{EnvTileSource: TileSourceText}, "requires"},
+		{"Invalid source", map[string]string{EnvTileSource: "center"}, "invalid tile source"},
+		{"Invalid angle", map[string]string{EnvTileAngle: "steep"}, EnvTileAngle},
+		{"Negative spacing", map[string]string{EnvTileSpacing: "-5"}, EnvTileSpacing},
+		{"Opacity out of range", map[string]string{EnvTileOpacity: "1.5"}, EnvTileOpacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range envVars {
+				os.Unsetenv(env)
+			}
+			for env, value := range tt.envVars {
+				os.Setenv(env, value)
+			}
+
+			err := validateTileSettings()
+			if tt.errContains == "" {
+				if err != nil {
+					t.Errorf("validateTileSettings() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("validateTileSettings() error = %v, should contain %v", err, tt.errContains)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Transform steps
+const (
+	TransformClamp   = "clamp"   // Scale down so the longer side fits: "clamp 2048"
+	TransformCrop    = "crop"    // Crop to an aspect ratio: "crop 16:9 [center|smart]"
+	TransformPad     = "pad"     // Pad to an aspect ratio: "pad 1:1 [#RRGGBB]"
+	TransformSharpen = "sharpen" // Sharpen after a downscale: "sharpen [sigma]"
+)
+
+// Crop anchors
+const (
+	CropCenter = "center" // Keep the middle of the image
+	CropSmart  = "smart"  // Keep the area with the most detail
+)
+
+// Transform defaults
+const (
+	DefaultPadColor     = "#FFFFFF"
+	DefaultSharpenSigma = 0.5
+)
+
+// Smart crop analysis works on a downscaled copy and tries a fixed number of
+// window positions along the axis being cropped
+const (
+	smartCropSize  = 256
+	smartCropSteps = 16
+)
+
+// transformStep is one parsed step of a transform chain
+type transformStep struct {
+	name   string
+	size   int         // Longest side for clamp
+	aspect image.Point // Aspect ratio for crop and pad
+	smart  bool        // Smart rather than center crop
+	color  color.NRGBA // Background of pad
+	sigma  float64     // Strength of sharpen
+}
+
+// transformChain is the ordered list of steps applied before watermarking
+type transformChain []transformStep
+
+// parseTransforms parses a semicolon separated chain of steps such as
+// "clamp 2048; crop 4:3 smart; pad 1:1 #000000; sharpen 0.6"
+func parseTransforms(spec string) (transformChain, error) {
+	var chain transformChain
+	for _, text := range strings.Split(spec, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		step := transformStep{name: strings.ToLower(fields[0])}
+		args := fields[1:]
+
+		var err error
+		switch step.name {
+		case TransformClamp:
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid %s step %q: needs a size", TransformClamp, strings.TrimSpace(text))
+			}
+			if step.size, err = strconv.Atoi(args[0]); err != nil || step.size <= 0 {
+				return nil, fmt.Errorf("invalid %s size: %s", TransformClamp, args[0])
+			}
+		case TransformCrop:
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("invalid %s step %q: needs an aspect ratio and an optional anchor", TransformCrop, strings.TrimSpace(text))
+			}
+			if step.aspect, err = parseAspect(args[0]); err != nil {
+				return nil, err
+			}
+			if len(args) == 2 {
+				switch strings.ToLower(args[1]) {
+				case CropCenter:
+				case CropSmart:
+					step.smart = true
+				default:
+					return nil, fmt.Errorf("invalid %s anchor: %s (must be %s or %s)", TransformCrop, args[1], CropCenter, CropSmart)
+				}
+			}
+		case TransformPad:
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("invalid %s step %q: needs an aspect ratio and an optional color", TransformPad, strings.TrimSpace(text))
+			}
+			if step.aspect, err = parseAspect(args[0]); err != nil {
+				return nil, err
+			}
+			background := DefaultPadColor
+			if len(args) == 2 {
+				background = args[1]
+			}
+			if step.color, err = parseHexColor(background); err != nil {
+				return nil, err
+			}
+		case TransformSharpen:
+			if len(args) > 1 {
+				return nil, fmt.Errorf("invalid %s step %q: takes an optional sigma", TransformSharpen, strings.TrimSpace(text))
+			}
+			step.sigma = DefaultSharpenSigma
+			if len(args) == 1 {
+				if step.sigma, err = strconv.ParseFloat(args[0], 64); err != nil || step.sigma <= 0 {
+					return nil, fmt.Errorf("invalid %s sigma: %s", TransformSharpen, args[0])
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown transform %s (must be %s, %s, %s or %s)", fields[0], TransformClamp, TransformCrop, TransformPad, TransformSharpen)
+		}
+		chain = append(chain, step)
+	}
+	return chain, nil
+}
+
+// parseAspect parses an aspect ratio written as W:H
+func parseAspect(s string) (image.Point, error) {
+	w, h, ok := strings.Cut(s, ":")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return image.Point{}, fmt.Errorf("invalid aspect ratio: %s (must be W:H, such as 16:9)", s)
+	}
+	return image.Pt(width, height), nil
+}
+
+// validateTransformSettings checks the optional transform chain
+func validateTransformSettings() error {
+	_, err := parseTransforms(os.Getenv(EnvTransforms))
+	return err
+}
+
+// String formats a step the way it is written in TRANSFORMS
+func (s transformStep) String() string {
+	aspect := fmt.Sprintf("%d:%d", s.aspect.X, s.aspect.Y)
+	switch s.name {
+	case TransformClamp:
+		return fmt.Sprintf("%s %d", s.name, s.size)
+	case TransformCrop:
+		if s.smart {
+			return fmt.Sprintf("%s %s %s", s.name, aspect, CropSmart)
+		}
+		return fmt.Sprintf("%s %s %s", s.name, aspect, CropCenter)
+	case TransformPad:
+		return fmt.Sprintf("%s %s #%02X%02X%02X", s.name, aspect, s.color.R, s.color.G, s.color.B)
+	default:
+		return fmt.Sprintf("%s %g", s.name, s.sigma)
+	}
+}
+
+// String formats the chain the way it is written in TRANSFORMS
+func (c transformChain) String() string {
+	steps := make([]string, len(c))
+	for i, step := range c {
+		steps[i] = step.String()
+	}
+	return strings.Join(steps, "; ")
+}
+
+// applyTransforms runs the transform chain on a decoded image. Sharpening
+// only applies once an earlier step has scaled the image down.
+func (ip *ImageProcessor) applyTransforms(key string, img image.Image) image.Image {
+	downscaled := false
+	for _, step := range ip.transforms {
+		before := img.Bounds().Size()
+		switch step.name {
+		case TransformClamp:
+			if before.X > step.size || before.Y > step.size {
+				img = imaging.Fit(img, step.size, step.size, imaging.Lanczos)
+				downscaled = true
+			}
+		case TransformCrop:
+			rect := aspectRect(img.Bounds(), step.aspect)
+			if step.smart {
+				rect = smartCropRect(img, rect)
+			}
+			img = imaging.Crop(img, rect)
+		case TransformPad:
+			img = padToAspect(img, step.aspect, step.color)
+		case TransformSharpen:
+			if !downscaled {
+				ip.logger.Printf("Skipped transform %s for %s: the image wasn't scaled down", step, key)
+				continue
+			}
+			img = imaging.Sharpen(img, step.sigma)
+		}
+		after := img.Bounds().Size()
+		ip.logger.Printf("Applied transform %s to %s: %dx%d -> %dx%d", step, key, before.X, before.Y, after.X, after.Y)
+	}
+	return img
+}
+
+// aspectRect returns the largest centered area of bounds with an aspect ratio
+func aspectRect(bounds image.Rectangle, aspect image.Point) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w*aspect.Y > h*aspect.X {
+		cropped := h * aspect.X / aspect.Y
+		x := bounds.Min.X + (w-cropped)/2
+		return image.Rect(x, bounds.Min.Y, x+cropped, bounds.Max.Y)
+	}
+	cropped := w * aspect.Y / aspect.X
+	y := bounds.Min.Y + (h-cropped)/2
+	return image.Rect(bounds.Min.X, y, bounds.Max.X, y+cropped)
+}
+
+// smartCropRect slides a crop window along the axis it is cropped on and
+// returns the position covering the most detail, scored like watermark
+// placement on a downscaled copy
+func smartCropRect(img image.Image, window image.Rectangle) image.Rectangle {
+	bounds := img.Bounds()
+	slackX, slackY := bounds.Dx()-window.Dx(), bounds.Dy()-window.Dy()
+	if slackX == 0 && slackY == 0 {
+		return window
+	}
+
+	small := imaging.Fit(img, smartCropSize, smartCropSize, imaging.Box)
+	scale := float64(small.Bounds().Dx()) / float64(bounds.Dx())
+	detail := newDetailMap(small)
+	scaled := func(r image.Rectangle) image.Rectangle {
+		r = r.Sub(bounds.Min)
+		return image.Rect(int(float64(r.Min.X)*scale), int(float64(r.Min.Y)*scale),
+			int(float64(r.Max.X)*scale), int(float64(r.Max.Y)*scale))
+	}
+
+	// Ties keep the centered window
+	best, bestScore := window, detail.score(scaled(window))
+	for i := 0; i <= smartCropSteps; i++ {
+		offset := image.Pt(bounds.Min.X+slackX*i/smartCropSteps, bounds.Min.Y+slackY*i/smartCropSteps)
+		candidate := image.Rectangle{Min: offset, Max: offset.Add(window.Size())}
+		if score := detail.score(scaled(candidate)); score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// padToAspect centers img on a background of the given color extended to an
+// aspect ratio
+func padToAspect(img image.Image, aspect image.Point, background color.NRGBA) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	paddedW, paddedH := w, h
+	if w*aspect.Y > h*aspect.X {
+		paddedH = (w*aspect.Y + aspect.X - 1) / aspect.X
+	} else {
+		paddedW = (h*aspect.X + aspect.Y - 1) / aspect.Y
+	}
+	if paddedW == w && paddedH == h {
+		return img
+	}
+	canvas := imaging.New(paddedW, paddedH, background)
+	return imaging.Paste(canvas, img, image.Pt((paddedW-w)/2, (paddedH-h)/2))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestParseTransforms(t *testing.T) {
+	chain, err := parseTransforms("clamp 2048; crop 4:3 SMART; pad 1:1 #000; sharpen 0.8; ")
+	if err != nil {
+		t.Fatalf("parseTransforms() error = %v", err)
+	}
+	if got, want := chain.String(), "clamp 2048; crop 4:3 smart; pad 1:1 #000000; sharpen 0.8"; got != want {
+		t.Errorf("parseTransforms() = %q, want %q", got, want)
+	}
+
+	defaults, err := parseTransforms("crop 16:9;pad 3:2;sharpen")
+	if err != nil {
+		t.Fatalf("parseTransforms() error = %v", err)
+	}
+	if got, want := defaults.String(), "crop 16:9 center; pad 3:2 #FFFFFF; sharpen 0.5"; got != want {
+		t.Errorf("parseTransforms() = %q, want %q", got, want)
+	}
+
+	for _, spec := range []string{
+		"clamp",
+		"clamp 0",
+		"crop 16x9",
+		"crop 0:9",
+		"crop 16:9 left",
+		"pad 1:1 white",
+		"sharpen -1",
+		"rotate 90",
+	} {
+		if _, err := parseTransforms(spec); err == nil {
+			t.Errorf("parseTransforms(%q) expected error", spec)
+		}
+	}
+}
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		src  image.Point
+		want image.Point
+	}{
+		{"Clamp landscape", "clamp 1000", image.Pt(4000, 3000), image.Pt(1000, 750)},
+		{"Clamp leaves small images", "clamp 1000", image.Pt(800, 600), image.Pt(800, 600)},
+		{"Center crop", "crop 1:1", image.Pt(400, 300), image.Pt(300, 300)},
+		{"Pad wide", "pad 1:1", image.Pt(400, 300), image.Pt(400, 400)},
+		{"Pad tall", "pad 16:9", image.Pt(300, 300), image.Pt(534, 300)},
+		{"Chain", "clamp 1000; crop 16:9; sharpen", image.Pt(2000, 2000), image.Pt(1000, 562)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := parseTransforms(tt.spec)
+			if err != nil {
+				t.Fatalf("parseTransforms() error = %v", err)
+			}
+			ip := &ImageProcessor{transforms: chain, logger: log.New(io.Discard, "", 0)}
+			got := ip.applyTransforms("photo.jpg", solidImage(tt.src.X, tt.src.Y, color.NRGBA{90, 90, 90, 255}))
+			if got.Bounds().Size() != tt.want {
+				t.Errorf("applyTransforms() size = %v, want %v", got.Bounds().Size(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPadToAspectColor(t *testing.T) {
+	padded := padToAspect(solidImage(100, 50, color.NRGBA{255, 0, 0, 255}), image.Pt(1, 1), color.NRGBA{0, 0, 255, 255})
+	if got := color.NRGBAModel.Convert(padded.At(50, 10)).(color.NRGBA); got != (color.NRGBA{0, 0, 255, 255}) {
+		t.Errorf("padding color = %v, want blue", got)
+	}
+	if got := color.NRGBAModel.Convert(padded.At(50, 50)).(color.NRGBA); got != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("center color = %v, want the image", got)
+	}
+}
+
+func TestSmartCropFollowsDetail(t *testing.T) {
+	// A flat image with a detailed patch on its right side
+	img := noisyImage(1200, 400, image.Rect(880, 0, 1180, 400))
+
+	window := aspectRect(img.Bounds(), image.Pt(1, 1))
+	rect := smartCropRect(img, window)
+	if rect.Size() != window.Size() {
+		t.Fatalf("smartCropRect() size = %v, want %v", rect.Size(), window.Size())
+	}
+	if rect.Min.X < 700 {
+		t.Errorf("smartCropRect() = %v, want the window over the detail on the right", rect)
+	}
+
+	flat := solidImage(1200, 400, color.NRGBA{128, 128, 128, 255})
+	if rect := smartCropRect(flat, window); rect != window {
+		t.Errorf("smartCropRect() of a flat image = %v, want the centered %v", rect, window)
+	}
+}
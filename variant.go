@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+)
+
+// validateVariantSettings checks the optional dark watermark variants and the
+// luminance threshold used to choose between variants
+func validateVariantSettings() error {
+	for _, env := range []string{EnvLeftWatermarkDark, EnvRightWatermarkDark} {
+		if path := os.Getenv(env); path != "" {
+			if err := validateWatermarkPath(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if v := os.Getenv(EnvLuminanceThreshold); v != "" {
+		if threshold, err := strconv.ParseFloat(v, 64); err != nil || threshold < 0 || threshold > 255 {
+			return fmt.Errorf("%s must be between 0 and 255: %s", EnvLuminanceThreshold, v)
+		}
+	}
+	return nil
+}
+
+// loadOptionalWatermark loads the watermark named by env, or returns nil when
+// it isn't set
+func loadOptionalWatermark(env string) (image.Image, error) {
+	path := os.Getenv(env)
+	if path == "" {
+		return nil, nil
+	}
+	return loadWatermarkImage(path)
+}
+
+// regionLuminance returns the mean relative luminance (0-255) of the part of
+// img covered by r
+func regionLuminance(img image.Image, r image.Rectangle) float64 {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return 0
+	}
+
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			sum += 0.2126*float64(cr>>8) + 0.7152*float64(cg>>8) + 0.0722*float64(cb>>8)
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// selectVariant returns the variant of a watermark that contrasts best with
+// the region of img it will cover: the dark variant on backgrounds brighter
+// than the threshold and the light one otherwise
+func (ip *ImageProcessor) selectVariant(slot string, img image.Image, light, dark image.Image, region image.Rectangle) image.Image {
+	if dark == nil {
+		return light
+	}
+
+	luminance := regionLuminance(img, region)
+	if luminance > ip.lumaThreshold {
+		ip.logger.Printf("Using dark %s watermark: background luminance %.1f is above threshold %.1f",
+			slot, luminance, ip.lumaThreshold)
+		return dark
+	}
+	ip.logger.Printf("Using light %s watermark: background luminance %.1f is at or below threshold %.1f",
+		slot, luminance, ip.lumaThreshold)
+	return light
+}
+
+// watermarkSize returns the size of a watermark once it has been scaled down
+// to MaxWatermarkHeight
+func watermarkSize(wm image.Image) image.Point {
+	size := wm.Bounds().Size()
+	if size.Y > MaxWatermarkHeight {
+		size.X = size.X * MaxWatermarkHeight / size.Y
+		size.Y = MaxWatermarkHeight
+	}
+	return size
+}
+
+// cornerPoint returns where a watermark of the given size is placed in
+// corners mode
+func cornerPoint(slot string, bounds image.Rectangle, size image.Point) image.Point {
+	y := bounds.Dy() - MaxWatermarkHeight - WatermarkPadding
+	if slot == "right" {
+		return image.Pt(bounds.Dx()-size.X-WatermarkPadding, y)
+	}
+	return image.Pt(WatermarkPadding, y)
+}
+
+// cornerRegion returns the area a watermark covers in corners mode when
+// placed at anchor a, or at its fixed corner position when a is empty
+func cornerRegion(slot string, a anchor, bounds image.Rectangle, wm image.Image) image.Rectangle {
+	size := watermarkSize(wm)
+	pt := watermarkPoint(slot, a, bounds, size)
+	return image.Rectangle{Min: pt, Max: pt.Add(size)}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"testing"
+)
+
+// solidImage returns an image filled with a single color
+func solidImage(width, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestRegionLuminance(t *testing.T) {
+	img := solidImage(100, 100, color.White)
+	for x := 0; x < 50; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.Black)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		region image.Rectangle
+		want   float64
+	}{
+		{"Black half", image.Rect(0, 0, 50, 100), 0},
+		{"White half", image.Rect(50, 0, 100, 100), 255},
+		{"Mixed", image.Rect(25, 0, 75, 100), 127.5},
+		{"Clipped to bounds", image.Rect(50, 50, 200, 200), 255},
+		{"Outside bounds", image.Rect(200, 200, 300, 300), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := regionLuminance(img, tt.region)
+			if got < tt.want-0.01 || got > tt.want+0.01 {
+				t.Errorf("regionLuminance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	ip := &ImageProcessor{
+		lumaThreshold: DefaultLuminanceThreshold,
+		logger:        log.New(io.Discard, "", 0),
+	}
+	light := solidImage(10, 10, color.White)
+	dark := solidImage(10, 10, color.Black)
+	region := image.Rect(0, 0, 50, 50)
+
+	if got := ip.selectVariant("left", solidImage(50, 50, color.White), light, dark, region); got != dark {
+		t.Error("selectVariant() on bright background should pick the dark variant")
+	}
+	if got := ip.selectVariant("left", solidImage(50, 50, color.Black), light, dark, region); got != light {
+		t.Error("selectVariant() on dark background should pick the light variant")
+	}
+	if got := ip.selectVariant("left", solidImage(50, 50, color.White), light, nil, region); got != light {
+		t.Error("selectVariant() without a dark variant should keep the light one")
+	}
+}
+
+func TestCornerRegion(t *testing.T) {
+	bounds := image.Rect(0, 0, 1000, 800)
+	wm := image.NewNRGBA(image.Rect(0, 0, 200, 500))
+
+	if got := watermarkSize(wm); got != image.Pt(100, MaxWatermarkHeight) {
+		t.Errorf("watermarkSize() = %v, want %v", got, image.Pt(100, MaxWatermarkHeight))
+	}
+
+	y := 800 - MaxWatermarkHeight - WatermarkPadding
+	if got, want := cornerRegion("left", "", bounds, wm), image.Rect(20, y, 120, y+MaxWatermarkHeight); got != want {
+		t.Errorf("cornerRegion(left) = %v, want %v", got, want)
+	}
+	if got, want := cornerRegion("right", "", bounds, wm), image.Rect(880, y, 980, y+MaxWatermarkHeight); got != want {
+		t.Errorf("cornerRegion(right) = %v, want %v", got, want)
+	}
+	if got, want := cornerRegion("left", anchorTopRight, bounds, wm), image.Rect(880, 20, 980, 20+MaxWatermarkHeight); got != want {
+		t.Errorf("cornerRegion(left, top-right) = %v, want %v", got, want)
+	}
+}
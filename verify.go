@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/disintegration/imaging"
+)
+
+// Scales at which logos are searched for, relative to the processed output,
+// so downscaled copies are still recognized
+var verifyScales = []float64{1, 0.75, 0.5, 0.375, 0.25}
+
+// verifySearchRadius is how far in pixels around each expected position a
+// logo is searched for
+const verifySearchRadius = 4
+
+// LogoMatchThreshold is the correlation score above which a logo counts as found
+const LogoMatchThreshold = 0.6
+
+// logoMatch is the best match of an expected logo in a suspected copy
+type logoMatch struct {
+	Slot    string  `json:"slot"`
+	Variant string  `json:"variant"`
+	Anchor  string  `json:"anchor"`
+	Scale   float64 `json:"scale"`
+	Score   float64 `json:"score"`
+	Found   bool    `json:"found"`
+}
+
+// verifyReport is the outcome of checking a suspected copy
+type verifyReport struct {
+	Source          string      `json:"source"`
+	Width           int         `json:"width"`
+	Height          int         `json:"height"`
+	Payload         string      `json:"payload,omitempty"`
+	PayloadValid    bool        `json:"payload_valid"`
+	PayloadScore    float64     `json:"payload_confidence"`
+	ExpectedPayload string      `json:"expected_payload,omitempty"`
+	PayloadMatches  *bool       `json:"payload_matches,omitempty"` // Set only with -expect
+	Logos           []logoMatch `json:"logos"`
+}
+
+// runVerify implements the verify command, which checks a local file or S3
+// object for our invisible payload and visible logos
+func runVerify(ctx context.Context, logger *log.Logger, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	expect := flags.String("expect", "", "payload the invisible watermark should contain")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify [-expect payload] [-json] <file | s3://bucket/key | key>")
+	}
+	source := flags.Arg(0)
+
+	data, _, err := readVerifySource(ctx, source)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", source, err)
+	}
+	logger.Printf("Verifying %s (%dx%d)", source, img.Bounds().Dx(), img.Bounds().Dy())
+
+	key := os.Getenv(EnvInvisibleKey)
+	if key == "" {
+		key = DefaultInvisibleKey
+	}
+	logos, err := loadVerifyLogos()
+	if err != nil {
+		return err
+	}
+
+	report := verifyImage(img, key, logos)
+	report.Source = source
+	if *expect != "" {
+		report.ExpectedPayload = *expect
+		matches := report.PayloadValid && report.Payload == *expect
+		report.PayloadMatches = &matches
+	}
+
+	if *asJSON {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+		return nil
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+// readVerifySource reads a local file, an s3://bucket/key URI or a key in
+// the configured bucket, along with the S3 user metadata of objects
+func readVerifySource(ctx context.Context, source string) ([]byte, map[string]string, error) {
+	if _, err := os.Stat(source); err == nil {
+		data, err := os.ReadFile(source)
+		return data, nil, err
+	}
+
+	bucket, key := os.Getenv(EnvBucket), source
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, key, _ = strings.Cut(rest, "/")
+	}
+	if bucket == "" {
+		return nil, nil, fmt.Errorf("%s is not a local file and %s is not set", source, EnvBucket)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+	result, err := s3.NewFromConfig(cfg).GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get object %s: %v", key, err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read object %s: %v", key, err)
+	}
+	return data, result.Metadata, nil
+}
+
+// verifyLogo is an expected logo variant
+type verifyLogo struct {
+	slot    string
+	variant string
+	img     image.Image
+}
+
+// loadVerifyLogos loads whichever watermark images are configured
+func loadVerifyLogos() ([]verifyLogo, error) {
+	var logos []verifyLogo
+	for _, logo := range []struct {
+		slot, variant, env string
+	}{
+		{"left", "light", EnvLeftWatermark},
+		{"left", "dark", EnvLeftWatermarkDark},
+		{"right", "light", EnvRightWatermark},
+		{"right", "dark", EnvRightWatermarkDark},
+	} {
+		img, err := loadOptionalWatermark(logo.env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s %s watermark: %v", logo.variant, logo.slot, err)
+		}
+		if img != nil {
+			logos = append(logos, verifyLogo{slot: logo.slot, variant: logo.variant, img: img})
+		}
+	}
+	return logos, nil
+}
+
+// verifyImage extracts the invisible payload and looks for each logo
+func verifyImage(img image.Image, key string, logos []verifyLogo) *verifyReport {
+	invisible := extractInvisibleWatermark(img, key)
+	report := &verifyReport{
+		Width:        img.Bounds().Dx(),
+		Height:       img.Bounds().Dy(),
+		Payload:      invisible.Payload,
+		PayloadValid: invisible.Valid,
+		PayloadScore: invisible.Confidence,
+	}
+
+	luma := newDetailMap(img).gray
+	for _, logo := range logos {
+		match := matchLogo(luma, logo.img, logo.slot)
+		match.Variant = logo.variant
+		report.Logos = append(report.Logos, match)
+	}
+	return report
+}
+
+// matchLogo searches the positions a logo can be placed at, at several
+// scales, and returns the best normalized cross-correlation
+func matchLogo(luma *image.Gray, logo image.Image, slot string) logoMatch {
+	best := logoMatch{Slot: slot, Score: -1}
+	bounds := luma.Bounds()
+
+	for _, scale := range verifyScales {
+		// Dimensions of the processed output this copy was scaled from
+		original := image.Rect(0, 0, int(float64(bounds.Dx())/scale), int(float64(bounds.Dy())/scale))
+		size := watermarkSize(logo)
+		scaled := image.Pt(int(float64(size.X)*scale), int(float64(size.Y)*scale))
+		if scaled.X < 8 || scaled.Y < 8 {
+			continue
+		}
+		template := logoTemplate(logo, scaled)
+
+		anchors := append([]anchor{""}, placementCandidates...)
+		for _, a := range anchors {
+			pt := watermarkPoint(slot, a, original, size)
+			pt = image.Pt(int(float64(pt.X)*scale), int(float64(pt.Y)*scale))
+			for dy := -verifySearchRadius; dy <= verifySearchRadius; dy += 2 {
+				for dx := -verifySearchRadius; dx <= verifySearchRadius; dx += 2 {
+					score := correlate(luma, template, pt.Add(image.Pt(dx, dy)))
+					if score > best.Score {
+						name := string(a)
+						if a == "" {
+							name = "corner"
+						}
+						best = logoMatch{Slot: slot, Anchor: name, Scale: scale, Score: score}
+					}
+				}
+			}
+		}
+	}
+
+	best.Score = math.Max(0, best.Score)
+	best.Found = best.Score >= LogoMatchThreshold
+	return best
+}
+
+// logoTemplate renders a logo over mid gray at the given size and returns
+// its luminance
+func logoTemplate(logo image.Image, size image.Point) *image.Gray {
+	resized := imaging.Resize(logo, size.X, size.Y, imaging.Lanczos)
+	composited := imaging.Overlay(imaging.New(size.X, size.Y, color.Gray{Y: 128}), resized, image.Pt(0, 0), 1.0)
+	return newDetailMap(composited).gray
+}
+
+// correlate returns the normalized cross-correlation between the template
+// and the area of luma at pt, or -1 when the area is out of bounds or flat
+func correlate(luma, template *image.Gray, pt image.Point) float64 {
+	r := template.Bounds().Add(pt)
+	if !r.In(luma.Bounds()) {
+		return -1
+	}
+
+	n := float64(r.Dx() * r.Dy())
+	var sumT, sumI, sumTT, sumII, sumTI float64
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			t := float64(template.GrayAt(x, y).Y)
+			i := float64(luma.GrayAt(r.Min.X+x, r.Min.Y+y).Y)
+			sumT += t
+			sumI += i
+			sumTT += t * t
+			sumII += i * i
+			sumTI += t * i
+		}
+	}
+
+	varT := sumTT - sumT*sumT/n
+	varI := sumII - sumI*sumI/n
+	if varT <= 0 || varI <= 0 {
+		return -1
+	}
+	return (sumTI - sumT*sumI/n) / math.Sqrt(varT*varI)
+}
+
+// print writes a human readable report
+func (r *verifyReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Source: %s (%dx%d)\n", r.Source, r.Width, r.Height)
+	if r.PayloadValid {
+		fmt.Fprintf(w, "Invisible watermark: %q (confidence %.2f)\n", r.Payload, r.PayloadScore)
+	} else {
+		fmt.Fprintf(w, "Invisible watermark: not found (confidence %.2f)\n", r.PayloadScore)
+	}
+	if r.PayloadMatches != nil {
+		fmt.Fprintf(w, "Expected payload %q: match=%v\n", r.ExpectedPayload, *r.PayloadMatches)
+	}
+	if len(r.Logos) == 0 {
+		fmt.Fprintf(w, "Visible logos: no watermark images configured\n")
+	}
+	for _, logo := range r.Logos {
+		status := "not found"
+		if logo.Found {
+			status = "found"
+		}
+		fmt.Fprintf(w, "Visible %s logo (%s): %s, score %.2f at %s, scale %.2f\n",
+			logo.Slot, logo.Variant, status, logo.Score, logo.Anchor, logo.Scale)
+	}
+}
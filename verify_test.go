@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// checkerLogo returns a logo with enough structure to be matched
+func checkerLogo(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 240, G: 240, B: 240, A: 255}
+			if (x/10+y/10)%2 == 0 {
+				c = color.NRGBA{R: 20, G: 20, B: 60, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestVerifyImage(t *testing.T) {
+	logo := checkerLogo(120, 60)
+	processor := &ImageProcessor{
+		leftWatermark:  logo,
+		rightWatermark: logo,
+		mode:           ModeCorners,
+		placement:      PlacementFixed,
+		lumaThreshold:  DefaultLuminanceThreshold,
+		logger:         log.New(io.Discard, "", 0),
+	}
+
+	photo := photoLikeImage(1024, 768)
+	watermarked, err := processor.addWatermark(photo, "", "")
+	if err != nil {
+		t.Fatalf("addWatermark() error = %v", err)
+	}
+	marked, err := embedInvisibleWatermark(watermarked, "IMG-42", "secret", DefaultInvisibleStrength)
+	if err != nil {
+		t.Fatalf("embedInvisibleWatermark() error = %v", err)
+	}
+	logos := []verifyLogo{{slot: "left", variant: "light", img: logo}, {slot: "right", variant: "light", img: logo}}
+
+	tests := []struct {
+		name        string
+		img         image.Image
+		wantPayload bool
+		wantLogos   bool
+	}{
+		{"Watermarked", marked, true, true},
+		{"Downscaled copy", imaging.Resize(marked, 512, 0, imaging.Lanczos), true, true},
+		{"Unmarked", photo, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := verifyImage(tt.img, "secret", logos)
+			if report.PayloadValid != tt.wantPayload {
+				t.Errorf("PayloadValid = %v, want %v", report.PayloadValid, tt.wantPayload)
+			}
+			if tt.wantPayload && report.Payload != "IMG-42" {
+				t.Errorf("Payload = %q, want %q", report.Payload, "IMG-42")
+			}
+			for _, m := range report.Logos {
+				if m.Found != tt.wantLogos {
+					t.Errorf("%s logo found = %v (score %.2f), want %v", m.Slot, m.Found, m.Score, tt.wantLogos)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyReportPayloadMatchJSON(t *testing.T) {
+	report := &verifyReport{Source: "leaked.jpg"}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if strings.Contains(string(encoded), "payload_matches") {
+		t.Errorf("report without -expect = %s, want no payload_matches", encoded)
+	}
+
+	// A failed match must be reported, not dropped as an empty value
+	matches := false
+	report.ExpectedPayload = "IMG-000123"
+	report.PayloadMatches = &matches
+	if encoded, err = json.Marshal(report); err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if !strings.Contains(string(encoded), `"payload_matches":false`) {
+		t.Errorf("report with a failed match = %s, want payload_matches false", encoded)
+	}
+}
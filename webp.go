@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	// Also registers the WebP decoder with image.Decode
+	"golang.org/x/image/webp"
+)
+
+// webpChunk is a RIFF chunk of a WebP file
+type webpChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+// VP8X feature flags
+const (
+	webpFlagICC   = 0x20
+	webpFlagAlpha = 0x10
+	webpFlagEXIF  = 0x08
+	webpFlagXMP   = 0x04
+)
+
+// isWebP reports whether data starts with a WebP RIFF header
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// webpChunks splits a WebP file into its RIFF chunks
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if !isWebP(data) {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+
+	var chunks []webpChunk
+	pos := 12
+	for pos+8 <= len(data) {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if size > len(data)-pos {
+			return nil, fmt.Errorf("truncated WebP chunk %q", fourCC)
+		}
+		chunks = append(chunks, webpChunk{FourCC: fourCC, Data: data[pos : pos+size]})
+		// Chunks are padded to an even size
+		pos += size + size&1
+	}
+	return chunks, nil
+}
+
+// checkWebPEncoder fails when setting asks for WebP outputs from a build
+// without the WebP encoder
+func checkWebPEncoder(setting string) error {
+	if !webpEncoder {
+		return fmt.Errorf("%s: WebP outputs need a build with cgo enabled", setting)
+	}
+	return nil
+}
+
+// embedWebPMetadata rewrites an encoded WebP in the extended format with an
+// ICC profile, EXIF and XMP chunks in the order the container requires
+func embedWebPMetadata(data []byte, m *imageMetadata) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.exif == nil && m.xmp == nil && m.icc == nil {
+		return data, nil
+	}
+
+	var flags byte
+	var width, height int
+	var frames []webpChunk
+	for _, chunk := range chunks {
+		switch chunk.FourCC {
+		case "VP8X":
+			if len(chunk.Data) < 10 {
+				return nil, fmt.Errorf("invalid VP8X chunk")
+			}
+			flags = chunk.Data[0] &^ (webpFlagICC | webpFlagEXIF | webpFlagXMP)
+			width = int(uint32(chunk.Data[4])|uint32(chunk.Data[5])<<8|uint32(chunk.Data[6])<<16) + 1
+			height = int(uint32(chunk.Data[7])|uint32(chunk.Data[8])<<8|uint32(chunk.Data[9])<<16) + 1
+		case "ICCP", "EXIF", "XMP ":
+			// Replaced below
+		default:
+			frames = append(frames, chunk)
+		}
+	}
+
+	// Simple files carry the size and alpha in the bitstream header
+	if width == 0 {
+		cfg, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WebP size: %v", err)
+		}
+		width, height = cfg.Width, cfg.Height
+		for _, chunk := range frames {
+			if chunk.FourCC == "ALPH" || chunk.FourCC == "VP8L" && len(chunk.Data) >= 5 && chunk.Data[4]&0x10 != 0 {
+				flags |= webpFlagAlpha
+			}
+		}
+	}
+
+	out := []webpChunk{{FourCC: "VP8X"}}
+	if m.icc != nil {
+		flags |= webpFlagICC
+		out = append(out, webpChunk{FourCC: "ICCP", Data: m.icc})
+	}
+	out = append(out, frames...)
+	if m.exif != nil {
+		flags |= webpFlagEXIF
+		out = append(out, webpChunk{FourCC: "EXIF", Data: m.exif.Encode()})
+	}
+	if m.xmp != nil {
+		flags |= webpFlagXMP
+		out = append(out, webpChunk{FourCC: "XMP ", Data: m.xmp})
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24(vp8x[4:], uint32(width-1))
+	putUint24(vp8x[7:], uint32(height-1))
+	out[0].Data = vp8x
+
+	var body []byte
+	for _, chunk := range out {
+		body = append(body, chunk.FourCC...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(chunk.Data)))
+		body = append(body, chunk.Data...)
+		if len(chunk.Data)&1 == 1 {
+			body = append(body, 0)
+		}
+	}
+
+	file := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(file[4:], uint32(4+len(body)))
+	file = append(file, "WEBP"...)
+	return append(file, body...), nil
+}
+
+// putUint24 writes a little endian 24 bit value
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,22 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+// webpEncoder reports whether this build can write WebP outputs
+const webpEncoder = true
+
+// encodeWebP encodes an image as lossy WebP at the given quality, or lossless
+func encodeWebP(img image.Image, lossless bool, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Lossless: lossless, Quality: float32(quality)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// webpEncoder reports whether this build can write WebP outputs. The WebP
+// encoder wraps libwebp, so builds without cgo only decode WebP.
+const webpEncoder = false
+
+// encodeWebP fails, since this build has no WebP encoder
+func encodeWebP(img image.Image, lossless bool, quality int) ([]byte, error) {
+	return nil, fmt.Errorf("WebP encoding needs a build with cgo enabled")
+}
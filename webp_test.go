@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// skipWithoutWebPEncoder skips tests that write WebP in builds without cgo
+func skipWithoutWebPEncoder(t *testing.T) {
+	t.Helper()
+	if !webpEncoder {
+		t.Skip("WebP encoder needs cgo")
+	}
+}
+
+func TestCheckWebPEncoder(t *testing.T) {
+	if err := checkWebPEncoder(EnvOutputFormat); (err != nil) == webpEncoder {
+		t.Errorf("checkWebPEncoder() error = %v, want error %v", err, !webpEncoder)
+	}
+}
+
+func TestWebPMetadataRoundTrip(t *testing.T) {
+	skipWithoutWebPEncoder(t)
+	exif := buildTestEXIF([]testIFDEntry{{tag: 0x013B, typ: 2, count: 11, value: asciiValue("Jane Smith")}}, nil)
+	source := &imageMetadata{
+		xmp: []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`),
+		icc: testICCProfile(),
+	}
+	var err error
+	if source.exif, err = parseEXIF(exif); err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+
+	img := solidImage(40, 30, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+	tests := []struct {
+		name     string
+		lossless bool
+	}{
+		{"Lossy", false},
+		{"Lossless", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeWebP(img, tt.lossless, DefaultWebPQuality)
+			if err != nil {
+				t.Fatalf("encodeWebP() error = %v", err)
+			}
+			embedded, err := embedWebPMetadata(encoded, source)
+			if err != nil {
+				t.Fatalf("embedWebPMetadata() error = %v", err)
+			}
+			if sniffFormat(embedded) != "webp" {
+				t.Errorf("sniffFormat() = %q, want webp", sniffFormat(embedded))
+			}
+
+			decoded, err := decodeImage(embedded)
+			if err != nil {
+				t.Fatalf("Output with metadata is not a valid WebP: %v", err)
+			}
+			if decoded.Bounds().Size() != image.Pt(40, 30) {
+				t.Errorf("decoded size = %v, want 40x30", decoded.Bounds().Size())
+			}
+
+			meta, err := extractMetadata(embedded)
+			if err != nil {
+				t.Fatalf("extractMetadata() error = %v", err)
+			}
+			if meta.exif == nil || meta.exif.Fields()["Artist"] != "Jane Smith" {
+				t.Errorf("extractMetadata() did not preserve EXIF")
+			}
+			if !bytes.Equal(meta.xmp, source.xmp) {
+				t.Errorf("extractMetadata() xmp = %q, want %q", meta.xmp, source.xmp)
+			}
+			if !bytes.Equal(meta.icc, source.icc) {
+				t.Errorf("extractMetadata() did not preserve the ICC profile")
+			}
+		})
+	}
+}
+
+func TestOutputKey(t *testing.T) {
+	tests := []struct {
+		format string
+		key    string
+		want   string
+	}{
+		{FormatJPEG, "processed/photo.png", "processed/photo.png"},
+		{FormatWebP, "processed/photo.jpg", "processed/photo.webp"},
+		{FormatWebP, "processed/upload-7f3a", "processed/upload-7f3a.webp"},
+		{FormatGIF, "processed/loop.gif", "processed/loop.gif"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.key, func(t *testing.T) {
+			ip := &ImageProcessor{}
+			if got := ip.outputKey(tt.key, tt.format); got != tt.want {
+				t.Errorf("outputKey() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebPOrientation(t *testing.T) {
+	skipWithoutWebPEncoder(t)
+	encoded, err := encodeWebP(solidImage(64, 32, color.White), true, DefaultWebPQuality)
+	if err != nil {
+		t.Fatalf("encodeWebP() error = %v", err)
+	}
+	exif := buildTestEXIF([]testIFDEntry{{tag: 0x0112, typ: 3, count: 1, value: []byte{8, 0}}}, nil)
+	ex, err := parseEXIF(exif)
+	if err != nil {
+		t.Fatalf("parseEXIF() error = %v", err)
+	}
+	data, err := embedWebPMetadata(encoded, &imageMetadata{exif: ex})
+	if err != nil {
+		t.Fatalf("embedWebPMetadata() error = %v", err)
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("decodeImage() error = %v", err)
+	}
+	if img.Bounds().Dx() != 32 || img.Bounds().Dy() != 64 {
+		t.Errorf("decodeImage() dimensions = %dx%d, want 32x64", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
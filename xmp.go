@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// xmpRights holds the rights management fields written into output XMP
+type xmpRights struct {
+	Creator      string
+	Copyright    string
+	CreditLine   string
+	WebStatement string
+	LicensorURL  string
+}
+
+// Namespaces of the XMP properties we write
+const (
+	xmpNSRDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNSDC        = "http://purl.org/dc/elements/1.1/"
+	xmpNSPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+	xmpNSRights    = "http://ns.adobe.com/xap/1.0/rights/"
+	xmpNSPlus      = "http://ns.useplus.org/ldf/xmp/1.0/"
+)
+
+// loadRightsTemplates reads the rights field templates from the environment
+func loadRightsTemplates() xmpRights {
+	return xmpRights{
+		Creator:      os.Getenv(EnvXMPCreator),
+		Copyright:    os.Getenv(EnvXMPCopyright),
+		CreditLine:   os.Getenv(EnvXMPCreditLine),
+		WebStatement: os.Getenv(EnvXMPWebStatement),
+		LicensorURL:  os.Getenv(EnvXMPLicensorURL),
+	}
+}
+
+// isEmpty reports whether no rights field is set
+func (r xmpRights) isEmpty() bool {
+	return r == xmpRights{}
+}
+
+// templates returns all field templates joined, for detecting which
+// variables they use
+func (r xmpRights) templates() string {
+	return strings.Join([]string{r.Creator, r.Copyright, r.CreditLine, r.WebStatement, r.LicensorURL}, "\n")
+}
+
+// render expands the field templates for one image
+func (r xmpRights) render(vars templateVars) xmpRights {
+	return xmpRights{
+		Creator:      renderTemplate(r.Creator, vars),
+		Copyright:    renderTemplate(r.Copyright, vars),
+		CreditLine:   renderTemplate(r.CreditLine, vars),
+		WebStatement: renderTemplate(r.WebStatement, vars),
+		LicensorURL:  renderTemplate(r.LicensorURL, vars),
+	}
+}
+
+// xmpRightsProperties lists every XMP property the rights fields write
+var xmpRightsProperties = []string{"dc:creator", "dc:rights", "xmpRights:Marked", "photoshop:Credit", "xmpRights:WebStatement", "plus:Licensor"}
+
+// xmpRightsPatterns holds the compiled patterns of the rights properties, so
+// they're compiled once rather than for every image
+var xmpRightsPatterns = newXMPPropertyPatterns(xmpRightsProperties)
+
+// xmpPropertyPattern matches a property written either as an element or as
+// an attribute of an rdf:Description
+type xmpPropertyPattern struct {
+	element   *regexp.Regexp
+	attribute *regexp.Regexp
+}
+
+// newXMPPropertyPatterns compiles the patterns of the qualified property names
+func newXMPPropertyPatterns(props []string) map[string]xmpPropertyPattern {
+	patterns := make(map[string]xmpPropertyPattern, len(props))
+	for _, prop := range props {
+		name := regexp.QuoteMeta(prop)
+		patterns[prop] = xmpPropertyPattern{
+			element:   regexp.MustCompile(`(?s)\s*<` + name + `(\s[^>]*)?(/>|>.*?</` + name + `>)`),
+			attribute: regexp.MustCompile(`\s` + name + `\s*=\s*("[^"]*"|'[^']*')`),
+		}
+	}
+	return patterns
+}
+
+// properties returns the qualified XMP property names of the fields that are set
+func (r xmpRights) properties() []string {
+	var props []string
+	if r.Creator != "" {
+		props = append(props, "dc:creator")
+	}
+	if r.Copyright != "" {
+		props = append(props, "dc:rights", "xmpRights:Marked")
+	}
+	if r.CreditLine != "" {
+		props = append(props, "photoshop:Credit")
+	}
+	if r.WebStatement != "" {
+		props = append(props, "xmpRights:WebStatement")
+	}
+	if r.LicensorURL != "" {
+		props = append(props, "plus:Licensor")
+	}
+	return props
+}
+
+// description renders the fields as an rdf:Description element
+func (r xmpRights) description() string {
+	var b strings.Builder
+	b.WriteString(`  <rdf:Description rdf:about=""` +
+		` xmlns:dc="` + xmpNSDC + `"` +
+		` xmlns:photoshop="` + xmpNSPhotoshop + `"` +
+		` xmlns:xmpRights="` + xmpNSRights + `"` +
+		` xmlns:plus="` + xmpNSPlus + `">` + "\n")
+
+	if r.Creator != "" {
+		b.WriteString("   <dc:creator><rdf:Seq><rdf:li>" + xmlEscape(r.Creator) + "</rdf:li></rdf:Seq></dc:creator>\n")
+	}
+	if r.Copyright != "" {
+		b.WriteString(`   <dc:rights><rdf:Alt><rdf:li xml:lang="x-default">` + xmlEscape(r.Copyright) + "</rdf:li></rdf:Alt></dc:rights>\n")
+		b.WriteString("   <xmpRights:Marked>True</xmpRights:Marked>\n")
+	}
+	if r.CreditLine != "" {
+		b.WriteString("   <photoshop:Credit>" + xmlEscape(r.CreditLine) + "</photoshop:Credit>\n")
+	}
+	if r.WebStatement != "" {
+		b.WriteString("   <xmpRights:WebStatement>" + xmlEscape(r.WebStatement) + "</xmpRights:WebStatement>\n")
+	}
+	if r.LicensorURL != "" {
+		b.WriteString(`   <plus:Licensor><rdf:Seq><rdf:li rdf:parseType="Resource"><plus:LicensorURL>` +
+			xmlEscape(r.LicensorURL) + "</plus:LicensorURL></rdf:li></rdf:Seq></plus:Licensor>\n")
+	}
+	b.WriteString("  </rdf:Description>\n")
+	return b.String()
+}
+
+// apply writes the fields into an XMP packet. Existing values of the same
+// properties are replaced and everything else in the packet is kept. A new
+// packet is created when xmp is empty.
+func (r xmpRights) apply(xmp []byte) []byte {
+	if r.isEmpty() {
+		return xmp
+	}
+
+	end := bytes.LastIndex(xmp, []byte("</rdf:RDF>"))
+	if end < 0 {
+		return []byte(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` + "\n" +
+			`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n" +
+			` <rdf:RDF xmlns:rdf="` + xmpNSRDF + `">` + "\n" +
+			r.description() +
+			" </rdf:RDF>\n" +
+			"</x:xmpmeta>\n" +
+			`<?xpacket end="w"?>`)
+	}
+
+	packet := string(xmp)
+	for _, prop := range r.properties() {
+		packet = xmpRightsPatterns[prop].remove(packet)
+	}
+	end = strings.LastIndex(packet, "</rdf:RDF>")
+	return []byte(packet[:end] + r.description() + packet[end:])
+}
+
+// remove deletes every occurrence of the property from a packet
+func (p xmpPropertyPattern) remove(packet string) string {
+	packet = p.element.ReplaceAllString(packet, "")
+	return p.attribute.ReplaceAllString(packet, "")
+}
+
+// xmlEscape escapes text for use in XML character data
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// checkWellFormed fails the test if data is not well-formed XML
+func checkWellFormed(t *testing.T, data []byte) {
+	t.Helper()
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("XMP packet is not well-formed: %v\n%s", err, data)
+		}
+	}
+}
+
+func TestXMPRightsNewPacket(t *testing.T) {
+	rights := xmpRights{
+		Creator:      "Jane <Smith>",
+		Copyright:    "© 2024 Jane & Co",
+		CreditLine:   "Jane Smith / Acme",
+		WebStatement: "https://example.com/license?id=1&v=2",
+		LicensorURL:  "https://example.com/licensing",
+	}
+
+	packet := rights.apply(nil)
+	checkWellFormed(t, packet)
+
+	for _, want := range []string{
+		"<dc:creator><rdf:Seq><rdf:li>Jane &lt;Smith&gt;</rdf:li>",
+		`<rdf:li xml:lang="x-default">© 2024 Jane &amp; Co</rdf:li>`,
+		"<xmpRights:Marked>True</xmpRights:Marked>",
+		"<photoshop:Credit>Jane Smith / Acme</photoshop:Credit>",
+		"<xmpRights:WebStatement>https://example.com/license?id=1&amp;v=2</xmpRights:WebStatement>",
+		"<plus:LicensorURL>https://example.com/licensing</plus:LicensorURL>",
+	} {
+		if !strings.Contains(string(packet), want) {
+			t.Errorf("apply() packet missing %s", want)
+		}
+	}
+}
+
+func TestXMPRightsMergesExistingPacket(t *testing.T) {
+	source := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    photoshop:Credit="Old Credit" xmp:Rating="5">
+   <dc:creator><rdf:Seq><rdf:li>Old Creator</rdf:li></rdf:Seq></dc:creator>
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Sunset</rdf:li></rdf:Alt></dc:title>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`)
+
+	packet := string(xmpRights{Creator: "New Creator", CreditLine: "New Credit"}.apply(source))
+	checkWellFormed(t, []byte(packet))
+
+	for _, gone := range []string{"Old Creator", "Old Credit"} {
+		if strings.Contains(packet, gone) {
+			t.Errorf("apply() kept replaced value %q", gone)
+		}
+	}
+	for _, kept := range []string{"New Creator", "New Credit", "Sunset", `xmp:Rating="5"`} {
+		if !strings.Contains(packet, kept) {
+			t.Errorf("apply() packet missing %q", kept)
+		}
+	}
+}
+
+func TestXMPRightsRender(t *testing.T) {
+	templates := xmpRights{Copyright: "© {photographer} {year}", LicensorURL: "https://example.com/license/{name}"}
+	rendered := templates.render(templateVars{"photographer": "Jane", "year": "2024", "name": "beach"})
+
+	if rendered.Copyright != "© Jane 2024" {
+		t.Errorf("render() Copyright = %q", rendered.Copyright)
+	}
+	if rendered.LicensorURL != "https://example.com/license/beach" {
+		t.Errorf("render() LicensorURL = %q", rendered.LicensorURL)
+	}
+	if (xmpRights{}).apply([]byte("keep")) == nil {
+		t.Error("apply() with no fields should keep the packet")
+	}
+}
+
+func TestXMPRightsPatterns(t *testing.T) {
+	all := xmpRights{Creator: "a", Copyright: "b", CreditLine: "c", WebStatement: "d", LicensorURL: "e"}
+	for _, prop := range all.properties() {
+		if _, ok := xmpRightsPatterns[prop]; !ok {
+			t.Errorf("no compiled pattern for XMP property %s", prop)
+		}
+	}
+
+	packet := `<rdf:Description photoshop:Credit="Old"><photoshop:Credit>Old</photoshop:Credit><dc:title>Beach</dc:title></rdf:Description>`
+	if got := xmpRightsPatterns["photoshop:Credit"].remove(packet); got != `<rdf:Description><dc:title>Beach</dc:title></rdf:Description>` {
+		t.Errorf("remove() = %s", got)
+	}
+}